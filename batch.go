@@ -0,0 +1,124 @@
+package store
+
+import (
+    "context"
+    "time"
+)
+
+type (
+    // BatchStore 批量操作. MGet 的结果不包含不存在的 key, MExist 的结果包含所有 key
+    BatchStore interface {
+        ContextStore
+        MGet(keys ...string) (map[string][]byte, error)
+        MGetContext(ctx context.Context, keys ...string) (map[string][]byte, error)
+        MPut(kvs map[string][]byte) error
+        MPutTTL(kvs map[string][]byte, ttl time.Duration) error
+        MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error
+        MDelete(keys ...string) error
+        MDeleteContext(ctx context.Context, keys ...string) error
+        MExist(keys ...string) (map[string]bool, error)
+        MExistContext(ctx context.Context, keys ...string) (map[string]bool, error)
+    }
+    batchStore struct {
+        ContextStore
+    }
+)
+
+// WithBatch 返回 s 的 BatchStore 版本.
+// s 本身实现了 BatchStore 时直接返回, 否则逐个 key 调用单 key 方法
+func WithBatch(s Store) BatchStore {
+    if bs, ok := s.(BatchStore); ok {
+        return bs
+    }
+    return batchStore{ContextStore: WithContext(s)}
+}
+
+// MGet 批量读取, s 不支持批量操作时逐个读取
+func MGet(s Store, keys ...string) (map[string][]byte, error) {
+    return WithBatch(s).MGet(keys...)
+}
+
+// MPut 批量写入, s 不支持批量操作时逐个写入
+func MPut(s Store, kvs map[string][]byte) error {
+    return WithBatch(s).MPut(kvs)
+}
+
+// MPutTTL 批量写入并设置相同的 TTL, s 不支持批量操作时逐个写入
+func MPutTTL(s Store, kvs map[string][]byte, ttl time.Duration) error {
+    return WithBatch(s).MPutTTL(kvs, ttl)
+}
+
+// MDelete 批量删除, s 不支持批量操作时逐个删除
+func MDelete(s Store, keys ...string) error {
+    return WithBatch(s).MDelete(keys...)
+}
+
+// MExist 批量判断是否存在, s 不支持批量操作时逐个判断
+func MExist(s Store, keys ...string) (map[string]bool, error) {
+    return WithBatch(s).MExist(keys...)
+}
+
+func (b batchStore) MGet(keys ...string) (map[string][]byte, error) {
+    return b.MGetContext(context.Background(), keys...)
+}
+
+func (b batchStore) MGetContext(ctx context.Context, keys ...string) (map[string][]byte, error) {
+    result := make(map[string][]byte, len(keys))
+    for _, key := range keys {
+        data, err := b.GetContext(ctx, key)
+        if IsNotFound(err) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        result[key] = data
+    }
+    return result, nil
+}
+
+func (b batchStore) MPut(kvs map[string][]byte) error {
+    return b.MPutTTL(kvs, 0)
+}
+
+func (b batchStore) MPutTTL(kvs map[string][]byte, ttl time.Duration) error {
+    return b.MPutTTLContext(context.Background(), kvs, ttl)
+}
+
+func (b batchStore) MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+    for key, value := range kvs {
+        if err := b.PutTTLContext(ctx, key, value, ttl); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (b batchStore) MDelete(keys ...string) error {
+    return b.MDeleteContext(context.Background(), keys...)
+}
+
+func (b batchStore) MDeleteContext(ctx context.Context, keys ...string) error {
+    for _, key := range keys {
+        if err := b.DeleteContext(ctx, key); err != nil && !IsNotFound(err) {
+            return err
+        }
+    }
+    return nil
+}
+
+func (b batchStore) MExist(keys ...string) (map[string]bool, error) {
+    return b.MExistContext(context.Background(), keys...)
+}
+
+func (b batchStore) MExistContext(ctx context.Context, keys ...string) (map[string]bool, error) {
+    result := make(map[string]bool, len(keys))
+    for _, key := range keys {
+        ok, err := b.ExistContext(ctx, key)
+        if err != nil {
+            return nil, err
+        }
+        result[key] = ok
+    }
+    return result, nil
+}
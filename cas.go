@@ -0,0 +1,46 @@
+package store
+
+import (
+    "context"
+    "time"
+)
+
+type (
+    // CASStore 条件写入, 比较和写入在后端是原子的
+    CASStore interface {
+        ContextStore
+        // CompareAndSwap 当前值等于 old 时写入 new 并保留原有的过期时间, key 不存在时返回 false
+        CompareAndSwap(key string, old, new []byte) (bool, error)
+        CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (bool, error)
+        // PutIfAbsent key 不存在或已过期时写入
+        PutIfAbsent(key string, value []byte, ttl time.Duration) (bool, error)
+        PutIfAbsentContext(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+        // DeleteIf 当前值等于 expected 时删除
+        DeleteIf(key string, expected []byte) (bool, error)
+        DeleteIfContext(ctx context.Context, key string, expected []byte) (bool, error)
+    }
+)
+
+// CompareAndSwap s 不支持条件写入时返回 ErrNotSupported
+func CompareAndSwap(s Store, key string, old, new []byte) (bool, error) {
+    if cs, ok := s.(CASStore); ok {
+        return cs.CompareAndSwap(key, old, new)
+    }
+    return false, ErrNotSupported
+}
+
+// PutIfAbsent s 不支持条件写入时返回 ErrNotSupported
+func PutIfAbsent(s Store, key string, value []byte, ttl time.Duration) (bool, error) {
+    if cs, ok := s.(CASStore); ok {
+        return cs.PutIfAbsent(key, value, ttl)
+    }
+    return false, ErrNotSupported
+}
+
+// DeleteIf s 不支持条件写入时返回 ErrNotSupported
+func DeleteIf(s Store, key string, expected []byte) (bool, error) {
+    if cs, ok := s.(CASStore); ok {
+        return cs.DeleteIf(key, expected)
+    }
+    return false, ErrNotSupported
+}
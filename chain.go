@@ -1,147 +1,443 @@
 package store
 
 import (
+    "bytes"
+    "context"
+    "github.com/DGHeroin/store/utils"
     "io"
+    "io/ioutil"
+    "sync/atomic"
     "time"
 )
 
 type (
-    chain struct {
-        list StSlice
+    // Chain 存储链, 读从前往后, 写从后往前
+    Chain struct {
+        writes uint64
+        rev    uint64
+        list   StSlice
+        tiers  []BatchStore
+        opts   ChainOptions
+        wb     *writeBack
+        rp     *repairer
+        sf     *flightGroup
+        inv    *invalidator
+    }
+    // ChainOptions 存储链配置
+    ChainOptions struct {
+        // ReadThrough 读命中后回填到命中层之前的所有层, 保留命中层剩余的 TTL
+        ReadThrough bool
+        // Tiers 各层配置, 下标与 NewChainWithOptions 的 store 参数对应, 可以少于层数
+        Tiers []TierOptions
+        // WriteBack 非 nil 时开启异步写: 写入只同步落到第一层, 其余层由后台批量刷新
+        WriteBack *WriteBackOptions
+        // TombstoneTTL 大于 0 时删除会在前面各层写入有效期为该值的删除标记, 保证最后一层删除失败时旧值不会被读到;
+        // 开启 TombstoneTTL 或 NegativeTTL 时写入与删除标记相同的 value 返回 ErrReservedValue
+        TombstoneTTL time.Duration
+        // RepairInterval 后台重试最后一层删除的间隔, 默认 1s; 待修复的 key 只保存在内存中, 进程重启后丢失
+        RepairInterval time.Duration
+        // NegativeTTL 大于 0 时所有层都未命中的 key 会在前面各层缓存该时长, 经由存储链的写入和删除会使其失效
+        NegativeTTL time.Duration
+        // Singleflight 合并对同一个 key 的并发 Get/RGet/Exist
+        Singleflight bool
+        // Health 非 nil 时跟踪各层健康状况: 连续失败的层会被熔断跳过, 前面各层写入失败不再导致整体失败
+        Health *HealthOptions
+        // Invalidation 非 nil 时最后一层的写入和删除会广播到总线, 其他进程的存储链收到后删除本地前面各层中的 key;
+        // 用于多个进程各自的内存层共享同一个最后一层
+        Invalidation *InvalidationOptions
+    }
+    // TierOptions 存储链单层配置
+    TierOptions struct {
+        // MaxValueSize 回填到该层的最大 value 字节数, 0 表示不限制
+        MaxValueSize int64
+        // Timeout 该层单次调用的超时时间, 0 表示不限制
+        Timeout time.Duration
+        // MaxTTL 写入该层的最大 TTL, 包括不过期的写入和回填, 0 表示不限制
+        MaxTTL time.Duration
     }
     StSlice []Store
 )
 
-func (c chain) Close() error {
+func (c *Chain) Close() (err error) {
+    if c.wb != nil {
+        err = c.wb.close()
+    }
+    if c.inv != nil {
+        c.inv.close()
+    }
+    if c.rp != nil {
+        c.rp.close()
+    }
     c.list.Range(func(store Store) bool {
         _ = store.Close()
         return true
     })
-    return nil
+    return
 }
 
-func (c chain) TTL(key string) (r time.Duration, err error) {
-    c.list.Range(func(store Store) bool {
-        if r, err = store.TTL(key); err == nil {
-            return false
-        }
-        return true
-    })
-    return
+func (c *Chain) TTL(key string) (time.Duration, error) {
+    return c.TTLContext(context.Background(), key)
 }
 
-func (c chain) RangeKeys(prefix, limit string, max int) (result KeysInfoSlice, err error) {
-    c.list.Range(func(store Store) bool {
-        if result, err = store.RangeKeys(prefix, limit, max); err == nil && len(result) > 0 {
-            return false
+func (c *Chain) TTLContext(ctx context.Context, key string) (time.Duration, error) {
+    if op, ok := c.pending(key); ok {
+        if !op.visible() {
+            return 0, ErrNotFound
         }
-        return true
-    })
-    return
+        return op.ttl(), nil
+    }
+    var firstErr error
+    for i, store := range c.tiers {
+        if c.tombstoned(i) {
+            data, err := store.GetContext(ctx, key)
+            if err == nil && isTombstone(data) {
+                return 0, ErrNotFound
+            }
+        }
+        r, err := store.TTLContext(ctx, key)
+        if err == nil {
+            return r, nil
+        }
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            return 0, ctxErr
+        }
+        if !IsNotFound(err) && err != ErrTierUnavailable && firstErr == nil {
+            firstErr = err
+        }
+    }
+    if firstErr != nil {
+        return 0, firstErr
+    }
+    return 0, ErrNotFound
 }
 
-func (c chain) Range(prefix, limit string, cb func(key string, value []byte) bool) (err error) {
-    c.list.Range(func(v Store) bool {
-        if err = v.Range(prefix, limit, cb); err != nil {
-            return false
-        }
-        return true
-    })
-    return
+func (c *Chain) RangeKeys(prefix, limit string, max int) (KeysInfoSlice, error) {
+    return c.RangeKeysContext(context.Background(), prefix, limit, max)
 }
 
-func (c chain) RRange(prefix, limit string, cb func(key string, r io.Reader) bool) (err error) {
-    c.list.Range(func(v Store) bool {
-        if err := v.RRange(prefix, limit, cb); err != nil {
-            return false
-        }
-        return true
-    })
-    return
+func (c *Chain) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
+    return c.RangeContext(context.Background(), prefix, limit, cb)
 }
 
-func (c chain) RPut(key string, r io.Reader, size int64) error {
-    return c.RPutTTL(key, r, size, 0)
+func (c *Chain) RRange(prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    return c.RRangeContext(context.Background(), prefix, limit, cb)
 }
 
-func (c chain) RPutTTL(key string, r io.Reader, size int64, ttl time.Duration) (err error) {
-    c.list.RevRange(func(v Store) bool {
-        if err = v.RPutTTL(key, r, size, ttl); err != nil {
-            return false
-        }
-        return true
-    })
-    return
+func (c *Chain) RPut(key string, r io.Reader, size int64) error {
+    return c.RPutTTL(key, r, size, 0)
 }
 
-func (c chain) RGet(key string) (r io.Reader, err error) {
-    c.list.RevRange(func(v Store) bool {
-        if r, err = v.RGet(key); err == nil {
-            return false
-        }
-        return true
-    })
-    return
+func (c *Chain) RPutTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+    return c.RPutTTLContext(context.Background(), key, r, size, ttl)
 }
 
-func (c chain) Put(key string, value []byte) error {
-    for i := len(c.list) - 1; i >= 0; i-- {
-        store := c.list[i]
-        if err := store.Put(key, value); err != nil {
+// RPutTTLContext 最后一层直接读取 r, 读到的数据缓存后再写入前面各层
+func (c *Chain) RPutTTLContext(ctx context.Context, key string, r io.Reader, size int64, ttl time.Duration) error {
+    if len(c.list) == 0 {
+        return nil
+    }
+    defer c.forget(key)
+    if c.wb != nil {
+        value, err := ioutil.ReadAll(r)
+        if err != nil {
+            return err
+        }
+        return c.PutTTLContext(ctx, key, value, ttl)
+    }
+    if c.tombstoned(0) && (size < 0 || size == int64(len(tombstone))) {
+        head, err := ioutil.ReadAll(io.LimitReader(r, int64(len(tombstone))+1))
+        if err != nil {
+            return err
+        }
+        if isTombstone(head) {
+            return ErrReservedValue
+        }
+        r = io.MultiReader(bytes.NewReader(head), r)
+    }
+    atomic.AddUint64(&c.writes, 1)
+    if c.rp != nil {
+        c.rp.forget(key)
+    }
+    last := len(c.list) - 1
+    buf := &bytes.Buffer{}
+    if last > 0 {
+        r = io.TeeReader(r, buf)
+    }
+    if err := c.tiers[last].RPutTTLContext(ctx, key, r, size, ttl); err != nil {
+        return err
+    }
+    c.invalidate(ctx, key)
+    for i := last - 1; i >= 0; i-- {
+        store := c.tiers[i]
+        if err := store.RPutTTLContext(ctx, key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), ttl); !c.tolerate(ctx, i, err) {
             return err
         }
     }
     return nil
 }
 
-func (c chain) PutTTL(key string, value []byte, ttl time.Duration) error {
-    for i := len(c.list) - 1; i >= 0; i-- {
-        store := c.list[i]
-        if err := store.PutTTL(key, value, ttl); err != nil {
+func (c *Chain) RGet(key string) (io.Reader, error) {
+    return c.RGetContext(context.Background(), key)
+}
+
+func (c *Chain) RGetContext(ctx context.Context, key string) (io.Reader, error) {
+    if c.sf != nil {
+        return c.sf.rget(ctx, key, c.rgetContext)
+    }
+    return c.rgetContext(ctx, key)
+}
+
+func (c *Chain) rgetContext(ctx context.Context, key string) (io.Reader, error) {
+    if op, ok := c.pending(key); ok {
+        if !op.visible() {
+            return nil, ErrNotFound
+        }
+        return bytes.NewReader(op.value), nil
+    }
+    gen := atomic.LoadUint64(&c.writes)
+    var firstErr error
+    for i, store := range c.tiers {
+        r, err := store.RGetContext(ctx, key)
+        if err == nil && c.tombstoned(i) {
+            var deleted bool
+            if r, deleted, err = peekTombstone(r); err == nil && deleted {
+                return nil, ErrNotFound
+            }
+        }
+        if err == nil {
+            return c.promoteReader(ctx, i, key, r)
+        }
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            return nil, ctxErr
+        }
+        if !IsNotFound(err) && err != ErrTierUnavailable && firstErr == nil {
+            firstErr = err
+        }
+    }
+    if firstErr != nil {
+        return nil, firstErr
+    }
+    c.cacheMiss(ctx, gen, key)
+    return nil, ErrNotFound
+}
+
+func (c *Chain) Put(key string, value []byte) error {
+    return c.PutContext(context.Background(), key, value)
+}
+
+func (c *Chain) PutContext(ctx context.Context, key string, value []byte) error {
+    return c.PutTTLContext(ctx, key, value, 0)
+}
+
+func (c *Chain) PutTTL(key string, value []byte, ttl time.Duration) error {
+    return c.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+func (c *Chain) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    if c.reserved(value) {
+        return ErrReservedValue
+    }
+    atomic.AddUint64(&c.writes, 1)
+    defer c.forget(key)
+    if c.wb != nil {
+        if err := c.wb.accepting(); err != nil {
+            return err
+        }
+        if err := c.tiers[0].PutTTLContext(ctx, key, value, ttl); !c.tolerate(ctx, 0, err) {
+            return err
+        }
+        op := &writeOp{key: key, value: utils.CopyBytes(value)}
+        if ttl > 0 {
+            op.expireAt = time.Now().Add(ttl)
+        }
+        return c.wb.enqueue(op)
+    }
+    if c.rp != nil {
+        c.rp.forget(key)
+    }
+    last := len(c.list) - 1
+    for i := last; i >= 0; i-- {
+        store := c.tiers[i]
+        if err := store.PutTTLContext(ctx, key, value, ttl); !c.tolerate(ctx, i, err) {
             return err
         }
+        if i == last {
+            c.invalidate(ctx, key)
+        }
     }
     return nil
 }
 
-func (c chain) Get(key string) ([]byte, error) {
-    for _, store := range c.list {
-        if data, err := store.Get(key); err == nil {
-            return data, err
+func (c *Chain) Get(key string) ([]byte, error) {
+    return c.GetContext(context.Background(), key)
+}
+
+// GetContext 按顺序查询各层, 全部未命中时返回 ErrNotFound;
+// 某层出错时继续查询后续层, 若最终未命中则返回遇到的第一个错误
+func (c *Chain) GetContext(ctx context.Context, key string) ([]byte, error) {
+    if c.sf != nil {
+        return c.sf.get(ctx, key, c.getContext)
+    }
+    return c.getContext(ctx, key)
+}
+
+func (c *Chain) getContext(ctx context.Context, key string) ([]byte, error) {
+    if op, ok := c.pending(key); ok {
+        if !op.visible() {
+            return nil, ErrNotFound
+        }
+        return utils.CopyBytes(op.value), nil
+    }
+    gen := atomic.LoadUint64(&c.writes)
+    var firstErr error
+    for i, store := range c.tiers {
+        data, err := store.GetContext(ctx, key)
+        if err == nil && c.tombstoned(i) && isTombstone(data) {
+            return nil, ErrNotFound
+        }
+        if err == nil {
+            c.promote(ctx, i, key, data)
+            return data, nil
+        }
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            return nil, ctxErr
         }
+        if !IsNotFound(err) && err != ErrTierUnavailable && firstErr == nil {
+            firstErr = err
+        }
+    }
+    if firstErr != nil {
+        return nil, firstErr
+    }
+    c.cacheMiss(ctx, gen, key)
+    return nil, ErrNotFound
+}
+
+func (c *Chain) Exist(key string) (bool, error) {
+    return c.ExistContext(context.Background(), key)
+}
+
+func (c *Chain) ExistContext(ctx context.Context, key string) (bool, error) {
+    if c.sf != nil {
+        return c.sf.exist(ctx, key, c.existContext)
     }
-    return nil, nil
+    return c.existContext(ctx, key)
 }
 
-func (c chain) Exist(key string) (bool, error) {
-    for _, store := range c.list {
-        if ok, err := store.Exist(key); err == nil {
-            if ok {
-                return true, nil
+func (c *Chain) existContext(ctx context.Context, key string) (bool, error) {
+    if op, ok := c.pending(key); ok {
+        return op.visible(), nil
+    }
+    gen := atomic.LoadUint64(&c.writes)
+    var firstErr error
+    for i, store := range c.tiers {
+        var (
+            ok  bool
+            err error
+        )
+        if c.tombstoned(i) {
+            var data []byte
+            if data, err = store.GetContext(ctx, key); err == nil {
+                if isTombstone(data) {
+                    return false, nil
+                }
+                ok = true
+            } else if IsNotFound(err) {
+                err = nil
             }
+        } else {
+            ok, err = store.ExistContext(ctx, key)
+        }
+        if err == nil && ok {
+            return true, nil
+        }
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            return false, ctxErr
         }
+        if err != nil && err != ErrTierUnavailable && firstErr == nil {
+            firstErr = err
+        }
+    }
+    if firstErr == nil {
+        c.cacheMiss(ctx, gen, key)
     }
-    return false, nil
+    return false, firstErr
 }
 
-func (c chain) Delete(key string) error {
-    for _, store := range c.list {
-        if err := store.Delete(key); err != nil {
+func (c *Chain) Delete(key string) error {
+    return c.DeleteContext(context.Background(), key)
+}
+
+func (c *Chain) DeleteContext(ctx context.Context, key string) error {
+    atomic.AddUint64(&c.writes, 1)
+    defer c.forget(key)
+    if c.wb != nil {
+        if err := c.wb.accepting(); err != nil {
+            return err
+        }
+        front := c.tiers[0]
+        var err error
+        if c.opts.TombstoneTTL > 0 {
+            err = front.PutTTLContext(ctx, key, tombstone, c.opts.TombstoneTTL)
+        } else {
+            err = front.DeleteContext(ctx, key)
+        }
+        if !c.tolerate(ctx, 0, err) {
             return err
         }
+        return c.wb.enqueue(&writeOp{key: key, deleted: true})
     }
+    if c.rp != nil {
+        return c.deleteWithTombstone(ctx, key)
+    }
+    for i, store := range c.tiers {
+        if err := store.DeleteContext(ctx, key); !c.tolerate(ctx, i, err) {
+            return err
+        }
+    }
+    c.invalidate(ctx, key)
     return nil
 }
 
 // NewChain 存储链
 func NewChain(store ...Store) Store {
-    c := chain{
+    return NewChainWithOptions(ChainOptions{}, store...)
+}
+
+// NewChainWithOptions 带配置的存储链
+func NewChainWithOptions(opts ChainOptions, store ...Store) *Chain {
+    c := &Chain{
         list: store,
+        opts: opts,
+    }
+    for i, s := range store {
+        t := &chainTier{
+            BatchStore: WithBatch(s),
+            last:       i == len(store)-1,
+            timeout:    c.tierOptions(i).Timeout,
+            maxTTL:     c.tierOptions(i).MaxTTL,
+        }
+        if opts.Health != nil {
+            t.h = newTierHealth(*opts.Health)
+        }
+        c.tiers = append(c.tiers, t)
+    }
+    if opts.WriteBack != nil && len(store) > 1 {
+        c.wb = newWriteBack(c, *opts.WriteBack)
+    } else if opts.TombstoneTTL > 0 && len(store) > 1 {
+        c.rp = newRepairer(c)
+    }
+    if opts.Singleflight {
+        c.sf = newFlightGroup()
+    }
+    if opts.Invalidation != nil && opts.Invalidation.Bus != nil && len(store) > 1 {
+        c.inv = newInvalidator(c, *opts.Invalidation)
     }
     return c
 }
 
 var _ = NewChain
+var _ BatchStore = &Chain{}
 
 func (s StSlice) Range(cb func(Store) bool) {
     for _, v := range s {
@@ -157,3 +453,111 @@ func (s StSlice) RevRange(cb func(Store) bool) {
         }
     }
 }
+
+// pending 异步写队列中尚未刷新的写入
+func (c *Chain) pending(key string) (*writeOp, bool) {
+    if c.wb == nil {
+        return nil, false
+    }
+    return c.wb.lookup(key)
+}
+
+// SingleflightStats 开启 Singleflight 时各 key 的读取合并统计
+func (c *Chain) SingleflightStats() map[string]SingleflightStats {
+    if c.sf == nil {
+        return nil
+    }
+    return c.sf.snapshot()
+}
+
+// forget 写入返回前丢弃 keys 正在进行的合并读取, 之后的读取能看到这次写入
+func (c *Chain) forget(keys ...string) {
+    if c.sf != nil {
+        c.sf.forget(keys...)
+    }
+}
+
+// cacheMiss 在前面各层缓存未命中, 查询期间有经由存储链的写入时放弃缓存
+func (c *Chain) cacheMiss(ctx context.Context, gen uint64, keys ...string) {
+    if c.opts.NegativeTTL <= 0 || len(keys) == 0 || atomic.LoadUint64(&c.writes) != gen {
+        return
+    }
+    if len(keys) == 1 {
+        for i := 0; i < len(c.list)-1; i++ {
+            _ = c.tiers[i].PutTTLContext(ctx, keys[0], tombstone, c.opts.NegativeTTL)
+        }
+        return
+    }
+    kvs := make(map[string][]byte, len(keys))
+    for _, key := range keys {
+        kvs[key] = tombstone
+    }
+    for i := 0; i < len(c.list)-1; i++ {
+        _ = c.tiers[i].MPutTTLContext(ctx, kvs, c.opts.NegativeTTL)
+    }
+}
+
+func (c *Chain) tierOptions(i int) TierOptions {
+    if i < len(c.opts.Tiers) {
+        return c.opts.Tiers[i]
+    }
+    return TierOptions{}
+}
+
+// promote 把第 hit 层读到的数据回填到之前的各层, 回填失败不影响读取结果
+func (c *Chain) promote(ctx context.Context, hit int, key string, data []byte) {
+    if !c.opts.ReadThrough || hit == 0 {
+        return
+    }
+    ttl, err := c.tiers[hit].TTLContext(ctx, key)
+    if err != nil {
+        return
+    }
+    for i := hit - 1; i >= 0; i-- {
+        if max := c.tierOptions(i).MaxValueSize; max > 0 && int64(len(data)) > max {
+            continue
+        }
+        _ = c.tiers[i].PutTTLContext(ctx, key, data, ttl)
+    }
+}
+
+// promoteReader 流式读取的回填, 只有 value 不超过前面各层的最大限制时才会读入内存回填
+func (c *Chain) promoteReader(ctx context.Context, hit int, key string, r io.Reader) (io.Reader, error) {
+    if !c.opts.ReadThrough || hit == 0 {
+        return r, nil
+    }
+    var limit int64
+    for i := 0; i < hit; i++ {
+        max := c.tierOptions(i).MaxValueSize
+        if max == 0 {
+            limit = 0
+            break
+        }
+        if max > limit {
+            limit = max
+        }
+    }
+    if limit == 0 {
+        data, err := ioutil.ReadAll(r)
+        if closer, ok := r.(io.Closer); ok {
+            _ = closer.Close()
+        }
+        if err != nil {
+            return nil, err
+        }
+        c.promote(ctx, hit, key, data)
+        return bytes.NewReader(data), nil
+    }
+    data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+    if err != nil {
+        return nil, err
+    }
+    if int64(len(data)) > limit {
+        return io.MultiReader(bytes.NewReader(data), r), nil
+    }
+    if closer, ok := r.(io.Closer); ok {
+        _ = closer.Close()
+    }
+    c.promote(ctx, hit, key, data)
+    return bytes.NewReader(data), nil
+}
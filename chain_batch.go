@@ -0,0 +1,258 @@
+package store
+
+import (
+    "context"
+    "github.com/DGHeroin/store/utils"
+    "sync/atomic"
+    "time"
+)
+
+func (c *Chain) MGet(keys ...string) (map[string][]byte, error) {
+    return c.MGetContext(context.Background(), keys...)
+}
+
+// MGetContext 逐层批量读取, 每层只查询前面各层未命中的 key; 某层出错时继续查询后续层,
+// 最终仍有未命中的 key 时返回已命中的结果和遇到的第一个错误
+func (c *Chain) MGetContext(ctx context.Context, keys ...string) (map[string][]byte, error) {
+    result := make(map[string][]byte, len(keys))
+    missing := c.unresolved(keys, func(key string, op *writeOp) {
+        if op.visible() {
+            result[key] = utils.CopyBytes(op.value)
+        }
+    })
+    gen := atomic.LoadUint64(&c.writes)
+    var firstErr error
+    for i, store := range c.tiers {
+        if len(missing) == 0 {
+            break
+        }
+        found, err := store.MGetContext(ctx, missing...)
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            return nil, ctxErr
+        }
+        if err != nil {
+            if err != ErrTierUnavailable && firstErr == nil {
+                firstErr = err
+            }
+            continue
+        }
+        var next []string
+        for _, key := range missing {
+            data, ok := found[key]
+            if !ok {
+                next = append(next, key)
+                continue
+            }
+            if c.tombstoned(i) && isTombstone(data) {
+                continue
+            }
+            result[key] = data
+            c.promote(ctx, i, key, data)
+        }
+        missing = next
+    }
+    if len(missing) > 0 && firstErr != nil {
+        return result, firstErr
+    }
+    c.cacheMiss(ctx, gen, missing...)
+    return result, nil
+}
+
+func (c *Chain) MPut(kvs map[string][]byte) error {
+    return c.MPutTTL(kvs, 0)
+}
+
+func (c *Chain) MPutTTL(kvs map[string][]byte, ttl time.Duration) error {
+    return c.MPutTTLContext(context.Background(), kvs, ttl)
+}
+
+// MPutTTLContext 从后往前逐层批量写入
+func (c *Chain) MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+    if len(c.tiers) == 0 || len(kvs) == 0 {
+        return nil
+    }
+    for _, value := range kvs {
+        if c.reserved(value) {
+            return ErrReservedValue
+        }
+    }
+    atomic.AddUint64(&c.writes, 1)
+    if c.sf != nil {
+        keys := make([]string, 0, len(kvs))
+        for key := range kvs {
+            keys = append(keys, key)
+        }
+        defer c.sf.forget(keys...)
+    }
+    if c.wb != nil {
+        if err := c.wb.accepting(); err != nil {
+            return err
+        }
+        if err := c.tiers[0].MPutTTLContext(ctx, kvs, ttl); !c.tolerate(ctx, 0, err) {
+            return err
+        }
+        for key, value := range kvs {
+            op := &writeOp{key: key, value: utils.CopyBytes(value)}
+            if ttl > 0 {
+                op.expireAt = time.Now().Add(ttl)
+            }
+            if err := c.wb.enqueue(op); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if c.rp != nil {
+        for key := range kvs {
+            c.rp.forget(key)
+        }
+    }
+    last := len(c.tiers) - 1
+    for i := last; i >= 0; i-- {
+        if err := c.tiers[i].MPutTTLContext(ctx, kvs, ttl); !c.tolerate(ctx, i, err) {
+            return err
+        }
+        if i == last && c.inv != nil {
+            keys := make([]string, 0, len(kvs))
+            for key := range kvs {
+                keys = append(keys, key)
+            }
+            c.invalidate(ctx, keys...)
+        }
+    }
+    return nil
+}
+
+func (c *Chain) MDelete(keys ...string) error {
+    return c.MDeleteContext(context.Background(), keys...)
+}
+
+// MDeleteContext 从前往后逐层批量删除; 开启 TombstoneTTL 时按单个 key 的删除流程处理
+func (c *Chain) MDeleteContext(ctx context.Context, keys ...string) error {
+    if len(c.tiers) == 0 || len(keys) == 0 {
+        return nil
+    }
+    atomic.AddUint64(&c.writes, 1)
+    defer c.forget(keys...)
+    if c.rp != nil {
+        for _, key := range keys {
+            if err := c.deleteWithTombstone(ctx, key); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    if c.wb != nil {
+        if err := c.wb.accepting(); err != nil {
+            return err
+        }
+        var err error
+        if c.opts.TombstoneTTL > 0 {
+            kvs := make(map[string][]byte, len(keys))
+            for _, key := range keys {
+                kvs[key] = tombstone
+            }
+            err = c.tiers[0].MPutTTLContext(ctx, kvs, c.opts.TombstoneTTL)
+        } else {
+            err = c.tiers[0].MDeleteContext(ctx, keys...)
+        }
+        if !c.tolerate(ctx, 0, err) {
+            return err
+        }
+        for _, key := range keys {
+            if err := c.wb.enqueue(&writeOp{key: key, deleted: true}); err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+    for i, store := range c.tiers {
+        if err := store.MDeleteContext(ctx, keys...); !c.tolerate(ctx, i, err) {
+            return err
+        }
+    }
+    c.invalidate(ctx, keys...)
+    return nil
+}
+
+func (c *Chain) MExist(keys ...string) (map[string]bool, error) {
+    return c.MExistContext(context.Background(), keys...)
+}
+
+// MExistContext 逐层批量判断, 每层只查询前面各层未命中的 key
+func (c *Chain) MExistContext(ctx context.Context, keys ...string) (map[string]bool, error) {
+    result := make(map[string]bool, len(keys))
+    missing := c.unresolved(keys, func(key string, op *writeOp) {
+        result[key] = op.visible()
+    })
+    gen := atomic.LoadUint64(&c.writes)
+    var firstErr error
+    for i, store := range c.tiers {
+        if len(missing) == 0 {
+            break
+        }
+        var (
+            next []string
+            err  error
+        )
+        if c.tombstoned(i) {
+            var found map[string][]byte
+            if found, err = store.MGetContext(ctx, missing...); err == nil {
+                for _, key := range missing {
+                    if data, ok := found[key]; !ok {
+                        next = append(next, key)
+                    } else {
+                        result[key] = !isTombstone(data)
+                    }
+                }
+            }
+        } else {
+            var found map[string]bool
+            if found, err = store.MExistContext(ctx, missing...); err == nil {
+                for _, key := range missing {
+                    if found[key] {
+                        result[key] = true
+                    } else {
+                        next = append(next, key)
+                    }
+                }
+            }
+        }
+        if ctxErr := ctx.Err(); ctxErr != nil {
+            return nil, ctxErr
+        }
+        if err != nil {
+            if err != ErrTierUnavailable && firstErr == nil {
+                firstErr = err
+            }
+            continue
+        }
+        missing = next
+    }
+    for _, key := range missing {
+        result[key] = false
+    }
+    if len(missing) > 0 && firstErr != nil {
+        return result, firstErr
+    }
+    c.cacheMiss(ctx, gen, missing...)
+    return result, nil
+}
+
+// unresolved 去重并去掉异步写队列中已有结果的 key, 返回仍需查询各层的 key
+func (c *Chain) unresolved(keys []string, pending func(key string, op *writeOp)) []string {
+    seen := make(map[string]struct{}, len(keys))
+    missing := make([]string, 0, len(keys))
+    for _, key := range keys {
+        if _, ok := seen[key]; ok {
+            continue
+        }
+        seen[key] = struct{}{}
+        if op, ok := c.pending(key); ok {
+            pending(key, op)
+            continue
+        }
+        missing = append(missing, key)
+    }
+    return missing
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+    "context"
+    "sync/atomic"
+    "time"
+)
+
+func (c *Chain) CompareAndSwap(key string, old, new []byte) (bool, error) {
+    return c.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+// CompareAndSwapContext 在最后一层执行条件写入, 成功后清除前面各层的旧值
+func (c *Chain) CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (bool, error) {
+    if c.reserved(new) {
+        return false, ErrReservedValue
+    }
+    return c.conditional(ctx, key, func(cs CASStore) (bool, error) {
+        return cs.CompareAndSwapContext(ctx, key, old, new)
+    })
+}
+
+func (c *Chain) PutIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+    return c.PutIfAbsentContext(context.Background(), key, value, ttl)
+}
+
+func (c *Chain) PutIfAbsentContext(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    if c.reserved(value) {
+        return false, ErrReservedValue
+    }
+    return c.conditional(ctx, key, func(cs CASStore) (bool, error) {
+        return cs.PutIfAbsentContext(ctx, key, value, ttl)
+    })
+}
+
+func (c *Chain) DeleteIf(key string, expected []byte) (bool, error) {
+    return c.DeleteIfContext(context.Background(), key, expected)
+}
+
+func (c *Chain) DeleteIfContext(ctx context.Context, key string, expected []byte) (bool, error) {
+    return c.conditional(ctx, key, func(cs CASStore) (bool, error) {
+        return cs.DeleteIfContext(ctx, key, expected)
+    })
+}
+
+// conditional 条件写入以最后一层为准, 最后一层不支持条件写入时返回 ErrNotSupported
+func (c *Chain) conditional(ctx context.Context, key string, fn func(cs CASStore) (bool, error)) (bool, error) {
+    return c.onLast(ctx, key, func(last Store) (bool, error) {
+        cs, ok := last.(CASStore)
+        if !ok {
+            return false, ErrNotSupported
+        }
+        return fn(cs)
+    })
+}
+
+// onLast 在最后一层执行读改写操作, 开启 WriteBack 时最后一层不是最新数据, 返回 ErrNotSupported;
+// fn 返回 true 表示有写入, 此时删除前面各层的值, 下次读取时从最后一层回填
+func (c *Chain) onLast(ctx context.Context, key string, fn func(last Store) (bool, error)) (bool, error) {
+    if len(c.list) == 0 || c.wb != nil {
+        return false, ErrNotSupported
+    }
+    last := len(c.list) - 1
+    if c.rp != nil {
+        if err := c.rp.repairKey(ctx, key); err != nil {
+            return false, err
+        }
+    }
+    atomic.AddUint64(&c.writes, 1)
+    defer c.forget(key)
+    if ok, err := fn(c.list[last]); err != nil || !ok {
+        return false, err
+    }
+    c.invalidate(ctx, key)
+    for i := last - 1; i >= 0; i-- {
+        if err := c.tiers[i].DeleteContext(ctx, key); !c.tolerate(ctx, i, err) {
+            return true, err
+        }
+    }
+    return true, nil
+}
+
+func (c *Chain) IncrBy(key string, delta int64) (int64, error) {
+    return c.IncrByTTL(key, delta, 0)
+}
+
+func (c *Chain) IncrByTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+    return c.IncrByTTLContext(context.Background(), key, delta, ttl)
+}
+
+// IncrByTTLContext 在最后一层自增, 成功后清除前面各层的旧值
+func (c *Chain) IncrByTTLContext(ctx context.Context, key string, delta int64, ttl time.Duration) (n int64, err error) {
+    _, err = c.onLast(ctx, key, func(last Store) (bool, error) {
+        n, err = IncrByTTLContext(ctx, last, key, delta, ttl)
+        return err == nil, err
+    })
+    return
+}
+
+var _ CASStore = &Chain{}
+var _ CounterStore = &Chain{}
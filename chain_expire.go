@@ -0,0 +1,97 @@
+package store
+
+import (
+    "context"
+    "sync/atomic"
+    "time"
+)
+
+func (c *Chain) Expire(key string, ttl time.Duration) error {
+    return c.ExpireContext(context.Background(), key, ttl)
+}
+
+func (c *Chain) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+    return c.ExpireAtContext(ctx, key, time.Now().Add(ttl))
+}
+
+func (c *Chain) ExpireAt(key string, at time.Time) error {
+    return c.ExpireAtContext(context.Background(), key, at)
+}
+
+// ExpireAtContext 以最后一层为准修改过期时间, 再同步到前面各层:
+// 前面的层支持 ExpireStore 时直接修改 (过期时间不超过该层 MaxTTL), 否则删除, 下次读取时回填
+func (c *Chain) ExpireAtContext(ctx context.Context, key string, at time.Time) error {
+    if len(c.list) == 0 || c.wb != nil {
+        return ErrNotSupported
+    }
+    last := len(c.list) - 1
+    if c.rp != nil {
+        if err := c.rp.repairKey(ctx, key); err != nil {
+            return err
+        }
+    }
+    atomic.AddUint64(&c.writes, 1)
+    defer c.forget(key)
+    if err := ExpireAtContext(ctx, c.list[last], key, at); err != nil {
+        return err
+    }
+    c.invalidate(ctx, key)
+    now := time.Now()
+    for i := last - 1; i >= 0; i-- {
+        t := c.tiers[i].(*chainTier)
+        es, ok := c.list[i].(ExpireStore)
+        var err error
+        if !ok || (!at.IsZero() && !at.After(now)) {
+            err = t.DeleteContext(ctx, key)
+        } else {
+            tierAt := at
+            if t.maxTTL > 0 && (at.IsZero() || at.Sub(now) > t.maxTTL) {
+                tierAt = now.Add(t.maxTTL)
+            }
+            err = t.write(ctx, func(ctx context.Context) error {
+                if err := es.ExpireAtContext(ctx, key, tierAt); !IsNotFound(err) {
+                    return err
+                }
+                return nil
+            }, key)
+        }
+        if !c.tolerate(ctx, i, err) {
+            return err
+        }
+    }
+    return nil
+}
+
+func (c *Chain) Persist(key string) error {
+    return c.PersistContext(context.Background(), key)
+}
+
+func (c *Chain) PersistContext(ctx context.Context, key string) error {
+    return c.ExpireAtContext(ctx, key, time.Time{})
+}
+
+func (c *Chain) Touch(key string) error {
+    return c.TouchContext(context.Background(), key)
+}
+
+// TouchContext 最后一层的结果为准, 前面各层尽力而为
+func (c *Chain) TouchContext(ctx context.Context, key string) error {
+    if len(c.list) == 0 {
+        return ErrNotSupported
+    }
+    last := len(c.list) - 1
+    if err := TouchContext(ctx, c.list[last], key); err != nil {
+        return err
+    }
+    for i := last - 1; i >= 0; i-- {
+        if es, ok := c.list[i].(ExpireStore); ok {
+            t := c.tiers[i].(*chainTier)
+            _ = t.call(ctx, key, t.timeout, func(ctx context.Context) error {
+                return es.TouchContext(ctx, key)
+            })
+        }
+    }
+    return nil
+}
+
+var _ ExpireStore = &Chain{}
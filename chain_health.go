@@ -0,0 +1,508 @@
+package store
+
+import (
+    "context"
+    "io"
+    "sync"
+    "time"
+)
+
+type (
+    // HealthOptions 存储链各层的健康检测与熔断配置
+    HealthOptions struct {
+        // FailureThreshold 连续失败多少次后熔断该层, 默认 5
+        FailureThreshold int
+        // Cooldown 熔断后多久放行一次探测请求, 默认 5s
+        Cooldown time.Duration
+        // MaxDirtyKeys 每层最多记录多少个写入失败的 key, 默认 10000.
+        // 超出后该层无法保证数据一致, 会一直处于熔断状态直到调用 ResetTier
+        MaxDirtyKeys int
+    }
+    // TierState 存储链单层的熔断状态
+    TierState int
+    // TierStatus 存储链单层的健康状况
+    TierStatus struct {
+        Index               int
+        State               TierState
+        ConsecutiveFailures int
+        Failures            uint64
+        Successes           uint64
+        // Latency 调用耗时的指数移动平均
+        Latency   time.Duration
+        LastError error
+        OpenUntil time.Time
+        // DirtyKeys 写入失败、在该层可能是旧值的 key 数量, 读取时会跳过该层
+        DirtyKeys     int
+        DirtyOverflow bool
+    }
+    tierHealth struct {
+        mu            sync.Mutex
+        opts          HealthOptions
+        state         TierState
+        consecutive   int
+        failures      uint64
+        successes     uint64
+        latency       time.Duration
+        lastErr       error
+        openUntil     time.Time
+        probing       bool
+        dirty         map[string]struct{}
+        dirtyOverflow bool
+    }
+    // chainTier 包装存储链中的一层: 应用该层的 TierOptions; 开启 Health 时熔断后直接返回 ErrTierUnavailable,
+    // 记录调用结果, 跟踪写入失败的 key
+    chainTier struct {
+        BatchStore
+        h       *tierHealth
+        last    bool
+        timeout time.Duration
+        maxTTL  time.Duration
+    }
+)
+
+const (
+    TierHealthy TierState = iota
+    TierBypassed
+    TierProbing
+)
+
+func (s TierState) String() string {
+    switch s {
+    case TierHealthy:
+        return "healthy"
+    case TierBypassed:
+        return "bypassed"
+    case TierProbing:
+        return "probing"
+    }
+    return "unknown"
+}
+
+func newTierHealth(opts HealthOptions) *tierHealth {
+    if opts.FailureThreshold <= 0 {
+        opts.FailureThreshold = 5
+    }
+    if opts.Cooldown <= 0 {
+        opts.Cooldown = time.Second * 5
+    }
+    if opts.MaxDirtyKeys <= 0 {
+        opts.MaxDirtyKeys = 10000
+    }
+    return &tierHealth{
+        opts:  opts,
+        dirty: map[string]struct{}{},
+    }
+}
+
+// allow 是否放行一次调用, 冷却结束后只放行一个探测请求
+func (h *tierHealth) allow() bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    switch h.state {
+    case TierHealthy:
+        return true
+    case TierBypassed:
+        if h.dirtyOverflow || time.Now().Before(h.openUntil) {
+            return false
+        }
+        h.state = TierProbing
+        h.probing = true
+        return true
+    default:
+        if h.probing {
+            return false
+        }
+        h.probing = true
+        return true
+    }
+}
+
+// release 放行的调用因调用方取消而没有结果, 不计入成功或失败
+func (h *tierHealth) release() {
+    h.mu.Lock()
+    h.probing = false
+    h.mu.Unlock()
+}
+
+// record 记录一次调用结果, 返回该层是否刚从熔断中恢复
+func (h *tierHealth) record(err error, d time.Duration) (recovered bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.probing = false
+    if h.latency == 0 {
+        h.latency = d
+    } else {
+        h.latency = (h.latency*4 + d) / 5
+    }
+    if err != nil {
+        h.failures++
+        h.consecutive++
+        h.lastErr = err
+        if h.state == TierProbing || h.consecutive >= h.opts.FailureThreshold {
+            h.state = TierBypassed
+            h.openUntil = time.Now().Add(h.opts.Cooldown)
+        }
+        return false
+    }
+    h.successes++
+    h.consecutive = 0
+    if h.state == TierProbing {
+        if h.dirtyOverflow {
+            h.state = TierBypassed
+        } else {
+            h.state = TierHealthy
+            return true
+        }
+    }
+    return false
+}
+
+func (h *tierHealth) isDirty(key string) bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.dirtyOverflow {
+        return true
+    }
+    _, ok := h.dirty[key]
+    return ok
+}
+
+func (h *tierHealth) markDirty(key string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if _, ok := h.dirty[key]; ok {
+        return
+    }
+    if len(h.dirty) >= h.opts.MaxDirtyKeys {
+        h.dirtyOverflow = true
+        h.state = TierBypassed
+        return
+    }
+    h.dirty[key] = struct{}{}
+}
+
+func (h *tierHealth) clearDirty(key string) {
+    h.mu.Lock()
+    delete(h.dirty, key)
+    h.mu.Unlock()
+}
+
+func (h *tierHealth) dirtyKeys() []string {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    keys := make([]string, 0, len(h.dirty))
+    for key := range h.dirty {
+        keys = append(keys, key)
+    }
+    return keys
+}
+
+func (h *tierHealth) status(i int) TierStatus {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    st := TierStatus{
+        Index:               i,
+        State:               h.state,
+        ConsecutiveFailures: h.consecutive,
+        Failures:            h.failures,
+        Successes:           h.successes,
+        Latency:             h.latency,
+        LastError:           h.lastErr,
+        DirtyKeys:           len(h.dirty),
+        DirtyOverflow:       h.dirtyOverflow,
+    }
+    if h.state == TierBypassed {
+        st.OpenUntil = h.openUntil
+    }
+    return st
+}
+
+func (h *tierHealth) reset() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.state = TierHealthy
+    h.consecutive = 0
+    h.probing = false
+    h.dirty = map[string]struct{}{}
+    h.dirtyOverflow = false
+}
+
+// dirty key 在该层的数据是否不可信
+func (t *chainTier) dirty(key string) bool {
+    return t.h != nil && t.h.isDirty(key)
+}
+
+// call 执行一次读取, 该层熔断或 key 的写入曾失败时跳过
+func (t *chainTier) call(ctx context.Context, key string, timeout time.Duration, fn func(ctx context.Context) error) error {
+    if t.h != nil {
+        if key != "" && t.dirty(key) {
+            return ErrTierUnavailable
+        }
+        if !t.h.allow() {
+            return ErrTierUnavailable
+        }
+    }
+    return t.run(ctx, timeout, fn)
+}
+
+// write 执行一次写入, 写入失败或被跳过的 key 会被记为脏数据, 直到下一次成功写入
+func (t *chainTier) write(ctx context.Context, fn func(ctx context.Context) error, keys ...string) error {
+    if t.h != nil && !t.h.allow() {
+        if !t.last {
+            for _, key := range keys {
+                t.h.markDirty(key)
+            }
+        }
+        return ErrTierUnavailable
+    }
+    err := t.run(ctx, t.timeout, fn)
+    if t.h != nil && !t.last {
+        for _, key := range keys {
+            if err != nil {
+                t.h.markDirty(key)
+            } else {
+                t.h.clearDirty(key)
+            }
+        }
+    }
+    return err
+}
+
+// clean 去掉在该层不可信的 key
+func (t *chainTier) clean(keys []string) []string {
+    if t.h == nil {
+        return keys
+    }
+    result := make([]string, 0, len(keys))
+    for _, key := range keys {
+        if !t.dirty(key) {
+            result = append(result, key)
+        }
+    }
+    return result
+}
+
+func (t *chainTier) run(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+    callCtx := ctx
+    if timeout > 0 {
+        var cancel context.CancelFunc
+        callCtx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+    start := time.Now()
+    err := fn(callCtx)
+    if t.h != nil {
+        switch {
+        case ctx.Err() != nil:
+            t.h.release()
+        case err == nil || IsNotFound(err):
+            if t.h.record(nil, time.Since(start)) && !t.last {
+                go t.purge()
+            }
+        default:
+            t.h.record(err, time.Since(start))
+        }
+    }
+    return err
+}
+
+func (t *chainTier) PutContext(ctx context.Context, key string, value []byte) error {
+    return t.PutTTLContext(ctx, key, value, 0)
+}
+
+// capTTL 写入该层的 TTL 不超过 MaxTTL, 不过期的写入也会被限制为 MaxTTL
+func (t *chainTier) capTTL(ttl time.Duration) time.Duration {
+    if t.maxTTL > 0 && (ttl <= 0 || ttl > t.maxTTL) {
+        return t.maxTTL
+    }
+    return ttl
+}
+
+func (t *chainTier) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    ttl = t.capTTL(ttl)
+    return t.write(ctx, func(ctx context.Context) error {
+        return t.BatchStore.PutTTLContext(ctx, key, value, ttl)
+    }, key)
+}
+
+func (t *chainTier) GetContext(ctx context.Context, key string) (data []byte, err error) {
+    err = t.call(ctx, key, t.timeout, func(ctx context.Context) (err error) {
+        data, err = t.BatchStore.GetContext(ctx, key)
+        return
+    })
+    return
+}
+
+func (t *chainTier) TTLContext(ctx context.Context, key string) (ttl time.Duration, err error) {
+    err = t.call(ctx, key, t.timeout, func(ctx context.Context) (err error) {
+        ttl, err = t.BatchStore.TTLContext(ctx, key)
+        return
+    })
+    return
+}
+
+func (t *chainTier) RPutTTLContext(ctx context.Context, key string, r io.Reader, size int64, ttl time.Duration) error {
+    ttl = t.capTTL(ttl)
+    return t.write(ctx, func(ctx context.Context) error {
+        return t.BatchStore.RPutTTLContext(ctx, key, r, size, ttl)
+    }, key)
+}
+
+// RGetContext 超时只约束打开 reader 的过程, 不约束之后的读取
+func (t *chainTier) RGetContext(ctx context.Context, key string) (r io.Reader, err error) {
+    err = t.call(ctx, key, 0, func(ctx context.Context) (err error) {
+        r, err = t.BatchStore.RGetContext(ctx, key)
+        return
+    })
+    return
+}
+
+func (t *chainTier) ExistContext(ctx context.Context, key string) (ok bool, err error) {
+    err = t.call(ctx, key, t.timeout, func(ctx context.Context) (err error) {
+        ok, err = t.BatchStore.ExistContext(ctx, key)
+        return
+    })
+    return
+}
+
+func (t *chainTier) DeleteContext(ctx context.Context, key string) error {
+    return t.write(ctx, func(ctx context.Context) error {
+        return t.BatchStore.DeleteContext(ctx, key)
+    }, key)
+}
+
+// RangeKeysContext 不过滤脏数据, 以免调用方误判结果是否被截断, 由调用方通过 dirty 过滤
+func (t *chainTier) RangeKeysContext(ctx context.Context, prefix, limit string, max int) (result KeysInfoSlice, err error) {
+    err = t.call(ctx, "", t.timeout, func(ctx context.Context) (err error) {
+        result, err = t.BatchStore.RangeKeysContext(ctx, prefix, limit, max)
+        return
+    })
+    return
+}
+
+// RangeContext 遍历不受单次调用超时约束
+func (t *chainTier) RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error {
+    if t.h != nil && !t.h.allow() {
+        return ErrTierUnavailable
+    }
+    return t.run(ctx, 0, func(ctx context.Context) error {
+        return t.BatchStore.RangeContext(ctx, prefix, limit, func(key string, value []byte) bool {
+            if t.dirty(key) {
+                return true
+            }
+            return cb(key, value)
+        })
+    })
+}
+
+func (t *chainTier) RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    if t.h != nil && !t.h.allow() {
+        return ErrTierUnavailable
+    }
+    return t.run(ctx, 0, func(ctx context.Context) error {
+        return t.BatchStore.RRangeContext(ctx, prefix, limit, func(key string, r io.Reader) bool {
+            if t.dirty(key) {
+                return true
+            }
+            return cb(key, r)
+        })
+    })
+}
+
+// MGetContext 只读取在该层可信的 key, 其余 key 视为未命中
+func (t *chainTier) MGetContext(ctx context.Context, keys ...string) (result map[string][]byte, err error) {
+    keys = t.clean(keys)
+    if len(keys) == 0 {
+        return map[string][]byte{}, nil
+    }
+    err = t.call(ctx, "", t.timeout, func(ctx context.Context) (err error) {
+        result, err = t.BatchStore.MGetContext(ctx, keys...)
+        return
+    })
+    return
+}
+
+func (t *chainTier) MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+    ttl = t.capTTL(ttl)
+    keys := make([]string, 0, len(kvs))
+    for key := range kvs {
+        keys = append(keys, key)
+    }
+    return t.write(ctx, func(ctx context.Context) error {
+        return t.BatchStore.MPutTTLContext(ctx, kvs, ttl)
+    }, keys...)
+}
+
+func (t *chainTier) MDeleteContext(ctx context.Context, keys ...string) error {
+    return t.write(ctx, func(ctx context.Context) error {
+        return t.BatchStore.MDeleteContext(ctx, keys...)
+    }, keys...)
+}
+
+// MExistContext 在该层不可信的 key 视为不存在
+func (t *chainTier) MExistContext(ctx context.Context, keys ...string) (result map[string]bool, err error) {
+    clean := t.clean(keys)
+    if len(clean) > 0 {
+        err = t.call(ctx, "", t.timeout, func(ctx context.Context) (err error) {
+            result, err = t.BatchStore.MExistContext(ctx, clean...)
+            return
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    if result == nil {
+        result = make(map[string]bool, len(keys))
+    }
+    for _, key := range keys {
+        if _, ok := result[key]; !ok {
+            result[key] = false
+        }
+    }
+    return result, nil
+}
+
+// TierStatus 各层的健康状况, 未开启 Health 时返回 nil
+func (c *Chain) TierStatus() []TierStatus {
+    if c.opts.Health == nil {
+        return nil
+    }
+    var result []TierStatus
+    for i, t := range c.tiers {
+        if ht, ok := t.(*chainTier); ok && ht.h != nil {
+            result = append(result, ht.h.status(i))
+        }
+    }
+    return result
+}
+
+// ResetTier 清除第 i 层的熔断状态和脏数据记录, 用于运维确认该层数据已清理后恢复使用
+func (c *Chain) ResetTier(i int) {
+    if i < 0 || i >= len(c.tiers) {
+        return
+    }
+    if ht, ok := c.tiers[i].(*chainTier); ok && ht.h != nil {
+        ht.h.reset()
+    }
+}
+
+// purge 恢复后删除写入失败期间留下的旧值, 删除成功的 key 即可重新从该层读取
+func (t *chainTier) purge() {
+    for _, key := range t.h.dirtyKeys() {
+        if t.DeleteContext(context.Background(), key) == ErrTierUnavailable {
+            return
+        }
+    }
+}
+
+// tolerate 开启 Health 时, 前面各层的失败只会让该层被跳过, 不影响存储链的结果;
+// 调用方的 ctx 结束导致的错误原样返回
+func (c *Chain) tolerate(ctx context.Context, i int, err error) bool {
+    if err == nil {
+        return true
+    }
+    if ctx.Err() != nil {
+        return false
+    }
+    return c.opts.Health != nil && i < len(c.tiers)-1
+}
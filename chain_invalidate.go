@@ -0,0 +1,75 @@
+package store
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "sync/atomic"
+)
+
+type (
+    // invalidator 存储链在总线上的收发, id 区分各个存储链
+    invalidator struct {
+        c      *Chain
+        opts   InvalidationOptions
+        id     string
+        cancel func()
+    }
+)
+
+func newInvalidator(c *Chain, opts InvalidationOptions) *invalidator {
+    buf := make([]byte, 16)
+    _, _ = rand.Read(buf)
+    inv := &invalidator{
+        c:    c,
+        opts: opts,
+        id:   hex.EncodeToString(buf),
+    }
+    cancel, err := opts.Bus.Subscribe(inv.receive)
+    if err != nil {
+        inv.fail(nil, err)
+    }
+    inv.cancel = cancel
+    return inv
+}
+
+func (inv *invalidator) fail(keys []string, err error) {
+    if inv.opts.OnError != nil {
+        inv.opts.OnError(keys, err)
+    }
+}
+
+// receive 删除其他存储链写入的 key 在本地前面各层中的值, 最后一层是共享的, 不需要处理
+func (inv *invalidator) receive(msg Invalidation) {
+    if msg.Origin == inv.id || len(msg.Keys) == 0 {
+        return
+    }
+    c := inv.c
+    // 使查询期间开始的未命中缓存失效
+    atomic.AddUint64(&c.writes, 1)
+    defer c.forget(msg.Keys...)
+    ctx := context.Background()
+    for i := 0; i < len(c.tiers)-1; i++ {
+        _ = c.tiers[i].MDeleteContext(ctx, msg.Keys...)
+    }
+}
+
+func (inv *invalidator) publish(ctx context.Context, keys []string) {
+    if err := inv.opts.Bus.Publish(ctx, Invalidation{Origin: inv.id, Keys: keys}); err != nil {
+        inv.fail(keys, err)
+    }
+}
+
+func (inv *invalidator) close() {
+    if inv.cancel != nil {
+        inv.cancel()
+    }
+}
+
+// invalidate 最后一层写入成功后通知其他存储链删除它们前面各层中的 keys
+func (c *Chain) invalidate(ctx context.Context, keys ...string) {
+    if c.inv == nil || len(keys) == 0 {
+        return
+    }
+    c.inv.publish(ctx, keys)
+}
@@ -0,0 +1,343 @@
+package store
+
+import (
+    "bytes"
+    "context"
+    "github.com/DGHeroin/store/utils"
+    "io"
+    "sync"
+)
+
+// rangePageSize Range 和 RRange 每次从一层读取的 key 数量
+const rangePageSize = 256
+
+type (
+    rangeEntry struct {
+        key     string
+        value   []byte
+        r       io.Reader
+        size    int64
+        deleted bool
+    }
+    // rangeSource 按 key 升序产出数据的来源, emit 返回 false 时应停止产出;
+    // emit 会阻塞到合并取走数据, 不能在持有后端锁或事务时调用
+    rangeSource func(ctx context.Context, emit func(e rangeEntry) bool) error
+    mergeCursor struct {
+        ch   chan rangeEntry
+        head rangeEntry
+        ok   bool
+    }
+)
+
+// mergeRange 对多个有序来源做 k-way 合并, 同一个 key 只输出一次, 取下标最小的来源;
+// 该来源标记为删除时跳过这个 key
+func mergeRange(ctx context.Context, sources []rangeSource, cb func(e rangeEntry) bool) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    var (
+        wg      sync.WaitGroup
+        errs    = make([]error, len(sources))
+        cursors = make([]*mergeCursor, len(sources))
+    )
+    for i, source := range sources {
+        cur := &mergeCursor{ch: make(chan rangeEntry)}
+        cursors[i] = cur
+        wg.Add(1)
+        go func(i int, source rangeSource) {
+            defer wg.Done()
+            defer close(cur.ch)
+            errs[i] = source(ctx, func(e rangeEntry) bool {
+                select {
+                case cur.ch <- e:
+                    return true
+                case <-ctx.Done():
+                    return false
+                }
+            })
+        }(i, source)
+    }
+    for _, cur := range cursors {
+        cur.head, cur.ok = <-cur.ch
+    }
+
+    for {
+        winner := -1
+        for i, cur := range cursors {
+            if !cur.ok {
+                continue
+            }
+            if winner == -1 || cur.head.key < cursors[winner].head.key {
+                winner = i
+            }
+        }
+        if winner == -1 {
+            break
+        }
+        entry := cursors[winner].head
+        for i, cur := range cursors {
+            if !cur.ok || cur.head.key != entry.key {
+                continue
+            }
+            if i != winner {
+                discardEntry(cur.head)
+            }
+            cur.head, cur.ok = <-cur.ch
+        }
+        if entry.deleted {
+            discardEntry(entry)
+            continue
+        }
+        if !cb(entry) {
+            break
+        }
+        if ctx.Err() != nil {
+            break
+        }
+    }
+
+    cancel()
+    for _, cur := range cursors {
+        for e := range cur.ch {
+            discardEntry(e)
+        }
+    }
+    wg.Wait()
+    for _, err := range errs {
+        if err != nil && err != context.Canceled {
+            return err
+        }
+    }
+    return nil
+}
+
+func discardEntry(e rangeEntry) {
+    if closer, ok := e.r.(io.Closer); ok {
+        _ = closer.Close()
+    }
+}
+
+// pendingSource 异步写队列作为最前面的来源, 删除和过期的写入会遮住后面各层的旧值
+func (c *Chain) pendingSource(prefix, limit string, withValue bool) rangeSource {
+    return func(ctx context.Context, emit func(e rangeEntry) bool) error {
+        for _, op := range c.wb.snapshot(prefix, limit) {
+            e := rangeEntry{key: op.key, size: int64(len(op.value)), deleted: !op.visible()}
+            if withValue && !e.deleted {
+                e.value = op.value
+            }
+            if !emit(e) {
+                return nil
+            }
+        }
+        return nil
+    }
+}
+
+func (c *Chain) rangeSources(prefix, limit string, tier func(i int, store ContextStore) rangeSource, withValue bool) []rangeSource {
+    var sources []rangeSource
+    if c.wb != nil {
+        sources = append(sources, c.pendingSource(prefix, limit, withValue))
+    }
+    for i, s := range c.tiers {
+        sources = append(sources, c.tolerateSource(i, tier(i, s)))
+    }
+    return sources
+}
+
+// RangeKeysContext 各层取前 fetch 个 key 合并; 删除标记会遮住部分 key,
+// 合并结果不足 max 且有层被截断时加倍 fetch 重试
+func (c *Chain) RangeKeysContext(ctx context.Context, prefix, limit string, max int) (result KeysInfoSlice, err error) {
+    fetch := max
+    if fetch < 1 {
+        fetch = 1
+    }
+    for {
+        var (
+            mu        sync.Mutex
+            truncated bool
+        )
+        sources := c.rangeSources(prefix, limit, func(i int, store ContextStore) rangeSource {
+            return func(ctx context.Context, emit func(e rangeEntry) bool) error {
+                infos, err := store.RangeKeysContext(ctx, prefix, limit, fetch)
+                if err != nil {
+                    return err
+                }
+                if len(infos) >= fetch {
+                    mu.Lock()
+                    truncated = true
+                    mu.Unlock()
+                }
+                for _, info := range infos {
+                    if t, ok := store.(*chainTier); ok && t.dirty(info.Key) {
+                        continue
+                    }
+                    e := rangeEntry{key: info.Key, size: info.Size}
+                    if c.tombstoned(i) && (info.Size < 0 || info.Size == int64(len(tombstone))) {
+                        data, err := store.GetContext(ctx, info.Key)
+                        if IsNotFound(err) {
+                            continue
+                        }
+                        if err != nil {
+                            return err
+                        }
+                        e.deleted = isTombstone(data)
+                    }
+                    if !emit(e) {
+                        return nil
+                    }
+                }
+                return nil
+            }
+        }, false)
+        result = nil
+        err = mergeRange(ctx, sources, func(e rangeEntry) bool {
+            result = append(result, KeysInfo{Key: e.key, Size: e.size})
+            return len(result) < max
+        })
+        if err == nil {
+            err = ctx.Err()
+        }
+        if err != nil || len(result) >= max || !truncated {
+            return
+        }
+        fetch *= 2
+    }
+}
+
+// RangeContext 各层按页遍历, 每页复制出来并结束该层的遍历后才交给合并, 回调中可以经由存储链写入
+func (c *Chain) RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error {
+    sources := c.rangeSources(prefix, limit, func(i int, store ContextStore) rangeSource {
+        return func(ctx context.Context, emit func(e rangeEntry) bool) error {
+            var page []rangeEntry
+            return rangePages(prefix, func(start string, next func(key string) (ok, more bool)) error {
+                return store.RangeContext(ctx, start, limit, func(key string, value []byte) bool {
+                    ok, more := next(key)
+                    if ok {
+                        // 后端可能在遍历结束后复用 value 的内存
+                        page = append(page, rangeEntry{key: key, value: utils.CopyBytes(value), deleted: c.tombstoned(i) && isTombstone(value)})
+                    }
+                    return more
+                })
+            }, func() bool {
+                for _, e := range page {
+                    if !emit(e) {
+                        return false
+                    }
+                }
+                page = page[:0]
+                return true
+            })
+        }
+    }, true)
+    err := mergeRange(ctx, sources, func(e rangeEntry) bool {
+        return cb(e.key, e.value)
+    })
+    if err == nil {
+        err = ctx.Err()
+    }
+    return err
+}
+
+// RRangeContext 各层按页列出 key, 结束该层的遍历后再逐个 RGet 交给合并; 列出之后被删除的 key 跳过
+func (c *Chain) RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    sources := c.rangeSources(prefix, limit, func(i int, store ContextStore) rangeSource {
+        return func(ctx context.Context, emit func(e rangeEntry) bool) error {
+            var (
+                keys []string
+                err  error
+            )
+            pageErr := rangePages(prefix, func(start string, next func(key string) (ok, more bool)) error {
+                return store.RRangeContext(ctx, start, limit, func(key string, _ io.Reader) bool {
+                    ok, more := next(key)
+                    if ok {
+                        keys = append(keys, key)
+                    }
+                    return more
+                })
+            }, func() bool {
+                for _, key := range keys {
+                    var r io.Reader
+                    r, err = store.RGetContext(ctx, key)
+                    if IsNotFound(err) || err == ErrTierUnavailable && isDirty(store, key) {
+                        err = nil
+                        continue
+                    }
+                    if err != nil {
+                        return false
+                    }
+                    e := rangeEntry{key: key, r: r}
+                    if c.tombstoned(i) {
+                        if e.r, e.deleted, err = peekTombstone(r); err != nil {
+                            return false
+                        }
+                    }
+                    if !emit(e) {
+                        discardEntry(e)
+                        return false
+                    }
+                }
+                keys = keys[:0]
+                return true
+            })
+            if err != nil {
+                return err
+            }
+            return pageErr
+        }
+    }, true)
+    err := mergeRange(ctx, sources, func(e rangeEntry) bool {
+        r := e.r
+        if r == nil {
+            r = bytes.NewReader(e.value)
+        }
+        return cb(e.key, r)
+    })
+    if err == nil {
+        err = ctx.Err()
+    }
+    return err
+}
+
+// rangePages 分页遍历一层: walk 从 start 开始遍历, 对每个 key 调用 next, ok 为 false 时跳过该 key,
+// more 为 false 时结束遍历; 每页结束遍历后调用 flush, flush 返回 false 时停止.
+// 下一页从上一页最后一个 key 之后开始, 部分后端的 prefix 不是严格的下界, 因此仍然跳过已经取出的 key
+func rangePages(prefix string, walk func(start string, next func(key string) (ok, more bool)) error, flush func() bool) error {
+    var (
+        start = prefix
+        last  string
+        seen  bool
+    )
+    for {
+        n := 0
+        err := walk(start, func(key string) (ok, more bool) {
+            if seen && key <= last {
+                return false, true
+            }
+            last, n = key, n+1
+            return true, n < rangePageSize
+        })
+        if err != nil {
+            return err
+        }
+        if !flush() || n < rangePageSize {
+            return nil
+        }
+        start, seen = last+"\x00", true
+    }
+}
+
+// isDirty key 在该层是否有未写成功的数据
+func isDirty(store ContextStore, key string) bool {
+    t, ok := store.(*chainTier)
+    return ok && t.dirty(key)
+}
+
+// tolerateSource 开启 Health 时前面各层遍历失败只丢弃该层, 由后面的层补全
+func (c *Chain) tolerateSource(i int, src rangeSource) rangeSource {
+    return func(ctx context.Context, emit func(rangeEntry) bool) error {
+        if err := src(ctx, emit); !c.tolerate(ctx, i, err) {
+            return err
+        }
+        return nil
+    }
+}
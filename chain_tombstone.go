@@ -0,0 +1,227 @@
+package store
+
+import (
+    "bytes"
+    "context"
+    "io"
+    "io/ioutil"
+    "sync"
+    "time"
+)
+
+type (
+    // repairer 记录最后一层删除失败的 key, 后台重试直到成功. 记录只保存在内存中, 进程重启后丢失,
+    // 此时最后一层的旧值只在删除标记过期前被遮住
+    repairer struct {
+        c       *Chain
+        mu      sync.Mutex
+        keys    map[string]int
+        running map[string]*repairing
+        done    chan struct{}
+        stopped chan struct{}
+    }
+    // repairing 正在修复的 key, 修复期间不持有 mu; forgotten 表示期间有新的写入, 失败时不再重试
+    repairing struct {
+        done      chan struct{}
+        forgotten bool
+    }
+)
+
+// tombstone 删除标记, 写入前面各层以遮住后面各层中尚未删除的旧值
+var tombstone = []byte("\x00\x00store:tombstone\x00\x00")
+
+func isTombstone(value []byte) bool {
+    return bytes.Equal(value, tombstone)
+}
+
+// peekTombstone 读取 r 的开头判断是否为删除标记, 返回可以继续完整读取的 reader
+func peekTombstone(r io.Reader) (io.Reader, bool, error) {
+    head, err := ioutil.ReadAll(io.LimitReader(r, int64(len(tombstone))+1))
+    if err != nil {
+        return nil, false, err
+    }
+    if isTombstone(head) {
+        if closer, ok := r.(io.Closer); ok {
+            _ = closer.Close()
+        }
+        return nil, true, nil
+    }
+    return io.MultiReader(bytes.NewReader(head), r), false, nil
+}
+
+// reserved 开启删除标记时, 与删除标记相同的 value 写入后会被当作删除, 拒绝写入
+func (c *Chain) reserved(value []byte) bool {
+    return c.tombstoned(0) && isTombstone(value)
+}
+
+// tombstoned 第 i 层是否可能存有删除标记或缓存的未命中, 最后一层总是直接删除
+func (c *Chain) tombstoned(i int) bool {
+    return (c.opts.TombstoneTTL > 0 || c.opts.NegativeTTL > 0) && i < len(c.list)-1
+}
+
+func newRepairer(c *Chain) *repairer {
+    rp := &repairer{
+        c:       c,
+        keys:    map[string]int{},
+        running: map[string]*repairing{},
+        done:    make(chan struct{}),
+        stopped: make(chan struct{}),
+    }
+    go rp.loop()
+    return rp
+}
+
+func (rp *repairer) loop() {
+    defer close(rp.stopped)
+    interval := rp.c.opts.RepairInterval
+    if interval <= 0 {
+        interval = time.Second
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-rp.done:
+            return
+        case <-ticker.C:
+            _ = rp.repair(context.Background())
+        }
+    }
+}
+
+func (rp *repairer) add(key string) {
+    rp.mu.Lock()
+    rp.keys[key]++
+    rp.mu.Unlock()
+}
+
+// forget 新的写入覆盖了待修复的删除; 该 key 正在修复时等待修复结束, 避免修复删除新写入的值
+func (rp *repairer) forget(key string) {
+    rp.mu.Lock()
+    delete(rp.keys, key)
+    r := rp.running[key]
+    if r != nil {
+        r.forgotten = true
+    }
+    rp.mu.Unlock()
+    if r != nil {
+        <-r.done
+    }
+}
+
+// repairKey key 有待修复的删除时立即修复, 用于需要最后一层数据准确的操作
+func (rp *repairer) repairKey(ctx context.Context, key string) error {
+    for {
+        rp.mu.Lock()
+        if r := rp.running[key]; r != nil {
+            rp.mu.Unlock()
+            <-r.done
+            continue
+        }
+        n, ok := rp.keys[key]
+        if !ok {
+            rp.mu.Unlock()
+            return nil
+        }
+        // 修复需要访问最后一层, 不持有 mu, 其他 key 的写入不会被阻塞
+        delete(rp.keys, key)
+        r := &repairing{done: make(chan struct{})}
+        rp.running[key] = r
+        rp.mu.Unlock()
+
+        err := rp.c.repairDelete(ctx, key)
+        rp.mu.Lock()
+        delete(rp.running, key)
+        if err != nil && !r.forgotten {
+            rp.keys[key] = n + 1
+        }
+        rp.mu.Unlock()
+        close(r.done)
+        return err
+    }
+}
+
+func (rp *repairer) repair(ctx context.Context) error {
+    rp.mu.Lock()
+    keys := make([]string, 0, len(rp.keys))
+    for key := range rp.keys {
+        keys = append(keys, key)
+    }
+    rp.mu.Unlock()
+
+    var firstErr error
+    for _, key := range keys {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        if err := rp.repairKey(ctx, key); err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
+
+func (rp *repairer) pending() int {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+    return len(rp.keys)
+}
+
+func (rp *repairer) close() {
+    close(rp.done)
+    <-rp.stopped
+}
+
+// writeTombstones 在前面各层写入删除标记, 写入失败的层退化为直接删除
+func (c *Chain) writeTombstones(ctx context.Context, key string) error {
+    for i := 0; i < len(c.list)-1; i++ {
+        s := c.tiers[i]
+        if err := s.PutTTLContext(ctx, key, tombstone, c.opts.TombstoneTTL); err != nil {
+            if err = s.DeleteContext(ctx, key); !c.tolerate(ctx, i, err) {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// deleteWithTombstone 先在前面各层写入删除标记, 再删除最后一层; 最后一层失败时交给后台修复
+func (c *Chain) deleteWithTombstone(ctx context.Context, key string) error {
+    if err := c.writeTombstones(ctx, key); err != nil {
+        return err
+    }
+    if err := c.tiers[len(c.tiers)-1].DeleteContext(ctx, key); err != nil {
+        c.rp.add(key)
+        return nil
+    }
+    c.invalidate(ctx, key)
+    return nil
+}
+
+// repairDelete 刷新删除标记的有效期并重新删除最后一层
+func (c *Chain) repairDelete(ctx context.Context, key string) error {
+    if err := c.writeTombstones(ctx, key); err != nil {
+        return err
+    }
+    if err := c.tiers[len(c.tiers)-1].DeleteContext(ctx, key); err != nil {
+        return err
+    }
+    c.invalidate(ctx, key)
+    return nil
+}
+
+// Repair 立即重试所有删除失败的 key, 返回第一个失败的错误
+func (c *Chain) Repair(ctx context.Context) error {
+    if c.rp == nil {
+        return nil
+    }
+    return c.rp.repair(ctx)
+}
+
+// PendingRepairs 等待修复的删除数量, 只统计本进程内存中的记录
+func (c *Chain) PendingRepairs() int {
+    if c.rp == nil {
+        return 0
+    }
+    return c.rp.pending()
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+    "context"
+    "github.com/DGHeroin/store/utils"
+    "sync/atomic"
+)
+
+type (
+    // chainEcho 某个 key 最近转发的一次变更, tiers 记录已经报告过该变更的层
+    chainEcho struct {
+        t     EventType
+        size  int64
+        tiers uint64
+    }
+    // tierEvent 第 i 层的事件, closed 表示该层的 channel 已关闭
+    tierEvent struct {
+        i      int
+        ev     Event
+        closed bool
+    }
+)
+
+const (
+    // chainEchoKeys 每个订阅用于去重的最近 key 数量
+    chainEchoKeys = 4096
+    // chainEchoDepth 每个 key 保留的最近变更数量, 各层的事件到达顺序可能相差几次写入
+    chainEchoDepth = 8
+)
+
+// Watch 合并各层的变更: 最后一层的事件全部转发; 前面各层只转发写入, 在写回模式下它们最先到达,
+// 过期, 淘汰, 删除和删除标记只是缓存行为, 以最后一层为准. 同一次写入在各层产生的事件只转发一次,
+// 回填通常也不会产生事件; Revision 由存储链重新分配.
+// 最后一层不支持 WatchStore 时返回已关闭的 channel; 任意一层的 channel 被关闭时返回的 channel 也会关闭
+func (c *Chain) Watch(ctx context.Context, prefix string) <-chan Event {
+    out := make(chan Event, WatchBuffer)
+    last := len(c.list) - 1
+    if last < 0 {
+        close(out)
+        return out
+    }
+    if _, ok := c.list[last].(WatchStore); !ok {
+        close(out)
+        return out
+    }
+    ctx, cancel := context.WithCancel(ctx)
+    in := make(chan tierEvent)
+    for i, s := range c.list {
+        ws, ok := s.(WatchStore)
+        if !ok {
+            continue
+        }
+        go func(i int, ch <-chan Event) {
+            for ev := range ch {
+                if !c.watchable(ctx, i, ev) {
+                    continue
+                }
+                select {
+                case in <- tierEvent{i: i, ev: ev}:
+                case <-ctx.Done():
+                    return
+                }
+            }
+            select {
+            case in <- tierEvent{i: i, closed: true}:
+            case <-ctx.Done():
+            }
+        }(i, ws.Watch(ctx, prefix))
+    }
+    go func() {
+        defer close(out)
+        defer cancel()
+        seen := utils.NewLRU(chainEchoKeys, nil)
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case te := <-in:
+                if te.closed {
+                    return
+                }
+                if echoed(seen, te.i, te.ev) {
+                    continue
+                }
+                ev := te.ev
+                ev.Revision = atomic.AddUint64(&c.rev, 1)
+                select {
+                case out <- ev:
+                default:
+                    return
+                }
+            }
+        }
+    }()
+    return out
+}
+
+// watchable 第 i 层的事件是否需要转发; 大小与删除标记相同的写入读取该层的值确认,
+// 读取失败时值已经被删除或覆盖, 覆盖的写入有自己的事件
+func (c *Chain) watchable(ctx context.Context, i int, ev Event) bool {
+    if i == len(c.list)-1 {
+        return true
+    }
+    if ev.Type != EventPut {
+        return false
+    }
+    if !c.tombstoned(i) || (ev.Size >= 0 && ev.Size != int64(len(tombstone))) {
+        return true
+    }
+    data, err := c.tiers[i].GetContext(ctx, ev.Key)
+    return err == nil && !isTombstone(data)
+}
+
+// echoed ev 是否是已转发的变更在第 i 层的重复: 按顺序匹配该层还没有报告过的变更, Size 为 -1 时只比较类型.
+// 不是重复时记录为新的变更, 删除类的变更会清除之前的记录
+func echoed(seen *utils.LRU, i int, ev Event) bool {
+    bit := uint64(1) << uint(i%64)
+    var history []*chainEcho
+    if p, ok := seen.Get(ev.Key); ok {
+        history = p.([]*chainEcho)
+        for _, e := range history {
+            if e.tiers&bit == 0 && e.t == ev.Type && (e.size == ev.Size || e.size < 0 || ev.Size < 0) {
+                e.tiers |= bit
+                return true
+            }
+        }
+    }
+    e := &chainEcho{t: ev.Type, size: ev.Size, tiers: bit}
+    if ev.Type != EventPut {
+        history = nil
+    } else if len(history) >= chainEchoDepth {
+        history = history[1:]
+    }
+    seen.Add(ev.Key, append(history, e))
+    return false
+}
+
+var _ WatchStore = &Chain{}
@@ -0,0 +1,390 @@
+package store
+
+import (
+    "context"
+    "sort"
+    "sync"
+    "time"
+)
+
+type (
+    // WriteBackOptions 存储链异步写配置
+    WriteBackOptions struct {
+        // BatchSize 每轮最多刷新的 key 数量, 待刷新数量达到该值时立即触发一轮, 默认 64
+        BatchSize int
+        // FlushInterval 后台刷新间隔, 默认 100ms
+        FlushInterval time.Duration
+        // RetryBackoff 首次重试的等待时间, 之后每次翻倍, 默认 100ms
+        RetryBackoff time.Duration
+        // MaxBackoff 重试等待的上限, 默认 30s
+        MaxBackoff time.Duration
+        // MaxRetries 最大重试次数, 超过后丢弃并回调 OnError, 0 表示一直重试
+        MaxRetries int
+        // CloseTimeout Close 时等待队列刷完的最长时间, 默认 10s
+        CloseTimeout time.Duration
+        // OnError 写入被丢弃时的回调
+        OnError func(key string, err error)
+    }
+    writeBack struct {
+        c       *Chain
+        opts    WriteBackOptions
+        ctx     context.Context
+        cancel  context.CancelFunc
+        mu      sync.Mutex
+        seq     uint64
+        pending map[string]*writeOp
+        changed chan struct{}
+        notify  chan struct{}
+        done    chan struct{}
+        stopped chan struct{}
+        closed  bool
+    }
+    writeOp struct {
+        key      string
+        value    []byte
+        expireAt time.Time
+        deleted  bool
+        seq      uint64
+        attempts int
+        nextTry  time.Time
+        inflight bool
+    }
+)
+
+func newWriteBack(c *Chain, opts WriteBackOptions) *writeBack {
+    if opts.BatchSize <= 0 {
+        opts.BatchSize = 64
+    }
+    if opts.FlushInterval <= 0 {
+        opts.FlushInterval = time.Millisecond * 100
+    }
+    if opts.RetryBackoff <= 0 {
+        opts.RetryBackoff = time.Millisecond * 100
+    }
+    if opts.MaxBackoff <= 0 {
+        opts.MaxBackoff = time.Second * 30
+    }
+    if opts.CloseTimeout <= 0 {
+        opts.CloseTimeout = time.Second * 10
+    }
+    w := &writeBack{
+        c:       c,
+        opts:    opts,
+        pending: map[string]*writeOp{},
+        changed: make(chan struct{}),
+        notify:  make(chan struct{}, 1),
+        done:    make(chan struct{}),
+        stopped: make(chan struct{}),
+    }
+    w.ctx, w.cancel = context.WithCancel(context.Background())
+    go w.loop()
+    return w
+}
+
+func (op *writeOp) expired(now time.Time) bool {
+    return !op.expireAt.IsZero() && !op.expireAt.After(now)
+}
+
+// visible 队列中的写入对读取是否可见, 删除和已过期的写入表现为 key 不存在
+func (op *writeOp) visible() bool {
+    return !op.deleted && !op.expired(time.Now())
+}
+
+func (op *writeOp) ttl() time.Duration {
+    if op.expireAt.IsZero() {
+        return 0
+    }
+    return time.Until(op.expireAt)
+}
+
+func (w *writeBack) accepting() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if w.closed {
+        return ErrClosed
+    }
+    return nil
+}
+
+func (w *writeBack) enqueue(op *writeOp) error {
+    w.mu.Lock()
+    if w.closed {
+        w.mu.Unlock()
+        return ErrClosed
+    }
+    w.seq++
+    op.seq = w.seq
+    w.pending[op.key] = op
+    n := len(w.pending)
+    w.mu.Unlock()
+    if n >= w.opts.BatchSize {
+        w.kick()
+    }
+    return nil
+}
+
+func (w *writeBack) kick() {
+    select {
+    case w.notify <- struct{}{}:
+    default:
+    }
+}
+
+func (w *writeBack) lookup(key string) (*writeOp, bool) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    op, ok := w.pending[key]
+    return op, ok
+}
+
+// snapshot 返回 [prefix, limit) 内待刷新的写入, 按 key 排序
+func (w *writeBack) snapshot(prefix, limit string) []*writeOp {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    var ops []*writeOp
+    for key, op := range w.pending {
+        if inRange(key, prefix, limit) {
+            ops = append(ops, op)
+        }
+    }
+    sort.Slice(ops, func(i, j int) bool {
+        return ops[i].key < ops[j].key
+    })
+    return ops
+}
+
+func (w *writeBack) loop() {
+    defer close(w.stopped)
+    timer := time.NewTimer(w.opts.FlushInterval)
+    defer timer.Stop()
+    for {
+        select {
+        case <-w.done:
+            return
+        case <-timer.C:
+        case <-w.notify:
+        }
+        w.flushOnce()
+        if !timer.Stop() {
+            select {
+            case <-timer.C:
+            default:
+            }
+        }
+        timer.Reset(w.nextWait())
+    }
+}
+
+// nextWait 距离下一次刷新的时间, 有等待重试的写入时提前到其重试时间
+func (w *writeBack) nextWait() time.Duration {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    wait := w.opts.FlushInterval
+    now := time.Now()
+    for _, op := range w.pending {
+        if op.nextTry.IsZero() {
+            continue
+        }
+        if d := op.nextTry.Sub(now); d < wait {
+            wait = d
+        }
+    }
+    if wait < 0 {
+        wait = 0
+    }
+    return wait
+}
+
+func (w *writeBack) flushOnce() {
+    for {
+        batch := w.take()
+        errs := w.c.persist(w.ctx, batch)
+        for i, op := range batch {
+            w.finish(op, errs[i])
+        }
+        if len(batch) < w.opts.BatchSize {
+            return
+        }
+    }
+}
+
+// take 取出到期可以刷新的写入, 按写入顺序排列
+func (w *writeBack) take() []*writeOp {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    now := time.Now()
+    var batch []*writeOp
+    for _, op := range w.pending {
+        if op.inflight || op.nextTry.After(now) {
+            continue
+        }
+        batch = append(batch, op)
+    }
+    sort.Slice(batch, func(i, j int) bool {
+        return batch[i].seq < batch[j].seq
+    })
+    if len(batch) > w.opts.BatchSize {
+        batch = batch[:w.opts.BatchSize]
+    }
+    for _, op := range batch {
+        op.inflight = true
+    }
+    return batch
+}
+
+func (w *writeBack) finish(op *writeOp, err error) {
+    w.mu.Lock()
+    op.inflight = false
+    current := w.pending[op.key] == op
+    dropped := false
+    switch {
+    case !current:
+        // 已被更新的写入覆盖, 由新的写入负责刷新
+    case err == nil:
+        delete(w.pending, op.key)
+    default:
+        op.attempts++
+        if w.opts.MaxRetries > 0 && op.attempts > w.opts.MaxRetries {
+            delete(w.pending, op.key)
+            dropped = true
+        } else {
+            op.nextTry = time.Now().Add(w.backoff(op.attempts))
+        }
+    }
+    close(w.changed)
+    w.changed = make(chan struct{})
+    w.mu.Unlock()
+    if dropped && w.opts.OnError != nil {
+        w.opts.OnError(op.key, err)
+    }
+}
+
+func (w *writeBack) backoff(attempts int) time.Duration {
+    d := w.opts.RetryBackoff
+    for i := 1; i < attempts && d < w.opts.MaxBackoff; i++ {
+        d *= 2
+    }
+    if d > w.opts.MaxBackoff {
+        d = w.opts.MaxBackoff
+    }
+    return d
+}
+
+// flush 立即重试所有待刷新的写入并等待队列清空
+func (w *writeBack) flush(ctx context.Context) error {
+    w.mu.Lock()
+    for _, op := range w.pending {
+        op.nextTry = time.Time{}
+    }
+    w.mu.Unlock()
+    for {
+        w.mu.Lock()
+        if len(w.pending) == 0 {
+            w.mu.Unlock()
+            return nil
+        }
+        ch := w.changed
+        w.mu.Unlock()
+        w.kick()
+        select {
+        case <-ch:
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
+
+func (w *writeBack) close() error {
+    w.mu.Lock()
+    if w.closed {
+        w.mu.Unlock()
+        return nil
+    }
+    w.closed = true
+    w.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), w.opts.CloseTimeout)
+    defer cancel()
+    err := w.flush(ctx)
+    // 超时后中断卡在后面各层的写入
+    w.cancel()
+    close(w.done)
+    <-w.stopped
+    return err
+}
+
+// persist 把一批写入同步到第一层之后的所有层, 返回每个写入的结果: 删除和已过期的写入合并为一次 MDelete,
+// 过期时间相同的写入合并为一次 MPutTTL
+func (c *Chain) persist(ctx context.Context, ops []*writeOp) []error {
+    errs := make([]error, len(ops))
+    now := time.Now()
+    var deletes []int
+    puts := map[int64][]int{}
+    for i, op := range ops {
+        if op.deleted || op.expired(now) {
+            deletes = append(deletes, i)
+        } else if op.expireAt.IsZero() {
+            puts[0] = append(puts[0], i)
+        } else {
+            at := op.expireAt.UnixNano()
+            puts[at] = append(puts[at], i)
+        }
+    }
+    if len(deletes) > 0 {
+        c.persistGroup(ctx, ops, deletes, errs)
+    }
+    for _, group := range puts {
+        c.persistGroup(ctx, ops, group, errs)
+    }
+    return errs
+}
+
+// persistGroup 从后往前逐层批量写入 ops 中下标为 group 的写入, 结果记录在 errs 中
+func (c *Chain) persistGroup(ctx context.Context, ops []*writeOp, group []int, errs []error) {
+    first := ops[group[0]]
+    deleted := first.deleted || first.expired(time.Now())
+    var ttl time.Duration
+    if !deleted && !first.expireAt.IsZero() {
+        // 分组之后才过期的写入改为删除
+        if ttl = first.ttl(); ttl <= 0 {
+            deleted = true
+        }
+    }
+    keys := make([]string, len(group))
+    kvs := make(map[string][]byte, len(group))
+    for i, j := range group {
+        keys[i] = ops[j].key
+        kvs[ops[j].key] = ops[j].value
+    }
+    var err error
+    last := len(c.list) - 1
+    for i := last; i >= 1; i-- {
+        s := c.tiers[i]
+        if deleted {
+            err = s.MDeleteContext(ctx, keys...)
+        } else {
+            err = s.MPutTTLContext(ctx, kvs, ttl)
+        }
+        if !c.tolerate(ctx, i, err) {
+            break
+        }
+        err = nil
+        if i == last {
+            c.invalidate(ctx, keys...)
+        }
+    }
+    for _, j := range group {
+        errs[j] = err
+    }
+}
+
+// Flush 等待异步写入全部落到后面的各层, 未开启 WriteBack 时直接返回
+func (c *Chain) Flush(ctx context.Context) error {
+    if c.wb == nil {
+        return nil
+    }
+    return c.wb.flush(ctx)
+}
+
+func inRange(key, prefix, limit string) bool {
+    return key >= prefix && (limit == "" || key < limit)
+}
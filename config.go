@@ -0,0 +1,499 @@
+package store
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "gopkg.in/yaml.v3"
+    "io/ioutil"
+    "net/url"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type (
+    // Config 声明式的 bucket 配置, 可以用 YAML 或 JSON 编写:
+    //   buckets:
+    //     cache:  {type: lru, size: 10000}
+    //     redis:  {type: redis, addr: "127.0.0.1:6379", pool_size: 20}
+    //     blob:   {type: s3, endpoint: "minio:9000", bucket: blob, access_key: k, secret_key: s, secure: false}
+    //     main:
+    //       type: chain
+    //       read_through: true
+    //       tiers:
+    //         - {use: cache, max_ttl: 1m}
+    //         - {use: redis, max_ttl: 1h}
+    //         - {use: blob}
+    // 除 chain 外的 type 都通过 Open 创建, 需要导入对应的后端包; 也可以直接用 dsn 描述
+    Config struct {
+        Buckets map[string]*BucketConfig `yaml:"buckets" json:"buckets"`
+    }
+    // BucketConfig 单个 bucket 的配置, 各字段只对相应的 type 生效
+    BucketConfig struct {
+        Type string `yaml:"type" json:"type"`
+        DSN  string `yaml:"dsn" json:"dsn"`
+
+        // bolt, leveldb
+        Path string `yaml:"path" json:"path"`
+        // bolt 的 bucket 名, s3 的 bucket 名
+        Bucket string `yaml:"bucket" json:"bucket"`
+        // lru
+        Size int `yaml:"size" json:"size"`
+        // memory, lru, bolt, leveldb, s3 的后台过期清理, sweep_budget 为每次检查的 key 数量
+        SweepInterval Duration `yaml:"sweep_interval" json:"sweep_interval"`
+        SweepBudget   int      `yaml:"sweep_budget" json:"sweep_budget"`
+
+        // redis
+        Addr     string     `yaml:"addr" json:"addr"`
+        Username string     `yaml:"username" json:"username"`
+        Password string     `yaml:"password" json:"password"`
+        DB       int        `yaml:"db" json:"db"`
+        PoolSize int        `yaml:"pool_size" json:"pool_size"`
+        TLS      *TLSConfig `yaml:"tls" json:"tls"`
+
+        // s3
+        Endpoint  string `yaml:"endpoint" json:"endpoint"`
+        AccessKey string `yaml:"access_key" json:"access_key"`
+        SecretKey string `yaml:"secret_key" json:"secret_key"`
+        Secure    *bool  `yaml:"secure" json:"secure"`
+
+        // chain
+        Tiers          []*TierConfig `yaml:"tiers" json:"tiers"`
+        ReadThrough    bool          `yaml:"read_through" json:"read_through"`
+        TombstoneTTL   Duration      `yaml:"tombstone_ttl" json:"tombstone_ttl"`
+        RepairInterval Duration      `yaml:"repair_interval" json:"repair_interval"`
+        NegativeTTL    Duration      `yaml:"negative_ttl" json:"negative_ttl"`
+        Singleflight   bool          `yaml:"singleflight" json:"singleflight"`
+    }
+    // TierConfig chain 中的一层: use 引用其他 bucket, 或者内联一个 bucket 配置
+    TierConfig struct {
+        Use          string `yaml:"use" json:"use"`
+        BucketConfig `yaml:",inline"`
+        MaxTTL       Duration `yaml:"max_ttl" json:"max_ttl"`
+        MaxValueSize int64    `yaml:"max_value_size" json:"max_value_size"`
+        Timeout      Duration `yaml:"timeout" json:"timeout"`
+    }
+    TLSConfig struct {
+        Crt        string `yaml:"crt" json:"crt"`
+        Key        string `yaml:"key" json:"key"`
+        CA         string `yaml:"ca" json:"ca"`
+        SkipVerify bool   `yaml:"skip_verify" json:"skip_verify"`
+    }
+    // Duration 配置中的时长, 写作 "1m30s" 这样的字符串, 或以秒为单位的数字
+    Duration time.Duration
+    // ConfigError 配置错误, Field 指向出错的字段, 如 buckets.main.tiers[1].type
+    ConfigError struct {
+        Field string
+        Err   error
+    }
+    // bucketPlan 校验后的 bucket, 还没有创建
+    bucketPlan struct {
+        field string
+        dsn   string
+        chain *chainPlan
+    }
+    chainPlan struct {
+        opts  ChainOptions
+        tiers []tierPlan
+    }
+    tierPlan struct {
+        field string
+        use   string
+        plan  *bucketPlan
+    }
+)
+
+func (e *ConfigError) Error() string {
+    return "store: config " + e.Field + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+    return e.Err
+}
+
+func (d *Duration) parse(s string) error {
+    if s == "" {
+        *d = 0
+        return nil
+    }
+    if v, err := time.ParseDuration(s); err == nil {
+        *d = Duration(v)
+        return nil
+    }
+    sec, err := strconv.ParseFloat(s, 64)
+    if err != nil {
+        return fmt.Errorf("invalid duration %q", s)
+    }
+    *d = Duration(sec * float64(time.Second))
+    return nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+    if err := d.parse(node.Value); err != nil {
+        return fmt.Errorf("line %d: %w", node.Line, err)
+    }
+    return nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        s = string(data)
+    }
+    return d.parse(s)
+}
+
+// ParseConfig 解析 YAML 或 JSON 格式的配置, 未知字段视为错误
+func ParseConfig(data []byte) (*Config, error) {
+    cfg := &Config{}
+    if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+        dec := json.NewDecoder(bytes.NewReader(data))
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(cfg); err != nil {
+            return nil, fmt.Errorf("store: config: %w", err)
+        }
+    } else {
+        dec := yaml.NewDecoder(bytes.NewReader(data))
+        dec.KnownFields(true)
+        if err := dec.Decode(cfg); err != nil {
+            return nil, fmt.Errorf("store: config: %w", err)
+        }
+    }
+    return cfg, nil
+}
+
+// LoadConfig 读取配置文件, 创建所有 bucket 并通过 InitStore 注册; 任何一个失败时不注册任何 bucket
+func LoadConfig(filename string) error {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return err
+    }
+    cfg, err := ParseConfig(data)
+    if err != nil {
+        return fmt.Errorf("%w (%s)", err, filepath.Base(filename))
+    }
+    return cfg.Apply()
+}
+
+// Validate 只校验配置, 不创建任何 Store
+func (c *Config) Validate() error {
+    _, err := c.plan()
+    return err
+}
+
+// Apply 创建所有 bucket 并通过 InitStore 注册, 任何一个失败时关闭已创建的 Store 并返回错误
+func (c *Config) Apply() error {
+    stores, err := c.Build()
+    if err != nil {
+        return err
+    }
+    for name, s := range stores {
+        InitStore(name, s)
+    }
+    return nil
+}
+
+// Build 创建所有 bucket 但不注册, 被 chain 引用的 bucket 与 chain 共享同一个 Store
+func (c *Config) Build() (map[string]Store, error) {
+    plans, err := c.plan()
+    if err != nil {
+        return nil, err
+    }
+    stores := map[string]Store{}
+    var opened []Store
+    var build func(p *bucketPlan) (Store, error)
+    build = func(p *bucketPlan) (Store, error) {
+        if p.chain == nil {
+            s, err := Open(p.dsn)
+            if err != nil {
+                return nil, &ConfigError{Field: p.field, Err: err}
+            }
+            opened = append(opened, s)
+            return s, nil
+        }
+        var tiers []Store
+        for _, t := range p.chain.tiers {
+            if t.use != "" {
+                s, err := named(t.use, plans, stores, build)
+                if err != nil {
+                    return nil, err
+                }
+                tiers = append(tiers, s)
+                continue
+            }
+            s, err := build(t.plan)
+            if err != nil {
+                return nil, err
+            }
+            tiers = append(tiers, s)
+        }
+        return NewChainWithOptions(p.chain.opts, tiers...), nil
+    }
+    for _, name := range sortedNames(plans) {
+        if _, err := named(name, plans, stores, build); err != nil {
+            for i := len(opened) - 1; i >= 0; i-- {
+                _ = opened[i].Close()
+            }
+            return nil, err
+        }
+    }
+    return stores, nil
+}
+
+func named(name string, plans map[string]*bucketPlan, stores map[string]Store, build func(p *bucketPlan) (Store, error)) (Store, error) {
+    if s, ok := stores[name]; ok {
+        return s, nil
+    }
+    s, err := build(plans[name])
+    if err != nil {
+        return nil, err
+    }
+    stores[name] = s
+    return s, nil
+}
+
+func sortedNames(plans map[string]*bucketPlan) []string {
+    names := make([]string, 0, len(plans))
+    for name := range plans {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// plan 校验所有 bucket 并生成 DSN, 检查 use 引用是否存在以及是否成环
+func (c *Config) plan() (map[string]*bucketPlan, error) {
+    if len(c.Buckets) == 0 {
+        return nil, &ConfigError{Field: "buckets", Err: fmt.Errorf("no bucket defined")}
+    }
+    plans := map[string]*bucketPlan{}
+    for name, b := range c.Buckets {
+        field := "buckets." + name
+        if b == nil {
+            return nil, &ConfigError{Field: field, Err: fmt.Errorf("empty bucket")}
+        }
+        p, err := planBucket(field, b)
+        if err != nil {
+            return nil, err
+        }
+        plans[name] = p
+    }
+    const (
+        visiting = 1
+        done     = 2
+    )
+    state := map[string]int{}
+    var visit func(name string) error
+    visit = func(name string) error {
+        switch state[name] {
+        case visiting:
+            return fmt.Errorf("reference cycle through %q", name)
+        case done:
+            return nil
+        }
+        state[name] = visiting
+        var walk func(p *bucketPlan) error
+        walk = func(p *bucketPlan) error {
+            if p.chain == nil {
+                return nil
+            }
+            for _, t := range p.chain.tiers {
+                if t.use == "" {
+                    if err := walk(t.plan); err != nil {
+                        return err
+                    }
+                    continue
+                }
+                if _, ok := plans[t.use]; !ok {
+                    return &ConfigError{Field: t.field + ".use", Err: fmt.Errorf("unknown bucket %q", t.use)}
+                }
+                if err := visit(t.use); err != nil {
+                    if _, ok := err.(*ConfigError); ok {
+                        return err
+                    }
+                    return &ConfigError{Field: t.field + ".use", Err: err}
+                }
+            }
+            return nil
+        }
+        if err := walk(plans[name]); err != nil {
+            return err
+        }
+        state[name] = done
+        return nil
+    }
+    for _, name := range sortedNames(plans) {
+        if err := visit(name); err != nil {
+            return nil, err
+        }
+    }
+    return plans, nil
+}
+
+func planBucket(field string, b *BucketConfig) (*bucketPlan, error) {
+    fail := func(name string, format string, args ...interface{}) error {
+        return &ConfigError{Field: field + "." + name, Err: fmt.Errorf(format, args...)}
+    }
+    if b.SweepInterval < 0 {
+        return nil, fail("sweep_interval", "must not be negative")
+    }
+    if b.SweepBudget < 0 {
+        return nil, fail("sweep_budget", "must not be negative")
+    }
+    if b.SweepBudget > 0 && b.SweepInterval == 0 {
+        return nil, fail("sweep_budget", "requires sweep_interval")
+    }
+    if b.DSN != "" {
+        if b.Type != "" {
+            return nil, fail("dsn", "dsn and type are mutually exclusive")
+        }
+        return &bucketPlan{field: field, dsn: withSweep(b.DSN, b)}, nil
+    }
+    p := &bucketPlan{field: field}
+    switch b.Type {
+    case "":
+        return nil, fail("type", "type or dsn is required")
+    case "memory":
+        p.dsn = "memory"
+    case "lru":
+        if b.Size < 0 {
+            return nil, fail("size", "must not be negative")
+        }
+        p.dsn = "lru://"
+        if b.Size > 0 {
+            p.dsn += "?size=" + strconv.Itoa(b.Size)
+        }
+    case "bolt":
+        if b.Path == "" {
+            return nil, fail("path", "required for bolt")
+        }
+        p.dsn = "bolt://" + b.Path
+        if b.Bucket != "" {
+            p.dsn += "?" + url.Values{"bucket": {b.Bucket}}.Encode()
+        }
+    case "leveldb":
+        if b.Path == "" {
+            return nil, fail("path", "required for leveldb")
+        }
+        p.dsn = "leveldb://" + b.Path
+    case "redis":
+        if b.Addr == "" {
+            return nil, fail("addr", "required for redis")
+        }
+        if b.PoolSize < 0 {
+            return nil, fail("pool_size", "must not be negative")
+        }
+        if b.DB < 0 {
+            return nil, fail("db", "must not be negative")
+        }
+        u := &url.URL{Scheme: "redis", Host: b.Addr, Path: "/" + strconv.Itoa(b.DB)}
+        if b.Username != "" || b.Password != "" {
+            u.User = url.UserPassword(b.Username, b.Password)
+        }
+        q := url.Values{}
+        if b.PoolSize > 0 {
+            q.Set("pool", strconv.Itoa(b.PoolSize))
+        }
+        if b.TLS != nil {
+            u.Scheme = "rediss"
+            if (b.TLS.Crt == "") != (b.TLS.Key == "") {
+                return nil, fail("tls", "crt and key must be set together")
+            }
+            for k, v := range map[string]string{"tls_crt": b.TLS.Crt, "tls_key": b.TLS.Key, "tls_ca": b.TLS.CA} {
+                if v != "" {
+                    q.Set(k, v)
+                }
+            }
+            if b.TLS.SkipVerify {
+                q.Set("skip_verify", "true")
+            }
+        }
+        u.RawQuery = q.Encode()
+        p.dsn = u.String()
+    case "s3":
+        if b.Endpoint == "" {
+            return nil, fail("endpoint", "required for s3")
+        }
+        if b.Bucket == "" {
+            return nil, fail("bucket", "required for s3")
+        }
+        u := &url.URL{Scheme: "s3", Host: b.Endpoint, Path: "/" + b.Bucket}
+        if b.AccessKey != "" || b.SecretKey != "" {
+            u.User = url.UserPassword(b.AccessKey, b.SecretKey)
+        }
+        if b.Secure != nil {
+            u.RawQuery = "secure=" + strconv.FormatBool(*b.Secure)
+        }
+        p.dsn = u.String()
+    case "chain":
+        if len(b.Tiers) == 0 {
+            return nil, fail("tiers", "chain requires at least one tier")
+        }
+        p.chain = &chainPlan{opts: ChainOptions{
+            ReadThrough:    b.ReadThrough,
+            TombstoneTTL:   time.Duration(b.TombstoneTTL),
+            RepairInterval: time.Duration(b.RepairInterval),
+            NegativeTTL:    time.Duration(b.NegativeTTL),
+            Singleflight:   b.Singleflight,
+        }}
+        for i, t := range b.Tiers {
+            tierField := fmt.Sprintf("%s.tiers[%d]", field, i)
+            if t == nil {
+                return nil, &ConfigError{Field: tierField, Err: fmt.Errorf("empty tier")}
+            }
+            if t.MaxTTL < 0 || t.MaxValueSize < 0 || t.Timeout < 0 {
+                return nil, &ConfigError{Field: tierField, Err: fmt.Errorf("max_ttl, max_value_size and timeout must not be negative")}
+            }
+            tp := tierPlan{field: tierField, use: t.Use}
+            if t.Use != "" {
+                if t.Type != "" || t.DSN != "" {
+                    return nil, &ConfigError{Field: tierField + ".use", Err: fmt.Errorf("use is mutually exclusive with type and dsn")}
+                }
+            } else {
+                sub, err := planBucket(tierField, &t.BucketConfig)
+                if err != nil {
+                    return nil, err
+                }
+                tp.plan = sub
+            }
+            p.chain.tiers = append(p.chain.tiers, tp)
+            p.chain.opts.Tiers = append(p.chain.opts.Tiers, TierOptions{
+                MaxValueSize: t.MaxValueSize,
+                Timeout:      time.Duration(t.Timeout),
+                MaxTTL:       time.Duration(t.MaxTTL),
+            })
+        }
+    default:
+        return nil, fail("type", "unknown type %q", b.Type)
+    }
+    if b.Type != "chain" && len(b.Tiers) > 0 {
+        return nil, fail("tiers", "only valid for chain")
+    }
+    if b.SweepInterval > 0 {
+        switch b.Type {
+        case "memory", "lru", "bolt", "leveldb", "s3":
+            p.dsn = withSweep(p.dsn, b)
+        default:
+            return nil, fail("sweep_interval", "not supported by %s", b.Type)
+        }
+    }
+    return p, nil
+}
+
+// withSweep 把后台过期清理的配置追加到 dsn 的参数中
+func withSweep(dsn string, b *BucketConfig) string {
+    if b.SweepInterval == 0 {
+        return dsn
+    }
+    q := url.Values{"sweep": {time.Duration(b.SweepInterval).String()}}
+    if b.SweepBudget > 0 {
+        q.Set("sweep_budget", strconv.Itoa(b.SweepBudget))
+    }
+    if strings.Contains(dsn, "?") {
+        return dsn + "&" + q.Encode()
+    }
+    return dsn + "?" + q.Encode()
+}
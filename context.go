@@ -0,0 +1,115 @@
+package store
+
+import (
+    "context"
+    "io"
+    "time"
+)
+
+type (
+    contextStore struct {
+        Store
+    }
+)
+
+// WithContext 返回 s 的 ContextStore 版本.
+// s 本身实现了 ContextStore 时直接返回, 否则在每次调用前检查 ctx, 并在 Range/RRange 迭代中途响应取消
+func WithContext(s Store) ContextStore {
+    if cs, ok := s.(ContextStore); ok {
+        return cs
+    }
+    return contextStore{Store: s}
+}
+
+func (c contextStore) PutContext(ctx context.Context, key string, value []byte) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return c.Store.Put(key, value)
+}
+
+func (c contextStore) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return c.Store.PutTTL(key, value, ttl)
+}
+
+func (c contextStore) GetContext(ctx context.Context, key string) ([]byte, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return c.Store.Get(key)
+}
+
+func (c contextStore) TTLContext(ctx context.Context, key string) (time.Duration, error) {
+    if err := ctx.Err(); err != nil {
+        return 0, err
+    }
+    return c.Store.TTL(key)
+}
+
+func (c contextStore) RPutTTLContext(ctx context.Context, key string, r io.Reader, size int64, ttl time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return c.Store.RPutTTL(key, r, size, ttl)
+}
+
+func (c contextStore) RGetContext(ctx context.Context, key string) (io.Reader, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return c.Store.RGet(key)
+}
+
+func (c contextStore) ExistContext(ctx context.Context, key string) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    return c.Store.Exist(key)
+}
+
+func (c contextStore) DeleteContext(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return c.Store.Delete(key)
+}
+
+func (c contextStore) RangeKeysContext(ctx context.Context, prefix, limit string, max int) (KeysInfoSlice, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    return c.Store.RangeKeys(prefix, limit, max)
+}
+
+func (c contextStore) RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if err := c.Store.Range(prefix, limit, func(key string, value []byte) bool {
+        if ctx.Err() != nil {
+            return false
+        }
+        return cb(key, value)
+    }); err != nil {
+        return err
+    }
+    return ctx.Err()
+}
+
+func (c contextStore) RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if err := c.Store.RRange(prefix, limit, func(key string, r io.Reader) bool {
+        if ctx.Err() != nil {
+            return false
+        }
+        return cb(key, r)
+    }); err != nil {
+        return err
+    }
+    return ctx.Err()
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+    "context"
+    "math"
+    "strconv"
+    "time"
+)
+
+type (
+    // CounterStore 原子计数器. 计数器以十进制 ASCII 字符串存储 (如 "-42"), Get 可以直接读取,
+    // 也可以用 Put 写入十进制字符串初始化
+    CounterStore interface {
+        ContextStore
+        // IncrBy key 不存在时视为 0, 返回自增后的值
+        IncrBy(key string, delta int64) (int64, error)
+        // IncrByTTL ttl 只在 key 不存在而新建时生效, 已有的过期时间保持不变
+        IncrByTTL(key string, delta int64, ttl time.Duration) (int64, error)
+        IncrByTTLContext(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+    }
+)
+
+// Incr 自增 1
+func Incr(s Store, key string) (int64, error) {
+    return IncrBy(s, key, 1)
+}
+
+// Decr 自减 1
+func Decr(s Store, key string) (int64, error) {
+    return IncrBy(s, key, -1)
+}
+
+// IncrBy s 没有实现 CounterStore 时用条件写入重试, 都不支持时返回 ErrNotSupported
+func IncrBy(s Store, key string, delta int64) (int64, error) {
+    return IncrByTTLContext(context.Background(), s, key, delta, 0)
+}
+
+// IncrByTTLContext 同 IncrBy, ttl 只在 key 新建时生效
+func IncrByTTLContext(ctx context.Context, s Store, key string, delta int64, ttl time.Duration) (int64, error) {
+    if cs, ok := s.(CounterStore); ok {
+        return cs.IncrByTTLContext(ctx, key, delta, ttl)
+    }
+    if cs, ok := s.(CASStore); ok {
+        return IncrByCAS(ctx, cs, key, delta, ttl)
+    }
+    return 0, ErrNotSupported
+}
+
+// IncrByCAS 用 PutIfAbsent/CompareAndSwap 实现的计数器, 冲突时重试直到成功或 ctx 结束
+func IncrByCAS(ctx context.Context, cs CASStore, key string, delta int64, ttl time.Duration) (int64, error) {
+    for {
+        if err := ctx.Err(); err != nil {
+            return 0, err
+        }
+        old, err := cs.GetContext(ctx, key)
+        if IsNotFound(err) {
+            n := delta
+            ok, err := cs.PutIfAbsentContext(ctx, key, FormatCounter(n), ttl)
+            if err != nil {
+                return 0, err
+            }
+            if ok {
+                return n, nil
+            }
+            continue
+        }
+        if err != nil {
+            return 0, err
+        }
+        n, err := AddCounter(old, delta)
+        if err != nil {
+            return 0, err
+        }
+        ok, err := cs.CompareAndSwapContext(ctx, key, old, FormatCounter(n))
+        if err != nil {
+            return 0, err
+        }
+        if ok {
+            return n, nil
+        }
+    }
+}
+
+// ParseCounter 解析计数器的值
+func ParseCounter(value []byte) (int64, error) {
+    n, err := strconv.ParseInt(string(value), 10, 64)
+    if err != nil {
+        return 0, ErrNotInteger
+    }
+    return n, nil
+}
+
+// FormatCounter 计数器的存储格式
+func FormatCounter(n int64) []byte {
+    return strconv.AppendInt(nil, n, 10)
+}
+
+// AddCounter 解析计数器的值并加上 delta, 溢出时返回 ErrNotInteger
+func AddCounter(value []byte, delta int64) (int64, error) {
+    n, err := ParseCounter(value)
+    if err != nil {
+        return 0, err
+    }
+    if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+        return 0, ErrNotInteger
+    }
+    return n + delta, nil
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+    "errors"
+    "github.com/DGHeroin/store/utils"
+)
+
+type (
+    storeError struct {
+        msg    string
+        parent error
+    }
+)
+
+var (
+    // ErrNotFound key 不存在
+    ErrNotFound = errors.New("store: key not found")
+    // ErrExpired key 已过期, errors.Is(ErrExpired, ErrNotFound) 为 true
+    ErrExpired = &storeError{msg: "store: key expired", parent: ErrNotFound}
+    // ErrClosed 存储已关闭
+    ErrClosed = errors.New("store: closed")
+    // ErrNotSupported 后端不支持该操作
+    ErrNotSupported = errors.New("store: operation not supported")
+    // ErrTooLarge key 或 value 超出后端限制
+    ErrTooLarge = errors.New("store: key or value too large")
+    // ErrNotInteger 计数器的值不是十进制整数, 或自增后溢出
+    ErrNotInteger = errors.New("store: value is not an integer or out of range")
+    // ErrCorruptData 数据无法解析或校验失败, 不会被当作过期数据删除
+    ErrCorruptData = utils.ErrCorruptData
+    // ErrUnsupportedVersion 数据由更新的格式版本写入, 不会被当作过期数据删除
+    ErrUnsupportedVersion = utils.ErrUnsupportedVersion
+    // ErrReservedValue 开启删除标记的存储链不能写入与删除标记相同的 value
+    ErrReservedValue = errors.New("store: value is reserved by the chain store")
+    // ErrTierUnavailable 存储链的某层被熔断或该 key 在该层的数据不可信
+    ErrTierUnavailable = errors.New("store: tier unavailable")
+)
+
+func (e *storeError) Error() string {
+    return e.msg
+}
+
+func (e *storeError) Unwrap() error {
+    return e.parent
+}
+
+// IsNotFound key 不存在或已过期
+func IsNotFound(err error) bool {
+    return errors.Is(err, ErrNotFound)
+}
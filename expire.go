@@ -0,0 +1,59 @@
+package store
+
+import (
+    "context"
+    "time"
+)
+
+type (
+    // ExpireStore 可以只修改过期时间而不重写 value 的后端, key 不存在或已过期时返回 ErrNotFound
+    ExpireStore interface {
+        ContextStore
+        // Expire 设置 ttl 之后过期, ttl <= 0 时立即删除
+        Expire(key string, ttl time.Duration) error
+        ExpireContext(ctx context.Context, key string, ttl time.Duration) error
+        // ExpireAt 设置在 at 时过期, at 不晚于当前时间时立即删除; at 为零值时去掉过期时间, 与 Persist 相同
+        ExpireAt(key string, at time.Time) error
+        ExpireAtContext(ctx context.Context, key string, at time.Time) error
+        // Persist 去掉过期时间
+        Persist(key string) error
+        PersistContext(ctx context.Context, key string) error
+        // Touch 标记 key 被访问, 不读取也不修改 value 和过期时间, 用于刷新 LRU 等淘汰策略中的位置
+        Touch(key string) error
+        TouchContext(ctx context.Context, key string) error
+    }
+)
+
+// Expire s 不支持时返回 ErrNotSupported
+func Expire(s Store, key string, ttl time.Duration) error {
+    return ExpireAtContext(context.Background(), s, key, time.Now().Add(ttl))
+}
+
+// ExpireAt s 不支持时返回 ErrNotSupported; at 为零值时去掉过期时间
+func ExpireAt(s Store, key string, at time.Time) error {
+    return ExpireAtContext(context.Background(), s, key, at)
+}
+
+func ExpireAtContext(ctx context.Context, s Store, key string, at time.Time) error {
+    if es, ok := s.(ExpireStore); ok {
+        return es.ExpireAtContext(ctx, key, at)
+    }
+    return ErrNotSupported
+}
+
+// Persist s 不支持时返回 ErrNotSupported; 等同于 at 为零值的 ExpireAt
+func Persist(s Store, key string) error {
+    return ExpireAtContext(context.Background(), s, key, time.Time{})
+}
+
+// Touch s 不支持时返回 ErrNotSupported
+func Touch(s Store, key string) error {
+    return TouchContext(context.Background(), s, key)
+}
+
+func TouchContext(ctx context.Context, s Store, key string) error {
+    if es, ok := s.(ExpireStore); ok {
+        return es.TouchContext(ctx, key)
+    }
+    return ErrNotSupported
+}
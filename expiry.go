@@ -0,0 +1,35 @@
+package store
+
+import (
+    "context"
+    "time"
+)
+
+type (
+    // ExpiringKey 过期索引中的一项
+    ExpiringKey struct {
+        Key      string
+        ExpireAt time.Time
+    }
+    // ExpiryIndexStore 维护过期索引的后端, 过期清理和按过期时间查询只访问索引中相关的项
+    ExpiryIndexStore interface {
+        Store
+        // Expiring 按过期时间升序返回在 before 之前过期的 key, 包括已过期但尚未清理的, 最多 max 个
+        Expiring(before time.Time, max int) ([]ExpiringKey, error)
+        ExpiringContext(ctx context.Context, before time.Time, max int) ([]ExpiringKey, error)
+    }
+)
+
+// Expiring 在 before 之前过期的 key, 例如 Expiring(s, time.Now().Add(10*time.Minute), 100);
+// 后端没有过期索引时返回 ErrNotSupported
+func Expiring(s Store, before time.Time, max int) ([]ExpiringKey, error) {
+    return ExpiringContext(context.Background(), s, before, max)
+}
+
+func ExpiringContext(ctx context.Context, s Store, before time.Time, max int) ([]ExpiringKey, error) {
+    es, ok := s.(ExpiryIndexStore)
+    if !ok {
+        return nil, ErrNotSupported
+    }
+    return es.ExpiringContext(ctx, before, max)
+}
@@ -0,0 +1,24 @@
+package store
+
+import (
+    "context"
+)
+
+type (
+    // FormatMigrator 可以把旧格式 (4 字节秒级过期时间) 的数据原地改写为当前格式的后端,
+    // 两种格式都可以直接读取, 改写只是为了使用毫秒精度和 2106 年之后的过期时间
+    FormatMigrator interface {
+        Store
+        // MigrateFormat 改写所有旧格式的数据, 返回改写的数量; 可以在使用中执行, 中断后重新执行即可
+        MigrateFormat(ctx context.Context) (int, error)
+    }
+)
+
+// MigrateFormat 后端不支持时返回 ErrNotSupported
+func MigrateFormat(ctx context.Context, s Store) (int, error) {
+    m, ok := s.(FormatMigrator)
+    if !ok {
+        return 0, ErrNotSupported
+    }
+    return m.MigrateFormat(ctx)
+}
@@ -8,4 +8,5 @@ require (
 	github.com/minio/minio-go/v7 v7.0.27
 	github.com/syndtr/goleveldb v1.0.0
 	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
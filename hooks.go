@@ -0,0 +1,111 @@
+package store
+
+import (
+    "sync"
+)
+
+type (
+    // HookEvent key 被移除的原因
+    HookEvent int
+    // HookStore 可以在 key 被移除时回调的后端, 同一事件可以注册多个回调;
+    // 回调在移除生效后同步调用, 调用时不持有后端的锁, 可以在回调中访问 Store
+    HookStore interface {
+        Store
+        // OnExpire key 因过期被删除, 由过期清理或读取时发现过期触发
+        OnExpire(fn func(key string))
+        // OnDelete key 被 Delete 等写入操作删除, 只对删除前存在的 key 触发
+        OnDelete(fn func(key string))
+        // OnEvict key 因容量限制被淘汰
+        OnEvict(fn func(key string))
+    }
+    // Hooks 后端持有的回调列表, 零值可用
+    Hooks struct {
+        mu  sync.RWMutex
+        fns [hookEvents][]func(key string)
+    }
+)
+
+const (
+    HookExpire HookEvent = iota
+    HookDelete
+    HookEvict
+    hookEvents
+)
+
+func (e HookEvent) String() string {
+    switch e {
+    case HookExpire:
+        return "expire"
+    case HookDelete:
+        return "delete"
+    case HookEvict:
+        return "evict"
+    }
+    return "unknown"
+}
+
+// OnExpire s 不支持时返回 ErrNotSupported
+func OnExpire(s Store, fn func(key string)) error {
+    return addHook(s, HookExpire, fn)
+}
+
+// OnDelete s 不支持时返回 ErrNotSupported
+func OnDelete(s Store, fn func(key string)) error {
+    return addHook(s, HookDelete, fn)
+}
+
+// OnEvict s 不支持时返回 ErrNotSupported
+func OnEvict(s Store, fn func(key string)) error {
+    return addHook(s, HookEvict, fn)
+}
+
+func addHook(s Store, e HookEvent, fn func(key string)) error {
+    hs, ok := s.(HookStore)
+    if !ok {
+        return ErrNotSupported
+    }
+    switch e {
+    case HookExpire:
+        hs.OnExpire(fn)
+    case HookDelete:
+        hs.OnDelete(fn)
+    case HookEvict:
+        hs.OnEvict(fn)
+    }
+    return nil
+}
+
+// Add 注册 e 的回调
+func (h *Hooks) Add(e HookEvent, fn func(key string)) {
+    if fn == nil || e < 0 || e >= hookEvents {
+        return
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.fns[e] = append(h.fns[e], fn)
+}
+
+// Has e 是否注册了回调, 后端可以据此跳过只为回调而做的额外查询
+func (h *Hooks) Has(e HookEvent) bool {
+    if e < 0 || e >= hookEvents {
+        return false
+    }
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    return len(h.fns[e]) > 0
+}
+
+// Fire 对每个 key 依次调用 e 的回调, 后端应在释放锁之后调用
+func (h *Hooks) Fire(e HookEvent, keys ...string) {
+    if len(keys) == 0 || e < 0 || e >= hookEvents {
+        return
+    }
+    h.mu.RLock()
+    fns := h.fns[e]
+    h.mu.RUnlock()
+    for _, key := range keys {
+        for _, fn := range fns {
+            fn(key)
+        }
+    }
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+    "context"
+    "sync"
+)
+
+type (
+    // Invalidation 一次需要失效的 key, Origin 标识发送的存储链, 用于忽略自己发出的消息
+    Invalidation struct {
+        Origin string   `json:"origin"`
+        Keys   []string `json:"keys"`
+    }
+    // InvalidationBus 在进程之间广播失效的 key, 可以有多个订阅者
+    InvalidationBus interface {
+        // Publish 发送给所有订阅者, 包括发送方自己的订阅
+        Publish(ctx context.Context, msg Invalidation) error
+        // Subscribe 注册回调, fn 在总线的 goroutine 中依次调用; 返回的 cancel 取消订阅并等待进行中的回调结束
+        Subscribe(fn func(msg Invalidation)) (cancel func(), err error)
+    }
+    // InvalidationOptions 存储链跨进程失效配置
+    InvalidationOptions struct {
+        // Bus 广播使用的总线, 各进程的存储链需要连接到同一个总线
+        Bus InvalidationBus
+        // OnError 广播或订阅失败时的回调, keys 为订阅失败时为 nil; 广播失败不影响写入结果
+        OnError func(keys []string, err error)
+    }
+    // MemoryBus 进程内的 InvalidationBus, Publish 同步调用所有订阅者, 用于测试和同一进程内的多个存储链
+    MemoryBus struct {
+        mu   sync.RWMutex
+        seq  int
+        subs map[int]func(msg Invalidation)
+    }
+)
+
+func NewMemoryBus() *MemoryBus {
+    return &MemoryBus{subs: map[int]func(msg Invalidation){}}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, msg Invalidation) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    b.mu.RLock()
+    fns := make([]func(msg Invalidation), 0, len(b.subs))
+    for _, fn := range b.subs {
+        fns = append(fns, fn)
+    }
+    b.mu.RUnlock()
+    for _, fn := range fns {
+        fn(Invalidation{Origin: msg.Origin, Keys: append([]string(nil), msg.Keys...)})
+    }
+    return nil
+}
+
+func (b *MemoryBus) Subscribe(fn func(msg Invalidation)) (func(), error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.seq++
+    id := b.seq
+    b.subs[id] = fn
+    return func() {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        delete(b.subs, id)
+    }, nil
+}
+
+var _ InvalidationBus = &MemoryBus{}
@@ -0,0 +1,274 @@
+package ServerHTTP
+
+import (
+    "bytes"
+    "context"
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/store"
+    "hash"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    // TTLHeader PUT 时指定过期时间, GET/HEAD 时返回剩余时间; 值为 Go duration 如 "90s", 或整数秒
+    TTLHeader = "X-Store-TTL"
+    // DefaultMax 列出 key 时 max 参数的默认值
+    DefaultMax = 1000
+)
+
+type (
+    // Handler 通过 HTTP 提供 bucket 的读写:
+    //   GET/HEAD /{bucket}/{key}          读取, 支持 Range 和 If-None-Match
+    //   PUT /{bucket}/{key}               写入, 需要 Content-Length, 可选 X-Store-TTL
+    //   DELETE /{bucket}/{key}            删除
+    //   GET /{bucket}?prefix=&limit=&max= 列出 key, 返回 JSON
+    // key 可以包含 "/"
+    Handler struct {
+        lookup func(bucket string) store.Store
+    }
+    keyInfo struct {
+        Key  string `json:"key"`
+        Size int64  `json:"size"`
+    }
+    // byteser bytes.Buffer 等可以直接取出内容的 Reader, 不需要复制
+    byteser interface {
+        Bytes() []byte
+    }
+)
+
+// New lookup 根据名称查找 bucket, 为 nil 时使用 store.Get 查找已注册的 bucket
+func New(lookup func(bucket string) store.Store) *Handler {
+    if lookup == nil {
+        lookup = store.Get
+    }
+    return &Handler{lookup: lookup}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    bucket, key := splitPath(r.URL.Path)
+    if bucket == "" {
+        http.NotFound(w, r)
+        return
+    }
+    s := h.lookup(bucket)
+    if s == nil {
+        http.Error(w, "bucket not found", http.StatusNotFound)
+        return
+    }
+    cs := store.WithContext(s)
+    if key == "" {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead:
+            h.list(w, r, cs)
+        default:
+            w.Header().Set("Allow", "GET, HEAD")
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+        return
+    }
+    switch r.Method {
+    case http.MethodGet, http.MethodHead:
+        h.get(w, r, cs, key)
+    case http.MethodPut:
+        h.put(w, r, cs, key)
+    case http.MethodDelete:
+        h.delete(w, r, cs, key)
+    default:
+        w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// splitPath "/bucket/a/b" 拆分为 "bucket" 和 "a/b"
+func splitPath(p string) (bucket, key string) {
+    p = strings.TrimPrefix(p, "/")
+    if i := strings.IndexByte(p, '/'); i >= 0 {
+        return p[:i], p[i+1:]
+    }
+    return p, ""
+}
+
+// writeError 把 store 的错误转换为状态码
+func writeError(w http.ResponseWriter, err error) {
+    code := http.StatusInternalServerError
+    switch {
+    case store.IsNotFound(err):
+        code = http.StatusNotFound
+    case errors.Is(err, store.ErrClosed):
+        code = http.StatusServiceUnavailable
+    case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+        code = http.StatusServiceUnavailable
+    }
+    http.Error(w, err.Error(), code)
+}
+
+// ParseTTL 解析 X-Store-TTL, 空值表示不过期
+func ParseTTL(v string) (time.Duration, error) {
+    if v == "" {
+        return 0, nil
+    }
+    if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+        return time.Duration(n) * time.Second, nil
+    }
+    ttl, err := time.ParseDuration(v)
+    if err != nil || ttl < 0 {
+        return 0, fmt.Errorf("invalid %s %q", TTLHeader, v)
+    }
+    return ttl, nil
+}
+
+func etag(h hash.Hash) string {
+    return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// get 计算 ETag 需要读完整个值: 可以 Seek 的 Reader 读两次, 其他的先写入临时文件
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, s store.ContextStore, key string) {
+    ctx := r.Context()
+    ttl, err := s.TTLContext(ctx, key)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    reader, err := s.RGetContext(ctx, key)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    if c, ok := reader.(io.Closer); ok {
+        defer c.Close()
+    }
+    content, cleanup, err := seekable(reader)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    defer cleanup()
+    sum := md5.New()
+    if _, err = io.Copy(sum, content); err == nil {
+        _, err = content.Seek(0, io.SeekStart)
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    header := w.Header()
+    header.Set("ETag", etag(sum))
+    header.Set("Content-Type", "application/octet-stream")
+    if ttl > 0 {
+        header.Set(TTLHeader, ttl.Truncate(time.Millisecond).String())
+    }
+    http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+func seekable(r io.Reader) (io.ReadSeeker, func(), error) {
+    switch v := r.(type) {
+    case byteser:
+        return bytes.NewReader(v.Bytes()), func() {}, nil
+    case io.ReadSeeker:
+        return v, func() {}, nil
+    }
+    f, err := ioutil.TempFile("", "store-http-")
+    if err != nil {
+        return nil, nil, err
+    }
+    cleanup := func() {
+        _ = f.Close()
+        _ = os.Remove(f.Name())
+    }
+    if _, err = io.Copy(f, r); err == nil {
+        _, err = f.Seek(0, io.SeekStart)
+    }
+    if err != nil {
+        cleanup()
+        return nil, nil, err
+    }
+    return f, cleanup, nil
+}
+
+// put 以 Content-Length 作为 RPutTTL 的 size, 成功返回 204 和新值的 ETag
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, s store.ContextStore, key string) {
+    if r.ContentLength < 0 {
+        http.Error(w, "Content-Length required", http.StatusLengthRequired)
+        return
+    }
+    ttl, err := ParseTTL(r.Header.Get(TTLHeader))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    sum := md5.New()
+    body := io.TeeReader(r.Body, sum)
+    if err = s.RPutTTLContext(r.Context(), key, body, r.ContentLength, ttl); err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Header().Set("ETag", etag(sum))
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// delete key 不存在时返回 404
+func (h *Handler) delete(w http.ResponseWriter, r *http.Request, s store.ContextStore, key string) {
+    ctx := r.Context()
+    ok, err := s.ExistContext(ctx, key)
+    if err == nil && !ok {
+        err = store.ErrNotFound
+    }
+    if err == nil {
+        err = s.DeleteContext(ctx, key)
+    }
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// list 参数同 RangeKeys, 只返回以 prefix 开头的 key
+func (h *Handler) list(w http.ResponseWriter, r *http.Request, s store.ContextStore) {
+    q := r.URL.Query()
+    prefix, limit := q.Get("prefix"), q.Get("limit")
+    max := DefaultMax
+    if v := q.Get("max"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n <= 0 {
+            http.Error(w, fmt.Sprintf("invalid max %q", v), http.StatusBadRequest)
+            return
+        }
+        max = n
+    }
+    infos, err := s.RangeKeysContext(r.Context(), prefix, limit, max)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    result := make([]keyInfo, 0, len(infos))
+    for _, info := range infos {
+        if !strings.HasPrefix(info.Key, prefix) {
+            break
+        }
+        result = append(result, keyInfo{Key: info.Key, Size: info.Size})
+    }
+    data, err := json.Marshal(result)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+    if r.Method == http.MethodHead {
+        return
+    }
+    _, _ = w.Write(data)
+}
+
+var _ http.Handler = &Handler{}
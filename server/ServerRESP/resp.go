@@ -0,0 +1,574 @@
+package ServerRESP
+
+import (
+    "errors"
+    "github.com/DGHeroin/redcon"
+    "github.com/DGHeroin/redcon/match"
+    "github.com/DGHeroin/store"
+    "math"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+type (
+    // Server 用 Redis 协议提供一个 store.Store, 支持的命令见 commands; 只有 db 0
+    Server struct {
+        s       store.Store
+        mu      sync.Mutex
+        srv     *redcon.Server
+        conns   map[redcon.Conn]struct{}
+        closing bool
+        wg      sync.WaitGroup
+    }
+    // command arity 为参数个数 (包括命令名), 负数表示至少 -arity 个
+    command struct {
+        arity int
+        fn    func(srv *Server, conn redcon.Conn, args [][]byte)
+    }
+)
+
+var (
+    commands map[string]command
+
+    errSyntax     = errors.New("ERR syntax error")
+    errNotInteger = errors.New("ERR value is not an integer or out of range")
+)
+
+func init() {
+    commands = map[string]command{
+        "ping":    {-1, (*Server).ping},
+        "quit":    {1, (*Server).quit},
+        "select":  {2, (*Server).selectDB},
+        "command": {-1, (*Server).command},
+        "get":     {2, (*Server).get},
+        "set":     {-3, (*Server).set},
+        "setnx":   {3, (*Server).setnx},
+        "del":     {-2, (*Server).del},
+        "exists":  {-2, (*Server).exists},
+        "ttl":     {2, (*Server).ttl},
+        "pttl":    {2, (*Server).ttl},
+        "expire":  {3, (*Server).expire},
+        "pexpire": {3, (*Server).expire},
+        "persist": {2, (*Server).persist},
+        "scan":    {-2, (*Server).scan},
+        "keys":    {2, (*Server).keys},
+        "mget":    {-2, (*Server).mget},
+        "mset":    {-3, (*Server).mset},
+        "incr":    {2, (*Server).incr},
+        "decr":    {2, (*Server).incr},
+        "incrby":  {3, (*Server).incr},
+        "decrby":  {3, (*Server).incr},
+    }
+}
+
+// New s 的生命周期由调用方管理, Close 不会关闭 s
+func New(s store.Store) *Server {
+    return &Server{s: s, conns: map[redcon.Conn]struct{}{}}
+}
+
+// ListenAndServe 监听 addr 并处理连接, 直到 Close
+func (srv *Server) ListenAndServe(addr string) error {
+    return srv.ListenServeAndSignal(addr, nil)
+}
+
+// ListenServeAndSignal 监听成功或失败后向 signal 发送结果, signal 可以为 nil
+func (srv *Server) ListenServeAndSignal(addr string, signal chan error) error {
+    srv.mu.Lock()
+    if srv.srv != nil {
+        srv.mu.Unlock()
+        return errors.New("resp: already serving")
+    }
+    srv.srv = redcon.NewServer(addr, srv.ServeRESP, srv.accept, srv.closed)
+    rs := srv.srv
+    srv.mu.Unlock()
+    return rs.ListenServeAndSignal(signal)
+}
+
+// Addr 监听的地址, 在 ListenServeAndSignal 发送结果之后可用
+func (srv *Server) Addr() net.Addr {
+    srv.mu.Lock()
+    defer srv.mu.Unlock()
+    if srv.srv == nil {
+        return nil
+    }
+    return srv.srv.Addr()
+}
+
+func (srv *Server) accept(conn redcon.Conn) bool {
+    srv.mu.Lock()
+    defer srv.mu.Unlock()
+    if srv.closing {
+        return false
+    }
+    srv.conns[conn] = struct{}{}
+    srv.wg.Add(1)
+    return true
+}
+
+func (srv *Server) closed(conn redcon.Conn, _ error) {
+    srv.mu.Lock()
+    defer srv.mu.Unlock()
+    if _, ok := srv.conns[conn]; ok {
+        delete(srv.conns, conn)
+        srv.wg.Done()
+    }
+}
+
+// Close 停止监听并关闭所有连接; 先关闭底层连接并等待处理结束,
+// 避免 redcon 在连接仍在写入时关闭连接
+func (srv *Server) Close() error {
+    srv.mu.Lock()
+    if srv.srv == nil || srv.closing {
+        srv.mu.Unlock()
+        return nil
+    }
+    srv.closing = true
+    rs := srv.srv
+    for conn := range srv.conns {
+        _ = conn.NetConn().Close()
+    }
+    srv.mu.Unlock()
+    srv.wg.Wait()
+    return rs.Close()
+}
+
+// ServeRESP 处理一条命令, 也可以作为 handler 挂到其他 redcon.Server 上
+func (srv *Server) ServeRESP(conn redcon.Conn, cmd redcon.Command) {
+    name := strings.ToLower(string(cmd.Args[0]))
+    c, ok := commands[name]
+    if !ok {
+        conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+        return
+    }
+    if (c.arity > 0 && len(cmd.Args) != c.arity) || (c.arity < 0 && len(cmd.Args) < -c.arity) {
+        conn.WriteError("ERR wrong number of arguments for '" + name + "' command")
+        return
+    }
+    c.fn(srv, conn, cmd.Args)
+}
+
+// writeError 把 store 的错误转换为 Redis 风格的错误
+func writeError(conn redcon.Conn, err error) {
+    switch {
+    case err == errSyntax || err == errNotInteger:
+        conn.WriteError(err.Error())
+    case errors.Is(err, store.ErrNotInteger):
+        conn.WriteError(errNotInteger.Error())
+    case errors.Is(err, store.ErrNotSupported):
+        conn.WriteError("ERR not supported by this store")
+    default:
+        conn.WriteError("ERR " + err.Error())
+    }
+}
+
+func parseInt(b []byte) (int64, error) {
+    n, err := strconv.ParseInt(string(b), 10, 64)
+    if err != nil {
+        return 0, errNotInteger
+    }
+    return n, nil
+}
+
+func (srv *Server) ping(conn redcon.Conn, args [][]byte) {
+    switch len(args) {
+    case 1:
+        conn.WriteString("PONG")
+    case 2:
+        conn.WriteBulk(args[1])
+    default:
+        conn.WriteError("ERR wrong number of arguments for 'ping' command")
+    }
+}
+
+func (srv *Server) quit(conn redcon.Conn, _ [][]byte) {
+    conn.WriteString("OK")
+    _ = conn.Close()
+}
+
+func (srv *Server) selectDB(conn redcon.Conn, args [][]byte) {
+    if string(args[1]) != "0" {
+        conn.WriteError("ERR DB index is out of range")
+        return
+    }
+    conn.WriteString("OK")
+}
+
+// command redis-cli 连接时会查询命令表, 返回空表即可
+func (srv *Server) command(conn redcon.Conn, _ [][]byte) {
+    conn.WriteArray(0)
+}
+
+func (srv *Server) get(conn redcon.Conn, args [][]byte) {
+    value, err := srv.s.Get(string(args[1]))
+    switch {
+    case err == nil:
+        conn.WriteBulk(value)
+    case store.IsNotFound(err):
+        conn.WriteNull()
+    default:
+        writeError(conn, err)
+    }
+}
+
+// set SET key value [EX seconds|PX milliseconds] [NX|XX]; 后端不支持事务时 XX 不是原子的
+func (srv *Server) set(conn redcon.Conn, args [][]byte) {
+    key, value := string(args[1]), args[2]
+    var (
+        ttl    time.Duration
+        nx, xx bool
+    )
+    for i := 3; i < len(args); i++ {
+        switch opt := strings.ToLower(string(args[i])); opt {
+        case "nx":
+            nx = true
+        case "xx":
+            xx = true
+        case "ex", "px":
+            if ttl != 0 || i+1 >= len(args) {
+                writeError(conn, errSyntax)
+                return
+            }
+            i++
+            n, err := parseInt(args[i])
+            if err != nil {
+                writeError(conn, err)
+                return
+            }
+            unit := time.Second
+            if opt == "px" {
+                unit = time.Millisecond
+            }
+            if n <= 0 || n > math.MaxInt64/int64(unit) {
+                conn.WriteError("ERR invalid expire time in 'set' command")
+                return
+            }
+            ttl = time.Duration(n) * unit
+        default:
+            writeError(conn, errSyntax)
+            return
+        }
+    }
+    if nx && xx {
+        writeError(conn, errSyntax)
+        return
+    }
+    ok, err := true, error(nil)
+    switch {
+    case nx:
+        ok, err = store.PutIfAbsent(srv.s, key, value, ttl)
+    case xx:
+        ok, err = srv.putIfExists(key, value, ttl)
+    default:
+        err = srv.s.PutTTL(key, value, ttl)
+    }
+    switch {
+    case err != nil:
+        writeError(conn, err)
+    case !ok:
+        conn.WriteNull()
+    default:
+        conn.WriteString("OK")
+    }
+}
+
+// setnx 旧命令, go-redis 的 SetNX 在没有过期时间时使用
+func (srv *Server) setnx(conn redcon.Conn, args [][]byte) {
+    ok, err := store.PutIfAbsent(srv.s, string(args[1]), args[2], 0)
+    if err != nil {
+        writeError(conn, err)
+        return
+    }
+    if ok {
+        conn.WriteInt(1)
+    } else {
+        conn.WriteInt(0)
+    }
+}
+
+// putIfExists 支持事务时在事务中检查并写入, 否则先检查再写入
+func (srv *Server) putIfExists(key string, value []byte, ttl time.Duration) (bool, error) {
+    ok := false
+    err := store.Update(srv.s, func(tx store.Txn) error {
+        if _, err := tx.Get(key); err != nil {
+            if store.IsNotFound(err) {
+                return nil
+            }
+            return err
+        }
+        ok = true
+        return tx.PutTTL(key, value, ttl)
+    })
+    if err != store.ErrNotSupported {
+        return ok, err
+    }
+    if ok, err = srv.s.Exist(key); err != nil || !ok {
+        return false, err
+    }
+    return true, srv.s.PutTTL(key, value, ttl)
+}
+
+func keysOf(args [][]byte) []string {
+    keys := make([]string, len(args))
+    for i, arg := range args {
+        keys[i] = string(arg)
+    }
+    return keys
+}
+
+// del 返回删除前存在的 key 数量, 检查和删除不是原子的
+func (srv *Server) del(conn redcon.Conn, args [][]byte) {
+    keys := keysOf(args[1:])
+    found, err := store.MExist(srv.s, keys...)
+    if err != nil {
+        writeError(conn, err)
+        return
+    }
+    if err := store.MDelete(srv.s, keys...); err != nil {
+        writeError(conn, err)
+        return
+    }
+    n := 0
+    for _, ok := range found {
+        if ok {
+            n++
+        }
+    }
+    conn.WriteInt(n)
+}
+
+// exists 重复的 key 重复计数
+func (srv *Server) exists(conn redcon.Conn, args [][]byte) {
+    keys := keysOf(args[1:])
+    found, err := store.MExist(srv.s, keys...)
+    if err != nil {
+        writeError(conn, err)
+        return
+    }
+    n := 0
+    for _, key := range keys {
+        if found[key] {
+            n++
+        }
+    }
+    conn.WriteInt(n)
+}
+
+// ttl TTL/PTTL: 不存在返回 -2, 没有过期时间返回 -1
+func (srv *Server) ttl(conn redcon.Conn, args [][]byte) {
+    ttl, err := srv.s.TTL(string(args[1]))
+    switch {
+    case store.IsNotFound(err):
+        conn.WriteInt(-2)
+    case err != nil:
+        writeError(conn, err)
+    case ttl <= 0:
+        conn.WriteInt(-1)
+    case strings.EqualFold(string(args[0]), "pttl"):
+        conn.WriteInt64(int64((ttl + time.Millisecond/2) / time.Millisecond))
+    default:
+        conn.WriteInt64(int64((ttl + time.Second/2) / time.Second))
+    }
+}
+
+// expire EXPIRE/PEXPIRE: 设置成功返回 1, key 不存在返回 0
+func (srv *Server) expire(conn redcon.Conn, args [][]byte) {
+    n, err := parseInt(args[2])
+    if err != nil {
+        writeError(conn, err)
+        return
+    }
+    unit := time.Second
+    if strings.EqualFold(string(args[0]), "pexpire") {
+        unit = time.Millisecond
+    }
+    if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+        conn.WriteError("ERR invalid expire time in '" + strings.ToLower(string(args[0])) + "' command")
+        return
+    }
+    err = store.Expire(srv.s, string(args[1]), time.Duration(n)*unit)
+    writeChanged(conn, err)
+}
+
+func (srv *Server) persist(conn redcon.Conn, args [][]byte) {
+    key := string(args[1])
+    ttl, err := srv.s.TTL(key)
+    if err == nil && ttl <= 0 {
+        // 没有过期时间
+        conn.WriteInt(0)
+        return
+    }
+    if err == nil {
+        err = store.Persist(srv.s, key)
+    }
+    writeChanged(conn, err)
+}
+
+func writeChanged(conn redcon.Conn, err error) {
+    switch {
+    case err == nil:
+        conn.WriteInt(1)
+    case store.IsNotFound(err):
+        conn.WriteInt(0)
+    default:
+        writeError(conn, err)
+    }
+}
+
+// patternPrefix 模式中第一个通配符之前的部分, 用于缩小 RangeKeys 的范围;
+// match 只支持 * 和 ?, 不支持 [...] 和转义
+func patternPrefix(pattern string) string {
+    if i := strings.IndexAny(pattern, "*?"); i >= 0 {
+        return pattern[:i]
+    }
+    return pattern
+}
+
+// scan SCAN cursor [MATCH pattern] [COUNT count]; cursor 是按 key 排序后的偏移量,
+// 扫描期间的写入可能导致 key 被跳过或重复
+func (srv *Server) scan(conn redcon.Conn, args [][]byte) {
+    cursor, err := strconv.ParseUint(string(args[1]), 10, 31)
+    if err != nil {
+        conn.WriteError("ERR invalid cursor")
+        return
+    }
+    pattern, count := "*", int64(10)
+    for i := 2; i < len(args); i++ {
+        if i+1 >= len(args) {
+            writeError(conn, errSyntax)
+            return
+        }
+        switch strings.ToLower(string(args[i])) {
+        case "match":
+            pattern = string(args[i+1])
+        case "count":
+            if count, err = parseInt(args[i+1]); err != nil || count < 1 {
+                writeError(conn, errSyntax)
+                return
+            }
+        default:
+            writeError(conn, errSyntax)
+            return
+        }
+        i++
+    }
+    // cursor + count 作为 RangeKeys 的 max, 不能溢出
+    if count > math.MaxInt32-int64(cursor) {
+        writeError(conn, errNotInteger)
+        return
+    }
+    prefix := patternPrefix(pattern)
+    end := int(cursor) + int(count)
+    infos, err := srv.s.RangeKeys(prefix, "", end)
+    if err != nil {
+        writeError(conn, err)
+        return
+    }
+    next := uint64(0)
+    if len(infos) >= end {
+        next = uint64(end)
+        infos = infos[:end]
+    }
+    var keys []string
+    for i := int(cursor); i < len(infos); i++ {
+        key := infos[i].Key
+        if !strings.HasPrefix(key, prefix) {
+            next = 0
+            break
+        }
+        if match.Match(key, pattern) {
+            keys = append(keys, key)
+        }
+    }
+    conn.WriteArray(2)
+    conn.WriteBulkString(strconv.FormatUint(next, 10))
+    conn.WriteArray(len(keys))
+    for _, key := range keys {
+        conn.WriteBulkString(key)
+    }
+}
+
+func (srv *Server) keys(conn redcon.Conn, args [][]byte) {
+    pattern := string(args[1])
+    prefix := patternPrefix(pattern)
+    infos, err := srv.s.RangeKeys(prefix, "", math.MaxInt32)
+    if err != nil {
+        writeError(conn, err)
+        return
+    }
+    var keys []string
+    for _, info := range infos {
+        if !strings.HasPrefix(info.Key, prefix) {
+            break
+        }
+        if match.Match(info.Key, pattern) {
+            keys = append(keys, info.Key)
+        }
+    }
+    conn.WriteArray(len(keys))
+    for _, key := range keys {
+        conn.WriteBulkString(key)
+    }
+}
+
+func (srv *Server) mget(conn redcon.Conn, args [][]byte) {
+    keys := keysOf(args[1:])
+    values, err := store.MGet(srv.s, keys...)
+    if err != nil {
+        writeError(conn, err)
+        return
+    }
+    conn.WriteArray(len(keys))
+    for _, key := range keys {
+        if value, ok := values[key]; ok {
+            conn.WriteBulk(value)
+        } else {
+            conn.WriteNull()
+        }
+    }
+}
+
+func (srv *Server) mset(conn redcon.Conn, args [][]byte) {
+    if len(args)%2 != 1 {
+        conn.WriteError("ERR wrong number of arguments for 'mset' command")
+        return
+    }
+    kvs := make(map[string][]byte, len(args)/2)
+    for i := 1; i < len(args); i += 2 {
+        kvs[string(args[i])] = args[i+1]
+    }
+    if err := store.MPut(srv.s, kvs); err != nil {
+        writeError(conn, err)
+        return
+    }
+    conn.WriteString("OK")
+}
+
+// incr INCR/DECR/INCRBY/DECRBY
+func (srv *Server) incr(conn redcon.Conn, args [][]byte) {
+    name := strings.ToLower(string(args[0]))
+    delta := int64(1)
+    if len(args) == 3 {
+        n, err := parseInt(args[2])
+        if err != nil {
+            writeError(conn, err)
+            return
+        }
+        delta = n
+    }
+    if strings.HasPrefix(name, "decr") {
+        if delta == math.MinInt64 {
+            writeError(conn, errNotInteger)
+            return
+        }
+        delta = -delta
+    }
+    n, err := store.IncrBy(srv.s, string(args[1]), delta)
+    if err != nil {
+        writeError(conn, err)
+        return
+    }
+    conn.WriteInt64(n)
+}
@@ -0,0 +1,433 @@
+package store
+
+import (
+    "bytes"
+    "context"
+    "github.com/DGHeroin/store/utils"
+    "io"
+    "io/ioutil"
+    "sync"
+    "time"
+)
+
+type (
+    // Singleflight 合并对同一个 key 的并发 Get/RGet/Exist, 同一时刻只有一次后端调用, 结果共享给所有调用者.
+    // 批量操作, 条件写入, 计数器, 过期时间和事务转发给被包装的 Store, 不支持时返回 ErrNotSupported
+    Singleflight struct {
+        ContextStore
+        g *flightGroup
+    }
+    // SingleflightStats 单个 key 的读取合并统计
+    SingleflightStats struct {
+        // Calls 读取次数
+        Calls uint64
+        // Collapsed 合并到其他调用上, 没有访问后端的次数
+        Collapsed uint64
+    }
+    flightGroup struct {
+        mu       sync.Mutex
+        calls    map[string]*flightCall
+        stats    map[string]*SingleflightStats
+        maxStats int
+    }
+    // flightTxn 记录事务中写入的 key, 提交后丢弃这些 key 正在进行的读取
+    flightTxn struct {
+        Txn
+        keys []string
+    }
+    flightCall struct {
+        key     string
+        done    chan struct{}
+        cancel  context.CancelFunc
+        waiters int
+        val     interface{}
+        err     error
+    }
+)
+
+// DefaultSingleflightStatsKeys 统计的最大 key 数量, 超出后新的 key 不再单独统计
+const DefaultSingleflightStatsKeys = 4096
+
+func newFlightGroup() *flightGroup {
+    return &flightGroup{
+        calls:    map[string]*flightCall{},
+        stats:    map[string]*SingleflightStats{},
+        maxStats: DefaultSingleflightStatsKeys,
+    }
+}
+
+// do 执行 fn, 同一个 callKey 正在执行时等待其结果.
+// fn 使用独立的 ctx, 只有所有等待者都放弃时才会被取消
+func (g *flightGroup) do(ctx context.Context, callKey, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+    g.mu.Lock()
+    st, ok := g.stats[key]
+    if !ok && len(g.stats) < g.maxStats {
+        st = &SingleflightStats{}
+        g.stats[key] = st
+    }
+    if st != nil {
+        st.Calls++
+    }
+    if call, ok := g.calls[callKey]; ok {
+        call.waiters++
+        if st != nil {
+            st.Collapsed++
+        }
+        g.mu.Unlock()
+        return g.wait(ctx, call)
+    }
+    callCtx, cancel := context.WithCancel(context.Background())
+    call := &flightCall{
+        key:     callKey,
+        done:    make(chan struct{}),
+        cancel:  cancel,
+        waiters: 1,
+    }
+    g.calls[callKey] = call
+    g.mu.Unlock()
+
+    go func() {
+        call.val, call.err = fn(callCtx)
+        g.mu.Lock()
+        if g.calls[callKey] == call {
+            delete(g.calls, callKey)
+        }
+        g.mu.Unlock()
+        cancel()
+        close(call.done)
+    }()
+    return g.wait(ctx, call)
+}
+
+func (g *flightGroup) wait(ctx context.Context, call *flightCall) (interface{}, error) {
+    select {
+    case <-call.done:
+        return call.val, call.err
+    case <-ctx.Done():
+        g.mu.Lock()
+        call.waiters--
+        if call.waiters == 0 {
+            if g.calls[call.key] == call {
+                delete(g.calls, call.key)
+            }
+            call.cancel()
+        }
+        g.mu.Unlock()
+        return nil, ctx.Err()
+    }
+}
+
+func (g *flightGroup) snapshot() map[string]SingleflightStats {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    result := make(map[string]SingleflightStats, len(g.stats))
+    for key, st := range g.stats {
+        result[key] = *st
+    }
+    return result
+}
+
+// forget 丢弃 keys 正在进行的读取, 写入返回之后的读取不会合并到写入之前开始的调用上
+func (g *flightGroup) forget(keys ...string) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    for _, key := range keys {
+        delete(g.calls, "get:"+key)
+        delete(g.calls, "rget:"+key)
+        delete(g.calls, "exist:"+key)
+    }
+}
+
+func (g *flightGroup) reset() {
+    g.mu.Lock()
+    g.stats = map[string]*SingleflightStats{}
+    g.mu.Unlock()
+}
+
+func (g *flightGroup) get(ctx context.Context, key string, fn func(ctx context.Context, key string) ([]byte, error)) ([]byte, error) {
+    v, err := g.do(ctx, "get:"+key, key, func(ctx context.Context) (interface{}, error) {
+        return fn(ctx, key)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return utils.CopyBytes(v.([]byte)), nil
+}
+
+// rget 共享的流式读取会被完整读入内存
+func (g *flightGroup) rget(ctx context.Context, key string, fn func(ctx context.Context, key string) (io.Reader, error)) (io.Reader, error) {
+    v, err := g.do(ctx, "rget:"+key, key, func(ctx context.Context) (interface{}, error) {
+        r, err := fn(ctx, key)
+        if err != nil {
+            return nil, err
+        }
+        data, err := ioutil.ReadAll(r)
+        if closer, ok := r.(io.Closer); ok {
+            _ = closer.Close()
+        }
+        return data, err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return bytes.NewReader(v.([]byte)), nil
+}
+
+func (g *flightGroup) exist(ctx context.Context, key string, fn func(ctx context.Context, key string) (bool, error)) (bool, error) {
+    v, err := g.do(ctx, "exist:"+key, key, func(ctx context.Context) (interface{}, error) {
+        return fn(ctx, key)
+    })
+    if err != nil {
+        return false, err
+    }
+    return v.(bool), nil
+}
+
+// NewSingleflight 包装任意 Store, 合并对同一个 key 的并发读取
+func NewSingleflight(s Store) *Singleflight {
+    return &Singleflight{
+        ContextStore: WithContext(s),
+        g:            newFlightGroup(),
+    }
+}
+
+func (s *Singleflight) Get(key string) ([]byte, error) {
+    return s.GetContext(context.Background(), key)
+}
+
+func (s *Singleflight) GetContext(ctx context.Context, key string) ([]byte, error) {
+    return s.g.get(ctx, key, s.ContextStore.GetContext)
+}
+
+func (s *Singleflight) RGet(key string) (io.Reader, error) {
+    return s.RGetContext(context.Background(), key)
+}
+
+func (s *Singleflight) RGetContext(ctx context.Context, key string) (io.Reader, error) {
+    return s.g.rget(ctx, key, s.ContextStore.RGetContext)
+}
+
+func (s *Singleflight) Exist(key string) (bool, error) {
+    return s.ExistContext(context.Background(), key)
+}
+
+func (s *Singleflight) ExistContext(ctx context.Context, key string) (bool, error) {
+    return s.g.exist(ctx, key, s.ContextStore.ExistContext)
+}
+
+func (s *Singleflight) Put(key string, value []byte) error {
+    return s.PutContext(context.Background(), key, value)
+}
+
+func (s *Singleflight) PutContext(ctx context.Context, key string, value []byte) error {
+    defer s.g.forget(key)
+    return s.ContextStore.PutContext(ctx, key, value)
+}
+
+func (s *Singleflight) PutTTL(key string, value []byte, ttl time.Duration) error {
+    return s.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+func (s *Singleflight) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    defer s.g.forget(key)
+    return s.ContextStore.PutTTLContext(ctx, key, value, ttl)
+}
+
+func (s *Singleflight) RPut(key string, r io.Reader, size int64) error {
+    return s.RPutTTL(key, r, size, 0)
+}
+
+func (s *Singleflight) RPutTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+    return s.RPutTTLContext(context.Background(), key, r, size, ttl)
+}
+
+func (s *Singleflight) RPutTTLContext(ctx context.Context, key string, r io.Reader, size int64, ttl time.Duration) error {
+    defer s.g.forget(key)
+    return s.ContextStore.RPutTTLContext(ctx, key, r, size, ttl)
+}
+
+func (s *Singleflight) Delete(key string) error {
+    return s.DeleteContext(context.Background(), key)
+}
+
+func (s *Singleflight) DeleteContext(ctx context.Context, key string) error {
+    defer s.g.forget(key)
+    return s.ContextStore.DeleteContext(ctx, key)
+}
+
+func (s *Singleflight) MGet(keys ...string) (map[string][]byte, error) {
+    return s.MGetContext(context.Background(), keys...)
+}
+
+func (s *Singleflight) MGetContext(ctx context.Context, keys ...string) (map[string][]byte, error) {
+    return WithBatch(s.ContextStore).MGetContext(ctx, keys...)
+}
+
+func (s *Singleflight) MPut(kvs map[string][]byte) error {
+    return s.MPutTTLContext(context.Background(), kvs, 0)
+}
+
+func (s *Singleflight) MPutTTL(kvs map[string][]byte, ttl time.Duration) error {
+    return s.MPutTTLContext(context.Background(), kvs, ttl)
+}
+
+func (s *Singleflight) MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+    keys := make([]string, 0, len(kvs))
+    for key := range kvs {
+        keys = append(keys, key)
+    }
+    defer s.g.forget(keys...)
+    return WithBatch(s.ContextStore).MPutTTLContext(ctx, kvs, ttl)
+}
+
+func (s *Singleflight) MDelete(keys ...string) error {
+    return s.MDeleteContext(context.Background(), keys...)
+}
+
+func (s *Singleflight) MDeleteContext(ctx context.Context, keys ...string) error {
+    defer s.g.forget(keys...)
+    return WithBatch(s.ContextStore).MDeleteContext(ctx, keys...)
+}
+
+func (s *Singleflight) MExist(keys ...string) (map[string]bool, error) {
+    return s.MExistContext(context.Background(), keys...)
+}
+
+func (s *Singleflight) MExistContext(ctx context.Context, keys ...string) (map[string]bool, error) {
+    return WithBatch(s.ContextStore).MExistContext(ctx, keys...)
+}
+
+func (s *Singleflight) CompareAndSwap(key string, old, new []byte) (bool, error) {
+    return s.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+func (s *Singleflight) CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (bool, error) {
+    cs, ok := s.ContextStore.(CASStore)
+    if !ok {
+        return false, ErrNotSupported
+    }
+    defer s.g.forget(key)
+    return cs.CompareAndSwapContext(ctx, key, old, new)
+}
+
+func (s *Singleflight) PutIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+    return s.PutIfAbsentContext(context.Background(), key, value, ttl)
+}
+
+func (s *Singleflight) PutIfAbsentContext(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    cs, ok := s.ContextStore.(CASStore)
+    if !ok {
+        return false, ErrNotSupported
+    }
+    defer s.g.forget(key)
+    return cs.PutIfAbsentContext(ctx, key, value, ttl)
+}
+
+func (s *Singleflight) DeleteIf(key string, expected []byte) (bool, error) {
+    return s.DeleteIfContext(context.Background(), key, expected)
+}
+
+func (s *Singleflight) DeleteIfContext(ctx context.Context, key string, expected []byte) (bool, error) {
+    cs, ok := s.ContextStore.(CASStore)
+    if !ok {
+        return false, ErrNotSupported
+    }
+    defer s.g.forget(key)
+    return cs.DeleteIfContext(ctx, key, expected)
+}
+
+func (s *Singleflight) IncrBy(key string, delta int64) (int64, error) {
+    return s.IncrByTTLContext(context.Background(), key, delta, 0)
+}
+
+func (s *Singleflight) IncrByTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+    return s.IncrByTTLContext(context.Background(), key, delta, ttl)
+}
+
+// IncrByTTLContext 被包装的 Store 没有实现 CounterStore 时用条件写入重试
+func (s *Singleflight) IncrByTTLContext(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+    defer s.g.forget(key)
+    return IncrByTTLContext(ctx, s.ContextStore, key, delta, ttl)
+}
+
+func (s *Singleflight) Expire(key string, ttl time.Duration) error {
+    return s.ExpireContext(context.Background(), key, ttl)
+}
+
+func (s *Singleflight) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+    return s.ExpireAtContext(ctx, key, time.Now().Add(ttl))
+}
+
+func (s *Singleflight) ExpireAt(key string, at time.Time) error {
+    return s.ExpireAtContext(context.Background(), key, at)
+}
+
+func (s *Singleflight) ExpireAtContext(ctx context.Context, key string, at time.Time) error {
+    defer s.g.forget(key)
+    return ExpireAtContext(ctx, s.ContextStore, key, at)
+}
+
+func (s *Singleflight) Persist(key string) error {
+    return s.PersistContext(context.Background(), key)
+}
+
+func (s *Singleflight) PersistContext(ctx context.Context, key string) error {
+    return s.ExpireAtContext(ctx, key, time.Time{})
+}
+
+func (s *Singleflight) Touch(key string) error {
+    return s.TouchContext(context.Background(), key)
+}
+
+func (s *Singleflight) TouchContext(ctx context.Context, key string) error {
+    return TouchContext(ctx, s.ContextStore, key)
+}
+
+func (s *Singleflight) Update(fn func(tx Txn) error) error {
+    return s.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext 事务结束后丢弃事务中写入的 key 正在进行的读取
+func (s *Singleflight) UpdateContext(ctx context.Context, fn func(tx Txn) error) error {
+    var written []string
+    defer func() {
+        s.g.forget(written...)
+    }()
+    return UpdateContext(ctx, s.ContextStore, func(tx Txn) error {
+        ftx := &flightTxn{Txn: tx}
+        err := fn(ftx)
+        written = ftx.keys
+        return err
+    })
+}
+
+func (t *flightTxn) Put(key string, value []byte) error {
+    t.keys = append(t.keys, key)
+    return t.Txn.Put(key, value)
+}
+
+func (t *flightTxn) PutTTL(key string, value []byte, ttl time.Duration) error {
+    t.keys = append(t.keys, key)
+    return t.Txn.PutTTL(key, value, ttl)
+}
+
+func (t *flightTxn) Delete(key string) error {
+    t.keys = append(t.keys, key)
+    return t.Txn.Delete(key)
+}
+
+// Stats 各 key 的读取合并统计
+func (s *Singleflight) Stats() map[string]SingleflightStats {
+    return s.g.snapshot()
+}
+
+// ResetStats 清空统计
+func (s *Singleflight) ResetStats() {
+    s.g.reset()
+}
+
+var _ BatchStore = &Singleflight{}
+var _ CASStore = &Singleflight{}
+var _ CounterStore = &Singleflight{}
+var _ ExpireStore = &Singleflight{}
+var _ TxnStore = &Singleflight{}
@@ -1,7 +1,10 @@
 package store
 
 import (
+    "context"
     "io"
+    "sort"
+    "sync"
     "time"
 )
 
@@ -25,6 +28,25 @@ type (
         Range(prefix, limit string, cb func(key string, value []byte) bool) error
         RRange(prefix, limit string, cb func(key string, r io.Reader) bool) error
     }
+    // ContextStore Store 的 context 版本, 所有操作均可被 ctx 取消
+    ContextStore interface {
+        Store
+        PutContext(ctx context.Context, key string, value []byte) error
+        PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error
+        GetContext(ctx context.Context, key string) ([]byte, error)
+
+        TTLContext(ctx context.Context, key string) (time.Duration, error)
+
+        RPutTTLContext(ctx context.Context, key string, r io.Reader, size int64, ttl time.Duration) error
+        RGetContext(ctx context.Context, key string) (io.Reader, error)
+
+        ExistContext(ctx context.Context, key string) (bool, error)
+        DeleteContext(ctx context.Context, key string) error
+
+        RangeKeysContext(ctx context.Context, prefix, limit string, max int) (KeysInfoSlice, error)
+        RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error
+        RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error
+    }
     KeysInfo struct {
         Key  string
         Size int64
@@ -33,20 +55,48 @@ type (
 )
 
 var (
-    buckets = map[string]Store{}
+    bucketsMu sync.RWMutex
+    buckets   = map[string]Store{}
 )
 
 func Get(bucket string) Store {
+    bucketsMu.RLock()
+    defer bucketsMu.RUnlock()
     return buckets[bucket]
 }
 
 func InitStore(bucket string, store Store) {
+    bucketsMu.Lock()
+    defer bucketsMu.Unlock()
     buckets[bucket] = store
 }
 
+// OpenBucket 根据 DSN 创建 Store 并注册为 bucket, 已有同名 bucket 时会被替换但不会关闭
+func OpenBucket(bucket, dsn string) (Store, error) {
+    s, err := Open(dsn)
+    if err != nil {
+        return nil, err
+    }
+    InitStore(bucket, s)
+    return s, nil
+}
+
+// Buckets 已注册的 bucket 名称
+func Buckets() []string {
+    bucketsMu.RLock()
+    defer bucketsMu.RUnlock()
+    result := make([]string, 0, len(buckets))
+    for name := range buckets {
+        result = append(result, name)
+    }
+    sort.Strings(result)
+    return result
+}
+
 var (
     _ = Get
     _ = InitStore
+    _ = OpenBucket
 )
 
 func (s KeysInfoSlice) ToKeys() (result []string) {
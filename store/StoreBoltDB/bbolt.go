@@ -2,49 +2,100 @@ package StoreBoltDB
 
 import (
     "bytes"
+    "context"
     "github.com/DGHeroin/store"
     "github.com/DGHeroin/store/utils"
     bolt "go.etcd.io/bbolt"
     "io"
     "io/ioutil"
+    "net/url"
     "os"
     "strings"
+    "sync"
     "time"
 )
 
 type (
     boltImpl struct {
         bucketName []byte
+        indexName  []byte
+        metaName   []byte
         db         *bolt.DB
+        sweeper    *store.SweeperSlot
+        hooks      *store.Hooks
+        watch      *store.Watchers
+        // wmu 保证提交顺序与发布顺序一致
+        wmu *sync.Mutex
+    }
+    // boltTxn 读写事务中的数据 bucket, 所有写入都经过它以便在同一个事务中维护过期索引;
+    // events 不为 nil 时记录写入和删除, 提交后发布并触发回调
+    boltTxn struct {
+        tx     *bolt.Tx
+        b      *bolt.Bucket
+        index  []byte
+        events *[]store.Event
     }
 )
 
 func (b boltImpl) Close() error {
-    return b.db.Close()
+    b.sweeper.Stop()
+    b.watch.Close()
+    return wrapError(b.db.Close())
+}
+
+func wrapError(err error) error {
+    switch err {
+    case bolt.ErrDatabaseNotOpen:
+        return store.ErrClosed
+    case bolt.ErrKeyTooLarge, bolt.ErrValueTooLarge:
+        return store.ErrTooLarge
+    }
+    return err
+}
+
+func (b boltImpl) TTL(key string) (time.Duration, error) {
+    return b.TTLContext(context.Background(), key)
 }
 
-func (b boltImpl) TTL(key string) (r time.Duration, err error) {
+func (b boltImpl) TTLContext(ctx context.Context, key string) (r time.Duration, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
     err = b.db.View(func(tx *bolt.Tx) error {
         bucket := tx.Bucket(b.bucketName)
         if bucket == nil {
-            return nil
+            return store.ErrNotFound
         }
         p := bucket.Get([]byte(key))
         if p == nil {
-            return nil
+            return store.ErrNotFound
         }
-        ok, ttl, _ := utils.SplitData(p)
-        if !ok {
+        _, expired, err := utils.ReadData(p)
+        if err != nil {
+            return err
+        }
+        ttl := utils.ExpireAtMillis(p)
+        if expired {
+            return store.ErrExpired
+        }
+        if ttl == 0 {
             return nil
         }
-        durationSec := int64(ttl) - utils.GetTimeNow().Unix()
-        r = time.Duration(durationSec) * time.Second
+        if r = time.Unix(0, ttl*int64(time.Millisecond)).Sub(utils.GetTimeNow()); r <= 0 {
+            r = 0
+            return store.ErrExpired
+        }
         return nil
     })
+    err = wrapError(err)
     return
 }
 
-func (b boltImpl) RangeKeys(prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
+func (b boltImpl) RangeKeys(prefix, limit string, max int) (store.KeysInfoSlice, error) {
+    return b.RangeKeysContext(context.Background(), prefix, limit, max)
+}
+
+func (b boltImpl) RangeKeysContext(ctx context.Context, prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
     db := b.db
     err = db.View(func(tx *bolt.Tx) error {
         b := tx.Bucket(b.bucketName)
@@ -55,6 +106,9 @@ func (b boltImpl) RangeKeys(prefix, limit string, max int) (result store.KeysInf
         cur := b.Cursor()
 
         for k, v := cur.Seek(prefixBytes); k != nil; k, v = cur.Next() {
+            if err := ctx.Err(); err != nil {
+                return err
+            }
             key := string(k)
             if limit != "" && strings.HasPrefix(key, limit) {
                 return nil
@@ -73,12 +127,17 @@ func (b boltImpl) RangeKeys(prefix, limit string, max int) (result store.KeysInf
         }
         return nil
     })
+    err = wrapError(err)
     return
 }
 
 func (b boltImpl) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
+    return b.RangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (b boltImpl) RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error {
     db := b.db
-    return db.View(func(tx *bolt.Tx) error {
+    return wrapError(db.View(func(tx *bolt.Tx) error {
         b := tx.Bucket(b.bucketName)
         if b == nil {
             return nil
@@ -86,6 +145,9 @@ func (b boltImpl) Range(prefix, limit string, cb func(key string, value []byte)
         prefixBytes := []byte(prefix)
         cur := b.Cursor()
         for k, v := cur.Seek(prefixBytes); k != nil; k, v = cur.Next() {
+            if err := ctx.Err(); err != nil {
+                return err
+            }
             key := string(k)
             if limit != "" && strings.HasPrefix(key, limit) {
                 return nil
@@ -94,16 +156,21 @@ func (b boltImpl) Range(prefix, limit string, cb func(key string, value []byte)
             if !ok {
                 continue
             }
-            if !cb(key, value) {
+            // v 指向 mmap, 事务结束后可能被复用
+            if !cb(key, utils.CopyBytes(value)) {
                 return nil
             }
         }
         return nil
-    })
+    }))
 }
 
 func (b boltImpl) RRange(prefix, limit string, cb func(key string, r io.Reader) bool) error {
-    return b.Range(prefix, limit, func(key string, value []byte) bool {
+    return b.RRangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (b boltImpl) RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    return b.RangeContext(ctx, prefix, limit, func(key string, value []byte) bool {
         return cb(key, bytes.NewBuffer(value))
     })
 }
@@ -112,16 +179,24 @@ func (b boltImpl) RPut(key string, r io.Reader, size int64) error {
     return b.RPutTTL(key, r, size, 0)
 }
 
-func (b boltImpl) RPutTTL(key string, r io.Reader, _ int64, ttl time.Duration) error {
+func (b boltImpl) RPutTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+    return b.RPutTTLContext(context.Background(), key, r, size, ttl)
+}
+
+func (b boltImpl) RPutTTLContext(ctx context.Context, key string, r io.Reader, _ int64, ttl time.Duration) error {
     value, err := ioutil.ReadAll(r)
     if err != nil {
         return err
     }
-    return b.PutTTL(key, value, ttl)
+    return b.PutTTLContext(ctx, key, value, ttl)
 }
 
 func (b boltImpl) RGet(key string) (io.Reader, error) {
-    value, err := b.Get(key)
+    return b.RGetContext(context.Background(), key)
+}
+
+func (b boltImpl) RGetContext(ctx context.Context, key string) (io.Reader, error) {
+    value, err := b.GetContext(ctx, key)
     if err != nil {
         return nil, err
     }
@@ -129,46 +204,70 @@ func (b boltImpl) RGet(key string) (io.Reader, error) {
 }
 
 func (b boltImpl) Put(key string, value []byte) error {
-    return b.db.Update(func(tx *bolt.Tx) error {
-        b, err := tx.CreateBucketIfNotExists(b.bucketName)
-        if err != nil {
-            return err
-        }
-        return b.Put([]byte(key), utils.CombineData(0, value))
-    })
+    return b.PutContext(context.Background(), key, value)
+}
+
+func (b boltImpl) PutContext(ctx context.Context, key string, value []byte) error {
+    return b.PutTTLContext(ctx, key, value, 0)
 }
 
 func (b boltImpl) PutTTL(key string, value []byte, ttl time.Duration) error {
-    return b.db.Update(func(tx *bolt.Tx) error {
-        b, err := tx.CreateBucketIfNotExists(b.bucketName)
-        if err != nil {
-            return err
-        }
-        return b.Put([]byte(key), utils.CombineData(ttl, value))
-    })
+    return b.PutTTLContext(context.Background(), key, value, ttl)
 }
 
-func (b boltImpl) Get(key string) (result []byte, err error) {
+func (b boltImpl) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return wrapError(b.write(func(w boltTxn) error {
+        return w.put([]byte(key), utils.CombineData(ttl, value))
+    }))
+}
+
+func (b boltImpl) Get(key string) ([]byte, error) {
+    return b.GetContext(context.Background(), key)
+}
+
+func (b boltImpl) GetContext(ctx context.Context, key string) (result []byte, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
     err = b.db.View(func(tx *bolt.Tx) error {
         b := tx.Bucket(b.bucketName)
         if b == nil {
-            return nil
+            return store.ErrNotFound
         }
         data := b.Get([]byte(key))
-        ok, _, val := utils.SplitData(data)
-        if !ok {
-            go func() {
-                _ = b.Delete([]byte(key))
-            }()
-            return nil
+        if data == nil {
+            return store.ErrNotFound
+        }
+        val, expired, err := utils.ReadData(data)
+        if err != nil {
+            return err
+        }
+        if expired {
+            return store.ErrExpired
         }
         result = utils.CopyBytes(val)
         return nil
     })
+    if err == store.ErrExpired {
+        go func() {
+            _, _ = b.deleteExpired([][]byte{[]byte(key)}, nil)
+        }()
+    }
+    err = wrapError(err)
     return
 }
 
-func (b boltImpl) Exist(key string) (ok bool, err error) {
+func (b boltImpl) Exist(key string) (bool, error) {
+    return b.ExistContext(context.Background(), key)
+}
+
+func (b boltImpl) ExistContext(ctx context.Context, key string) (ok bool, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
     err = b.db.View(func(tx *bolt.Tx) error {
         b := tx.Bucket(b.bucketName)
         if b == nil {
@@ -178,23 +277,674 @@ func (b boltImpl) Exist(key string) (ok bool, err error) {
         ok, _, _ = utils.SplitData(data)
         return nil
     })
+    err = wrapError(err)
     return
 }
 
 func (b boltImpl) Delete(key string) error {
-    return b.db.Update(func(tx *bolt.Tx) error {
-        b, err := tx.CreateBucketIfNotExists(b.bucketName)
+    return b.DeleteContext(context.Background(), key)
+}
+
+func (b boltImpl) DeleteContext(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return wrapError(b.write(func(w boltTxn) error {
+        return w.delete([]byte(key))
+    }))
+}
+
+func (b boltImpl) MGet(keys ...string) (map[string][]byte, error) {
+    return b.MGetContext(context.Background(), keys...)
+}
+
+// MGetContext 在一个只读事务中读取所有 key, 过期的 key 在事务结束后异步删除
+func (b boltImpl) MGetContext(ctx context.Context, keys ...string) (map[string][]byte, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    var expired [][]byte
+    result := make(map[string][]byte, len(keys))
+    err := b.db.View(func(tx *bolt.Tx) error {
+        b := tx.Bucket(b.bucketName)
+        if b == nil {
+            return nil
+        }
+        for _, key := range keys {
+            data := b.Get([]byte(key))
+            if data == nil {
+                continue
+            }
+            val, isExpired, err := utils.ReadData(data)
+            if err != nil {
+                return err
+            }
+            if isExpired {
+                expired = append(expired, []byte(key))
+                continue
+            }
+            result[key] = utils.CopyBytes(val)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, wrapError(err)
+    }
+    if len(expired) > 0 {
+        // 在写事务中确认仍然过期再删除, 期间重新写入的 key 会保留
+        go func() {
+            _, _ = b.deleteExpired(expired, nil)
+        }()
+    }
+    return result, nil
+}
+
+func (b boltImpl) MPut(kvs map[string][]byte) error {
+    return b.MPutTTL(kvs, 0)
+}
+
+func (b boltImpl) MPutTTL(kvs map[string][]byte, ttl time.Duration) error {
+    return b.MPutTTLContext(context.Background(), kvs, ttl)
+}
+
+// MPutTTLContext 所有 key 在同一个事务中写入, 要么全部成功要么全部失败
+func (b boltImpl) MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return wrapError(b.write(func(w boltTxn) error {
+        for key, value := range kvs {
+            if err := w.put([]byte(key), utils.CombineData(ttl, value)); err != nil {
+                return err
+            }
+        }
+        return nil
+    }))
+}
+
+func (b boltImpl) MDelete(keys ...string) error {
+    return b.MDeleteContext(context.Background(), keys...)
+}
+
+func (b boltImpl) MDeleteContext(ctx context.Context, keys ...string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return wrapError(b.write(func(w boltTxn) error {
+        for _, key := range keys {
+            if err := w.delete([]byte(key)); err != nil {
+                return err
+            }
+        }
+        return nil
+    }))
+}
+
+func (b boltImpl) MExist(keys ...string) (map[string]bool, error) {
+    return b.MExistContext(context.Background(), keys...)
+}
+
+func (b boltImpl) MExistContext(ctx context.Context, keys ...string) (map[string]bool, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    result := make(map[string]bool, len(keys))
+    err := b.db.View(func(tx *bolt.Tx) error {
+        b := tx.Bucket(b.bucketName)
+        for _, key := range keys {
+            result[key] = false
+            if b == nil {
+                continue
+            }
+            if data := b.Get([]byte(key)); data != nil {
+                result[key], _, _ = utils.SplitData(data)
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, wrapError(err)
+    }
+    return result, nil
+}
+
+func (b boltImpl) CompareAndSwap(key string, old, new []byte) (bool, error) {
+    return b.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+func (b boltImpl) CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (bool, error) {
+    return b.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(utils.ValueOf(data), old) {
+            return nil, false
+        }
+        return utils.ReplaceValue(data, new), true
+    })
+}
+
+func (b boltImpl) PutIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+    return b.PutIfAbsentContext(context.Background(), key, value, ttl)
+}
+
+func (b boltImpl) PutIfAbsentContext(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    return b.update(ctx, key, func(_ []byte, ok bool) ([]byte, bool) {
+        if ok {
+            return nil, false
+        }
+        return utils.CombineData(ttl, value), true
+    })
+}
+
+func (b boltImpl) DeleteIf(key string, expected []byte) (bool, error) {
+    return b.DeleteIfContext(context.Background(), key, expected)
+}
+
+func (b boltImpl) DeleteIfContext(ctx context.Context, key string, expected []byte) (bool, error) {
+    return b.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(utils.ValueOf(data), expected) {
+            return nil, false
+        }
+        return nil, true
+    })
+}
+
+// update 在一个读写事务中读取 key 当前的数据 (ok 表示存在且未过期) 并决定是否修改, 新数据为 nil 表示删除
+func (b boltImpl) update(ctx context.Context, key string, fn func(data []byte, ok bool) ([]byte, bool)) (changed bool, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
+    err = b.write(func(w boltTxn) error {
+        data := w.b.Get([]byte(key))
+        ok := false
+        if data != nil {
+            _, expired, err := utils.ReadData(data)
+            if err != nil {
+                return err
+            }
+            ok = !expired
+        }
+        var next []byte
+        if next, changed = fn(data, ok); !changed {
+            return nil
+        }
+        if next == nil {
+            return w.delete([]byte(key))
+        }
+        return w.put([]byte(key), next)
+    })
+    if err != nil {
+        return false, wrapError(err)
+    }
+    return
+}
+
+func (b boltImpl) IncrBy(key string, delta int64) (int64, error) {
+    return b.IncrByTTL(key, delta, 0)
+}
+
+func (b boltImpl) IncrByTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+    return b.IncrByTTLContext(context.Background(), key, delta, ttl)
+}
+
+func (b boltImpl) IncrByTTLContext(ctx context.Context, key string, delta int64, ttl time.Duration) (n int64, err error) {
+    _, uerr := b.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok {
+            n = delta
+            return utils.CombineData(ttl, store.FormatCounter(n)), true
+        }
+        if n, err = store.AddCounter(utils.ValueOf(data), delta); err != nil {
+            return nil, false
+        }
+        return utils.ReplaceValue(data, store.FormatCounter(n)), true
+    })
+    if uerr != nil {
+        return 0, uerr
+    }
+    return
+}
+
+func (b boltImpl) Update(fn func(tx store.Txn) error) error {
+    return b.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext 整个回调在一个 bolt 读写事务中执行
+func (b boltImpl) UpdateContext(ctx context.Context, fn func(tx store.Txn) error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    return wrapError(b.write(func(w boltTxn) error {
+        if err := fn(w); err != nil {
+            return err
+        }
+        return ctx.Err()
+    }))
+}
+
+func (t boltTxn) Get(key string) ([]byte, error) {
+    data := t.b.Get([]byte(key))
+    if data == nil {
+        return nil, store.ErrNotFound
+    }
+    val, expired, err := utils.ReadData(data)
+    if err != nil {
+        return nil, err
+    }
+    if expired {
+        return nil, store.ErrExpired
+    }
+    return utils.CopyBytes(val), nil
+}
+
+func (t boltTxn) Put(key string, value []byte) error {
+    return t.PutTTL(key, value, 0)
+}
+
+func (t boltTxn) PutTTL(key string, value []byte, ttl time.Duration) error {
+    return wrapError(t.put([]byte(key), utils.CombineData(ttl, value)))
+}
+
+func (t boltTxn) Delete(key string) error {
+    return wrapError(t.delete([]byte(key)))
+}
+
+// writer 在读写事务中打开数据 bucket
+func (b boltImpl) writer(tx *bolt.Tx) (boltTxn, error) {
+    bucket, err := tx.CreateBucketIfNotExists(b.bucketName)
+    if err != nil {
+        return boltTxn{}, err
+    }
+    return boltTxn{tx: tx, b: bucket, index: b.indexName}, nil
+}
+
+// write 在读写事务中执行 fn, 提交成功后按顺序发布变更, 再对被删除的 key 触发 OnDelete 回调
+func (b boltImpl) write(fn func(w boltTxn) error) error {
+    var events []store.Event
+    b.wmu.Lock()
+    err := b.db.Update(func(tx *bolt.Tx) error {
+        events = events[:0]
+        w, err := b.writer(tx)
+        if err != nil {
+            return err
+        }
+        w.events = &events
+        return fn(w)
+    })
+    if err != nil {
+        b.wmu.Unlock()
+        return err
+    }
+    var deleted []string
+    for _, ev := range events {
+        b.watch.Publish(ev.Type, ev.Key, ev.Size)
+        if ev.Type == store.EventDelete {
+            deleted = append(deleted, ev.Key)
+        }
+    }
+    b.wmu.Unlock()
+    b.hooks.Fire(store.HookDelete, deleted...)
+    return nil
+}
+
+// put 写入数据, 同时用新的过期时间替换索引中旧的项
+func (t boltTxn) put(key, data []byte) error {
+    if err := t.unindex(key); err != nil {
+        return err
+    }
+    if at := utils.ExpireAtMillis(data); at > 0 {
+        index, err := t.tx.CreateBucketIfNotExists(t.index)
+        if err != nil {
+            return err
+        }
+        if err := index.Put(utils.ExpiryIndexKey(nil, at, key), []byte{}); err != nil {
+            return err
+        }
+    }
+    if err := t.b.Put(key, data); err != nil {
+        return err
+    }
+    if t.events != nil {
+        *t.events = append(*t.events, store.Event{Type: store.EventPut, Key: string(key), Size: int64(len(utils.ValueOf(data)))})
+    }
+    return nil
+}
+
+// delete 删除数据和它在索引中的项
+func (t boltTxn) delete(key []byte) error {
+    if t.b.Get(key) == nil {
+        return nil
+    }
+    if err := t.unindex(key); err != nil {
+        return err
+    }
+    if err := t.b.Delete(key); err != nil {
+        return err
+    }
+    if t.events != nil {
+        *t.events = append(*t.events, store.Event{Type: store.EventDelete, Key: string(key)})
+    }
+    return nil
+}
+
+func (t boltTxn) unindex(key []byte) error {
+    at := utils.ExpireAtMillis(t.b.Get(key))
+    if at == 0 {
+        return nil
+    }
+    if index := t.tx.Bucket(t.index); index != nil {
+        return index.Delete(utils.ExpiryIndexKey(nil, at, key))
+    }
+    return nil
+}
+
+func (t boltTxn) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
+    cur := t.b.Cursor()
+    for k, v := cur.Seek([]byte(prefix)); k != nil; k, v = cur.Next() {
+        key := string(k)
+        if limit != "" && strings.HasPrefix(key, limit) {
+            return nil
+        }
+        ok, _, value := utils.SplitData(v)
+        if !ok {
+            continue
+        }
+        if !cb(key, utils.CopyBytes(value)) {
+            return nil
+        }
+    }
+    return nil
+}
+
+// indexReady meta bucket 中的标记, 表示已经为建立索引之前写入的数据补建过索引
+var indexReady = []byte("index_ready")
+
+// ensureIndex 第一次使用索引时扫描全部数据补建索引, 之后的写入都会同步维护索引.
+// 旧版本把标记放在索引 bucket 中, 补建时一并删除
+func (b boltImpl) ensureIndex() error {
+    ready := false
+    err := b.db.View(func(tx *bolt.Tx) error {
+        if meta := tx.Bucket(b.metaName); meta != nil {
+            ready = meta.Get(indexReady) != nil
+        }
+        return nil
+    })
+    if err != nil || ready {
+        return wrapError(err)
+    }
+    return wrapError(b.db.Update(func(tx *bolt.Tx) error {
+        index, err := tx.CreateBucketIfNotExists(b.indexName)
+        if err != nil {
+            return err
+        }
+        if err = index.Delete([]byte("ready")); err != nil {
+            return err
+        }
+        meta, err := tx.CreateBucketIfNotExists(b.metaName)
+        if err != nil {
+            return err
+        }
+        if bucket := tx.Bucket(b.bucketName); bucket != nil {
+            err = bucket.ForEach(func(k, v []byte) error {
+                if at := utils.ExpireAtMillis(v); at > 0 {
+                    return index.Put(utils.ExpiryIndexKey(nil, at, k), []byte{})
+                }
+                return nil
+            })
+            if err != nil {
+                return err
+            }
+        }
+        return meta.Put(indexReady, []byte{})
+    }))
+}
+
+// scanIndex 按过期时间升序遍历 before (Unix 毫秒) 之前的索引项, 跳过无法解析的项
+func (b boltImpl) scanIndex(tx *bolt.Tx, before int64, cb func(at int64, key []byte) bool) {
+    index := tx.Bucket(b.indexName)
+    if index == nil {
+        return
+    }
+    c := index.Cursor()
+    for k, _ := c.First(); k != nil; k, _ = c.Next() {
+        at, key, ok := utils.ParseExpiryIndexKey(nil, k)
+        if !ok {
+            continue
+        }
+        if at >= before || !cb(at, key) {
+            return
+        }
+    }
+}
+
+func (b boltImpl) Expiring(before time.Time, max int) ([]store.ExpiringKey, error) {
+    return b.ExpiringContext(context.Background(), before, max)
+}
+
+// ExpiringContext 只读取过期索引
+func (b boltImpl) ExpiringContext(ctx context.Context, before time.Time, max int) (result []store.ExpiringKey, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
+    if err = b.ensureIndex(); err != nil {
+        return
+    }
+    err = b.db.View(func(tx *bolt.Tx) error {
+        b.scanIndex(tx, before.UnixNano()/int64(time.Millisecond), func(at int64, key []byte) bool {
+            result = append(result, store.ExpiringKey{
+                Key:      string(key),
+                ExpireAt: time.Unix(0, at*int64(time.Millisecond)),
+            })
+            return len(result) < max
+        })
+        return nil
+    })
+    err = wrapError(err)
+    return
+}
+
+// SweepExpired 从过期索引的开头删除最多 budget 个已过期的 key, 不需要 cursor, 总是返回空的 next
+func (b boltImpl) SweepExpired(ctx context.Context, _ string, budget int) (removed int, next string, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
+    if budget <= 0 {
+        budget = store.DefaultSweepBudget
+    }
+    if err = b.ensureIndex(); err != nil {
+        return
+    }
+    var (
+        keys [][]byte
+        ats  []int64
+    )
+    err = b.db.View(func(tx *bolt.Tx) error {
+        b.scanIndex(tx, utils.GetTimeNow().UnixNano()/int64(time.Millisecond), func(at int64, key []byte) bool {
+            keys = append(keys, utils.CopyBytes(key))
+            ats = append(ats, at)
+            return len(keys) < budget
+        })
+        return nil
+    })
+    if err != nil || len(keys) == 0 {
+        return 0, "", wrapError(err)
+    }
+    removed, err = b.deleteExpired(keys, ats)
+    return
+}
+
+// deleteExpired 在一个读写事务中删除仍然过期的 key, 期间被重新写入的 key 会保留;
+// ats 为这些 key 在索引中的过期时间, 与当前数据不一致的索引项是过时的, 一并删除
+func (b boltImpl) deleteExpired(keys [][]byte, ats []int64) (removed int, err error) {
+    var expired []string
+    b.wmu.Lock()
+    err = b.db.Update(func(tx *bolt.Tx) error {
+        expired = expired[:0]
+        w, err := b.writer(tx)
         if err != nil {
             return err
         }
-        return b.Delete([]byte(key))
+        for i, k := range keys {
+            v := w.b.Get(k)
+            if ats != nil && (v == nil || utils.ExpireAtMillis(v) != ats[i]) {
+                if index := tx.Bucket(b.indexName); index != nil {
+                    if err := index.Delete(utils.ExpiryIndexKey(nil, ats[i], k)); err != nil {
+                        return err
+                    }
+                }
+            }
+            if v == nil {
+                continue
+            }
+            if !utils.IsExpired(v) {
+                continue
+            }
+            if err := w.delete(k); err != nil {
+                return err
+            }
+            expired = append(expired, string(k))
+        }
+        return nil
     })
+    if err != nil {
+        b.wmu.Unlock()
+        return 0, wrapError(err)
+    }
+    for _, key := range expired {
+        b.watch.Publish(store.EventExpire, key, 0)
+    }
+    b.wmu.Unlock()
+    b.hooks.Fire(store.HookExpire, expired...)
+    return len(expired), nil
+}
+
+// migrateChunk MigrateFormat 每个读写事务处理的 key 数量
+const migrateChunk = 1000
+
+// MigrateFormat 分多个读写事务改写旧格式的数据, 过期时间不变, 过期索引不需要修改
+func (b boltImpl) MigrateFormat(ctx context.Context) (migrated int, err error) {
+    var from []byte
+    for {
+        if err = ctx.Err(); err != nil {
+            return
+        }
+        done := true
+        err = b.db.Update(func(tx *bolt.Tx) error {
+            bucket := tx.Bucket(b.bucketName)
+            if bucket == nil {
+                return nil
+            }
+            var keys, values [][]byte
+            c := bucket.Cursor()
+            n := 0
+            for k, v := c.Seek(from); k != nil; k, v = c.Next() {
+                if n == migrateChunk {
+                    from, done = utils.CopyBytes(k), false
+                    break
+                }
+                n++
+                if data, ok := utils.UpgradeData(v); ok {
+                    keys = append(keys, utils.CopyBytes(k))
+                    values = append(values, data)
+                }
+            }
+            for i, k := range keys {
+                if err := bucket.Put(k, values[i]); err != nil {
+                    return err
+                }
+            }
+            migrated += len(keys)
+            return nil
+        })
+        if err != nil || done {
+            err = wrapError(err)
+            return
+        }
+    }
+}
+
+func (b boltImpl) Expire(key string, ttl time.Duration) error {
+    return b.ExpireContext(context.Background(), key, ttl)
+}
+
+func (b boltImpl) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+    return b.ExpireAtContext(ctx, key, utils.GetTimeNow().Add(ttl))
+}
+
+func (b boltImpl) ExpireAt(key string, at time.Time) error {
+    return b.ExpireAtContext(context.Background(), key, at)
+}
+
+// ExpireAtContext 在一个读写事务中改写数据头, 同时更新过期索引
+func (b boltImpl) ExpireAtContext(ctx context.Context, key string, at time.Time) error {
+    changed, err := b.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok {
+            return nil, false
+        }
+        return utils.SetExpireAt(data, at), true
+    })
+    if err == nil && !changed {
+        err = store.ErrNotFound
+    }
+    return err
+}
+
+func (b boltImpl) Persist(key string) error {
+    return b.PersistContext(context.Background(), key)
+}
+
+func (b boltImpl) PersistContext(ctx context.Context, key string) error {
+    return b.ExpireAtContext(ctx, key, time.Time{})
+}
+
+func (b boltImpl) Touch(key string) error {
+    return b.TouchContext(context.Background(), key)
+}
+
+// TouchContext bolt 没有访问顺序, 只检查 key 是否存在
+func (b boltImpl) TouchContext(ctx context.Context, key string) error {
+    ok, err := b.ExistContext(ctx, key)
+    if err == nil && !ok {
+        err = store.ErrNotFound
+    }
+    return err
+}
+
+func (b boltImpl) OnExpire(fn func(key string)) {
+    b.hooks.Add(store.HookExpire, fn)
+}
+
+func (b boltImpl) OnDelete(fn func(key string)) {
+    b.hooks.Add(store.HookDelete, fn)
+}
+
+// OnEvict 没有容量限制, 不会触发
+func (b boltImpl) OnEvict(fn func(key string)) {
+    b.hooks.Add(store.HookEvict, fn)
+}
+
+// Watch 变更在事务提交后按提交顺序发布
+func (b boltImpl) Watch(ctx context.Context, prefix string) <-chan store.Event {
+    return b.watch.Watch(ctx, prefix)
+}
+
+// StartSweeper 启动后台过期清理, Close 时停止
+func (b boltImpl) StartSweeper(opts store.SweeperOptions) *store.Sweeper {
+    return b.sweeper.Start(b, opts)
 }
 
 func New(db *bolt.DB) store.Store {
+    return NewWithBucket(db, "default")
+}
+
+// NewWithBucket 使用指定的 bolt bucket 存储数据
+func NewWithBucket(db *bolt.DB, bucket string) store.Store {
     impl := &boltImpl{
-        bucketName: []byte("default"),
+        bucketName: []byte(bucket),
+        indexName:  []byte("\x00expire:" + bucket),
+        metaName:   []byte("\x00meta:" + bucket),
         db:         db,
+        sweeper:    &store.SweeperSlot{},
+        hooks:      &store.Hooks{},
+        watch:      &store.Watchers{},
+        wmu:        &sync.Mutex{},
     }
     return impl
 }
@@ -207,4 +957,29 @@ func FromEnv() store.Store {
     return New(db)
 }
 
+// init 注册 bolt:///path/to/x.db?bucket=users, bucket 默认为 default, 打开的库在 Close 时关闭
+func init() {
+    store.Register("bolt", func(u *url.URL) (store.Store, error) {
+        db, err := bolt.Open(u.Host+u.Path, os.ModePerm, bolt.DefaultOptions)
+        if err != nil {
+            return nil, err
+        }
+        bucket := u.Query().Get("bucket")
+        if bucket == "" {
+            bucket = "default"
+        }
+        return NewWithBucket(db, bucket), nil
+    })
+}
+
 var _ = FromEnv
+var _ store.BatchStore = &boltImpl{}
+var _ store.CASStore = &boltImpl{}
+var _ store.CounterStore = &boltImpl{}
+var _ store.TxnStore = &boltImpl{}
+var _ store.SweeperStore = &boltImpl{}
+var _ store.ExpiryIndexStore = &boltImpl{}
+var _ store.FormatMigrator = &boltImpl{}
+var _ store.ExpireStore = &boltImpl{}
+var _ store.HookStore = &boltImpl{}
+var _ store.WatchStore = &boltImpl{}
@@ -2,47 +2,108 @@ package StoreLeveldb
 
 import (
     "bytes"
+    "context"
+    "errors"
     "github.com/DGHeroin/store"
     "github.com/DGHeroin/store/utils"
     "github.com/syndtr/goleveldb/leveldb"
+    "github.com/syndtr/goleveldb/leveldb/opt"
     "github.com/syndtr/goleveldb/leveldb/util"
     "io"
     "io/ioutil"
+    "net/url"
     "os"
     "time"
 )
 
 type (
     leveldbImpl struct {
-        db *leveldb.DB
+        db      *leveldb.DB
+        locks   *utils.KeyLock
+        sweeper *store.SweeperSlot
+        hooks   *store.Hooks
+        watch   *store.Watchers
     }
+    // leveldbTxn events 记录事务中的写入和删除, 提交后发布并触发回调
+    leveldbTxn struct {
+        tr     *leveldb.Transaction
+        events *[]store.Event
+    }
+    // reader DB 和 Transaction 共有的读取方法
+    reader interface {
+        Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+    }
+)
+
+var (
+    // indexReserved 以它开头的 key 保留给过期索引, 以 0xff 开头排在普通 key 之后, 遍历时排除
+    indexReserved = []byte("\xff\xffexpire")
+    // indexPrefix 过期索引项的前缀, 后面是 8 字节的过期时间和原始 key
+    indexPrefix = []byte("\xff\xffexpire:")
+    // indexReady 表示已经为建立索引之前写入的数据补建过索引
+    indexReady = []byte("\xff\xffexpire!ready")
+
+    errReservedKey = errors.New("leveldb: keys starting with \\xff\\xffexpire are reserved")
 )
 
 func (l leveldbImpl) Close() error {
-    return l.db.Close()
+    l.sweeper.Stop()
+    l.watch.Close()
+    return wrapError(l.db.Close())
+}
+
+func wrapError(err error) error {
+    switch err {
+    case leveldb.ErrNotFound:
+        return store.ErrNotFound
+    case leveldb.ErrClosed:
+        return store.ErrClosed
+    }
+    return err
 }
 
 func (l leveldbImpl) TTL(key string) (time.Duration, error) {
+    return l.TTLContext(context.Background(), key)
+}
+
+func (l leveldbImpl) TTLContext(ctx context.Context, key string) (time.Duration, error) {
+    if err := ctx.Err(); err != nil {
+        return 0, err
+    }
     p, err := l.db.Get([]byte(key), nil)
+    if err != nil {
+        return 0, wrapError(err)
+    }
+    _, expired, err := utils.ReadData(p)
     if err != nil {
         return 0, err
     }
-    ok, ttl, _ := utils.SplitData(p)
-    if !ok {
-        return -1, nil
+    ttl := utils.ExpireAtMillis(p)
+    if expired {
+        return 0, store.ErrExpired
+    }
+    if ttl == 0 {
+        return 0, nil
+    }
+    left := time.Unix(0, ttl*int64(time.Millisecond)).Sub(utils.GetTimeNow())
+    if left <= 0 {
+        return 0, store.ErrExpired
     }
-    durationSec := int64(ttl) - utils.GetTimeNow().Unix()
-    return time.Duration(durationSec) * time.Second, nil
+    return left, nil
 }
 
-func (l leveldbImpl) RangeKeys(prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
+func (l leveldbImpl) RangeKeys(prefix, limit string, max int) (store.KeysInfoSlice, error) {
+    return l.RangeKeysContext(context.Background(), prefix, limit, max)
+}
+
+func (l leveldbImpl) RangeKeysContext(ctx context.Context, prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
     db := l.db
-    it := db.NewIterator(&util.Range{
-        Start: []byte(prefix),
-        Limit: []byte(limit),
-    }, nil)
+    it := db.NewIterator(dataRange(prefix, limit), nil)
     defer it.Release()
     for it.Next() {
+        if err = ctx.Err(); err != nil {
+            return
+        }
         ok, _, value := utils.SplitData(it.Value())
         if !ok {
             continue
@@ -55,17 +116,22 @@ func (l leveldbImpl) RangeKeys(prefix, limit string, max int) (result store.Keys
             break
         }
     }
+    err = wrapError(it.Error())
     return
 }
 
 func (l leveldbImpl) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
+    return l.RangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (l leveldbImpl) RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error {
     db := l.db
-    it := db.NewIterator(&util.Range{
-        Start: []byte(prefix),
-        Limit: []byte(limit),
-    }, nil)
+    it := db.NewIterator(dataRange(prefix, limit), nil)
     defer it.Release()
     for it.Next() {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
         ok, _, value := utils.SplitData(it.Value())
         if !ok {
             continue
@@ -74,11 +140,15 @@ func (l leveldbImpl) Range(prefix, limit string, cb func(key string, value []byt
             break
         }
     }
-    return nil
+    return wrapError(it.Error())
 }
 
 func (l leveldbImpl) RRange(prefix, limit string, cb func(key string, r io.Reader) bool) error {
-    return l.Range(prefix, limit, func(key string, value []byte) bool {
+    return l.RRangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (l leveldbImpl) RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    return l.RangeContext(ctx, prefix, limit, func(key string, value []byte) bool {
         return cb(key, bytes.NewBuffer(value))
     })
 }
@@ -87,16 +157,24 @@ func (l leveldbImpl) RPut(key string, r io.Reader, size int64) error {
     return l.RPutTTL(key, r, size, 0)
 }
 
-func (l leveldbImpl) RPutTTL(key string, r io.Reader, _ int64, ttl time.Duration) error {
+func (l leveldbImpl) RPutTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+    return l.RPutTTLContext(context.Background(), key, r, size, ttl)
+}
+
+func (l leveldbImpl) RPutTTLContext(ctx context.Context, key string, r io.Reader, _ int64, ttl time.Duration) error {
     value, err := ioutil.ReadAll(r)
     if err != nil {
         return err
     }
-    return l.PutTTL(key, value, ttl)
+    return l.PutTTLContext(ctx, key, value, ttl)
 }
 
 func (l leveldbImpl) RGet(key string) (io.Reader, error) {
-    value, err := l.Get(key)
+    return l.RGetContext(context.Background(), key)
+}
+
+func (l leveldbImpl) RGetContext(ctx context.Context, key string) (io.Reader, error) {
+    value, err := l.GetContext(ctx, key)
     if err != nil {
         return nil, err
     }
@@ -104,40 +182,737 @@ func (l leveldbImpl) RGet(key string) (io.Reader, error) {
 }
 
 func (l leveldbImpl) Put(key string, value []byte) error {
-    return l.db.Put([]byte(key), utils.CombineData(0, value), nil)
+    return l.PutContext(context.Background(), key, value)
+}
+
+func (l leveldbImpl) PutContext(ctx context.Context, key string, value []byte) error {
+    return l.PutTTLContext(ctx, key, value, 0)
 }
 
 func (l leveldbImpl) PutTTL(key string, value []byte, ttl time.Duration) error {
-    return l.db.Put([]byte(key), utils.CombineData(ttl, value), nil)
+    return l.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+func (l leveldbImpl) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    defer l.locks.Lock(key)()
+    batch := new(leveldb.Batch)
+    if err := putData(l.db, batch, []byte(key), utils.CombineData(ttl, value)); err != nil {
+        return wrapError(err)
+    }
+    if err := l.db.Write(batch, nil); err != nil {
+        return wrapError(err)
+    }
+    l.watch.Publish(store.EventPut, key, int64(len(value)))
+    return nil
 }
 
 func (l leveldbImpl) Get(key string) ([]byte, error) {
+    return l.GetContext(context.Background(), key)
+}
+
+func (l leveldbImpl) GetContext(ctx context.Context, key string) ([]byte, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
     value, err := l.db.Get([]byte(key), nil)
     if err != nil {
+        return nil, wrapError(err)
+    }
+    data, expired, err := utils.ReadData(value)
+    if err != nil {
+        return nil, err
+    }
+    if expired {
+        if _, err = l.deleteExpired([]string{key}, nil); err != nil {
+            return nil, err
+        }
+        return nil, store.ErrExpired
+    }
+    return utils.CopyBytes(data), nil
+}
+
+func (l leveldbImpl) Exist(key string) (bool, error) {
+    return l.ExistContext(context.Background(), key)
+}
+
+func (l leveldbImpl) ExistContext(ctx context.Context, key string) (bool, error) {
+    _, err := l.GetContext(ctx, key)
+    if store.IsNotFound(err) {
+        return false, nil
+    }
+    return err == nil, err
+}
+
+func (l leveldbImpl) Delete(key string) error {
+    return l.DeleteContext(context.Background(), key)
+}
+
+func (l leveldbImpl) DeleteContext(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    var deleted []string
+    defer func() { l.hooks.Fire(store.HookDelete, deleted...) }()
+    defer l.locks.Lock(key)()
+    batch := new(leveldb.Batch)
+    ok, err := deleteData(l.db, batch, []byte(key))
+    if err != nil {
+        return wrapError(err)
+    }
+    if err := l.db.Write(batch, nil); err != nil {
+        return wrapError(err)
+    }
+    if ok {
+        l.watch.Publish(store.EventDelete, key, 0)
+        deleted = append(deleted, key)
+    }
+    return nil
+}
+
+func (l leveldbImpl) MGet(keys ...string) (map[string][]byte, error) {
+    return l.MGetContext(context.Background(), keys...)
+}
+
+// MGetContext 在同一个快照上读取所有 key, 过期的 key 在读取后批量删除
+func (l leveldbImpl) MGetContext(ctx context.Context, keys ...string) (map[string][]byte, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    snap, err := l.db.GetSnapshot()
+    if err != nil {
+        return nil, wrapError(err)
+    }
+    defer snap.Release()
+    var expired []string
+    result := make(map[string][]byte, len(keys))
+    for _, key := range keys {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        value, err := snap.Get([]byte(key), nil)
         if err == leveldb.ErrNotFound {
-            return nil, nil
+            continue
+        }
+        if err != nil {
+            return nil, wrapError(err)
+        }
+        data, isExpired, err := utils.ReadData(value)
+        if err != nil {
+            return nil, err
+        }
+        if isExpired {
+            expired = append(expired, key)
+            continue
+        }
+        result[key] = utils.CopyBytes(data)
+    }
+    if len(expired) > 0 {
+        if _, err := l.deleteExpired(expired, nil); err != nil {
+            return nil, err
         }
+    }
+    return result, nil
+}
+
+func (l leveldbImpl) MPut(kvs map[string][]byte) error {
+    return l.MPutTTL(kvs, 0)
+}
+
+func (l leveldbImpl) MPutTTL(kvs map[string][]byte, ttl time.Duration) error {
+    return l.MPutTTLContext(context.Background(), kvs, ttl)
+}
+
+func (l leveldbImpl) MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    keys := make([]string, 0, len(kvs))
+    for key := range kvs {
+        keys = append(keys, key)
+    }
+    defer l.locks.Lock(keys...)()
+    batch := &leveldb.Batch{}
+    for key, value := range kvs {
+        if err := putData(l.db, batch, []byte(key), utils.CombineData(ttl, value)); err != nil {
+            return wrapError(err)
+        }
+    }
+    if err := l.db.Write(batch, nil); err != nil {
+        return wrapError(err)
+    }
+    for key, value := range kvs {
+        l.watch.Publish(store.EventPut, key, int64(len(value)))
+    }
+    return nil
+}
+
+func (l leveldbImpl) MDelete(keys ...string) error {
+    return l.MDeleteContext(context.Background(), keys...)
+}
+
+func (l leveldbImpl) MDeleteContext(ctx context.Context, keys ...string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    var deleted []string
+    defer func() { l.hooks.Fire(store.HookDelete, deleted...) }()
+    defer l.locks.Lock(keys...)()
+    batch := &leveldb.Batch{}
+    var existed []string
+    for _, key := range keys {
+        ok, err := deleteData(l.db, batch, []byte(key))
+        if err != nil {
+            return wrapError(err)
+        }
+        if ok {
+            existed = append(existed, key)
+        }
+    }
+    if err := l.db.Write(batch, nil); err != nil {
+        return wrapError(err)
+    }
+    for _, key := range existed {
+        l.watch.Publish(store.EventDelete, key, 0)
+    }
+    deleted = existed
+    return nil
+}
+
+func (l leveldbImpl) MExist(keys ...string) (map[string]bool, error) {
+    return l.MExistContext(context.Background(), keys...)
+}
+
+func (l leveldbImpl) MExistContext(ctx context.Context, keys ...string) (map[string]bool, error) {
+    found, err := l.MGetContext(ctx, keys...)
+    if err != nil {
         return nil, err
     }
-    if ok, _, data := utils.SplitData(value); ok {
-        return utils.CopyBytes(data), nil
+    result := make(map[string]bool, len(keys))
+    for _, key := range keys {
+        _, result[key] = found[key]
+    }
+    return result, nil
+}
+
+func (l leveldbImpl) CompareAndSwap(key string, old, new []byte) (bool, error) {
+    return l.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+func (l leveldbImpl) CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (bool, error) {
+    return l.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(utils.ValueOf(data), old) {
+            return nil, false
+        }
+        return utils.ReplaceValue(data, new), true
+    })
+}
+
+func (l leveldbImpl) PutIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+    return l.PutIfAbsentContext(context.Background(), key, value, ttl)
+}
+
+func (l leveldbImpl) PutIfAbsentContext(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    return l.update(ctx, key, func(_ []byte, ok bool) ([]byte, bool) {
+        if ok {
+            return nil, false
+        }
+        return utils.CombineData(ttl, value), true
+    })
+}
+
+func (l leveldbImpl) DeleteIf(key string, expected []byte) (bool, error) {
+    return l.DeleteIfContext(context.Background(), key, expected)
+}
+
+func (l leveldbImpl) DeleteIfContext(ctx context.Context, key string, expected []byte) (bool, error) {
+    return l.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(utils.ValueOf(data), expected) {
+            return nil, false
+        }
+        return nil, true
+    })
+}
+
+// update LevelDB 没有条件写入, 由进程内的 key 锁保证读改写的原子性, 所有写入都会持有该锁;
+// 多个进程打开同一个库时不保证原子性
+func (l leveldbImpl) update(ctx context.Context, key string, fn func(data []byte, ok bool) ([]byte, bool)) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    var deleted []string
+    defer func() { l.hooks.Fire(store.HookDelete, deleted...) }()
+    defer l.locks.Lock(key)()
+    data, err := l.db.Get([]byte(key), nil)
+    if err != nil && err != leveldb.ErrNotFound {
+        return false, wrapError(err)
+    }
+    ok := false
+    if err == nil {
+        _, expired, err := utils.ReadData(data)
+        if err != nil {
+            return false, err
+        }
+        ok = !expired
+    }
+    data, changed := fn(data, ok)
+    if !changed {
+        return false, nil
+    }
+    batch := new(leveldb.Batch)
+    existed := false
+    if data == nil {
+        existed, err = deleteData(l.db, batch, []byte(key))
     } else {
-        err = l.db.Delete([]byte(key), nil)
+        err = putData(l.db, batch, []byte(key), data)
+    }
+    if err == nil {
+        err = l.db.Write(batch, nil)
+    }
+    if err != nil {
+        return false, wrapError(err)
+    }
+    if data != nil {
+        l.watch.Publish(store.EventPut, key, int64(len(utils.ValueOf(data))))
+    } else if existed {
+        l.watch.Publish(store.EventDelete, key, 0)
+        deleted = append(deleted, key)
+    }
+    return true, nil
+}
+
+func (l leveldbImpl) IncrBy(key string, delta int64) (int64, error) {
+    return l.IncrByTTL(key, delta, 0)
+}
+
+func (l leveldbImpl) IncrByTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+    return l.IncrByTTLContext(context.Background(), key, delta, ttl)
+}
+
+func (l leveldbImpl) IncrByTTLContext(ctx context.Context, key string, delta int64, ttl time.Duration) (n int64, err error) {
+    _, uerr := l.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok {
+            n = delta
+            return utils.CombineData(ttl, store.FormatCounter(n)), true
+        }
+        if n, err = store.AddCounter(utils.ValueOf(data), delta); err != nil {
+            return nil, false
+        }
+        return utils.ReplaceValue(data, store.FormatCounter(n)), true
+    })
+    if uerr != nil {
+        return 0, uerr
+    }
+    return
+}
+
+func (l leveldbImpl) Update(fn func(tx store.Txn) error) error {
+    return l.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext 使用 LevelDB 的 Transaction, 事务期间持有所有 key 锁, 不会与条件写入交错
+func (l leveldbImpl) UpdateContext(ctx context.Context, fn func(tx store.Txn) error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    var deleted []string
+    defer func() { l.hooks.Fire(store.HookDelete, deleted...) }()
+    defer l.locks.LockAll()()
+    tr, err := l.db.OpenTransaction()
+    if err != nil {
+        return wrapError(err)
+    }
+    var events []store.Event
+    if err := fn(leveldbTxn{tr: tr, events: &events}); err != nil {
+        tr.Discard()
+        return err
+    }
+    if err := ctx.Err(); err != nil {
+        tr.Discard()
+        return err
+    }
+    if err := tr.Commit(); err != nil {
+        // 提交失败时事务仍然持有写锁
+        tr.Discard()
+        return wrapError(err)
+    }
+    for _, ev := range events {
+        l.watch.Publish(ev.Type, ev.Key, ev.Size)
+        if ev.Type == store.EventDelete {
+            deleted = append(deleted, ev.Key)
+        }
+    }
+    return nil
+}
+
+func (t leveldbTxn) Get(key string) ([]byte, error) {
+    value, err := t.tr.Get([]byte(key), nil)
+    if err != nil {
+        return nil, wrapError(err)
+    }
+    data, expired, err := utils.ReadData(value)
+    if err != nil {
         return nil, err
     }
+    if expired {
+        return nil, store.ErrExpired
+    }
+    return utils.CopyBytes(data), nil
 }
 
-func (l leveldbImpl) Exist(key string) (bool, error) {
-    data, err := l.Get(key)
-    return data != nil, err
+func (t leveldbTxn) Put(key string, value []byte) error {
+    return t.PutTTL(key, value, 0)
 }
 
-func (l leveldbImpl) Delete(key string) error {
-    return l.db.Delete([]byte(key), nil)
+func (t leveldbTxn) PutTTL(key string, value []byte, ttl time.Duration) error {
+    batch := new(leveldb.Batch)
+    if err := putData(t.tr, batch, []byte(key), utils.CombineData(ttl, value)); err != nil {
+        return wrapError(err)
+    }
+    if err := t.tr.Write(batch, nil); err != nil {
+        return wrapError(err)
+    }
+    *t.events = append(*t.events, store.Event{Type: store.EventPut, Key: key, Size: int64(len(value))})
+    return nil
+}
+
+func (t leveldbTxn) Delete(key string) error {
+    batch := new(leveldb.Batch)
+    ok, err := deleteData(t.tr, batch, []byte(key))
+    if err != nil {
+        return wrapError(err)
+    }
+    if err := t.tr.Write(batch, nil); err != nil {
+        return wrapError(err)
+    }
+    if ok {
+        *t.events = append(*t.events, store.Event{Type: store.EventDelete, Key: key})
+    }
+    return nil
+}
+
+func (t leveldbTxn) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
+    it := t.tr.NewIterator(dataRange(prefix, limit), nil)
+    defer it.Release()
+    for it.Next() {
+        ok, _, value := utils.SplitData(it.Value())
+        if !ok {
+            continue
+        }
+        if !cb(string(it.Key()), utils.CopyBytes(value)) {
+            break
+        }
+    }
+    return wrapError(it.Error())
+}
+
+// dataRange 普通数据的遍历范围, 排除保留给过期索引的 key
+func dataRange(prefix, limit string) *util.Range {
+    r := &util.Range{Start: []byte(prefix), Limit: []byte(limit)}
+    if limit == "" || bytes.Compare(r.Limit, indexReserved) > 0 {
+        r.Limit = indexReserved
+    }
+    return r
+}
+
+// putData 把写入和过期索引的更新放进同一个 batch, 调用方需要持有 key 锁
+func putData(r reader, batch *leveldb.Batch, key, data []byte) error {
+    if bytes.HasPrefix(key, indexReserved) {
+        return errReservedKey
+    }
+    if err := unindex(r, batch, key); err != nil {
+        return err
+    }
+    if at := utils.ExpireAtMillis(data); at > 0 {
+        batch.Put(utils.ExpiryIndexKey(indexPrefix, at, key), nil)
+    }
+    batch.Put(key, data)
+    return nil
+}
+
+// deleteData 删除数据和它在索引中的项, 返回删除前是否存在, 调用方需要持有 key 锁
+func deleteData(r reader, batch *leveldb.Batch, key []byte) (bool, error) {
+    old, err := r.Get(key, nil)
+    if err == leveldb.ErrNotFound {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    if at := utils.ExpireAtMillis(old); at > 0 {
+        batch.Delete(utils.ExpiryIndexKey(indexPrefix, at, key))
+    }
+    batch.Delete(key)
+    return true, nil
+}
+
+func unindex(r reader, batch *leveldb.Batch, key []byte) error {
+    old, err := r.Get(key, nil)
+    if err == leveldb.ErrNotFound {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if at := utils.ExpireAtMillis(old); at > 0 {
+        batch.Delete(utils.ExpiryIndexKey(indexPrefix, at, key))
+    }
+    return nil
+}
+
+// ensureIndex 第一次使用索引时扫描全部数据补建索引, 之后的写入都会同步维护索引
+func (l leveldbImpl) ensureIndex() error {
+    if ok, err := l.db.Has(indexReady, nil); err != nil || ok {
+        return wrapError(err)
+    }
+    defer l.locks.LockAll()()
+    it := l.db.NewIterator(dataRange("", ""), nil)
+    defer it.Release()
+    batch := new(leveldb.Batch)
+    for it.Next() {
+        if at := utils.ExpireAtMillis(it.Value()); at > 0 {
+            batch.Put(utils.ExpiryIndexKey(indexPrefix, at, it.Key()), nil)
+        }
+        if batch.Len() >= 1000 {
+            if err := l.db.Write(batch, nil); err != nil {
+                return wrapError(err)
+            }
+            batch.Reset()
+        }
+    }
+    if err := it.Error(); err != nil {
+        return wrapError(err)
+    }
+    batch.Put(indexReady, nil)
+    return wrapError(l.db.Write(batch, nil))
+}
+
+// scanIndex 按过期时间升序遍历 before (Unix 毫秒) 之前的索引项
+func (l leveldbImpl) scanIndex(before int64, cb func(at int64, key []byte) bool) error {
+    it := l.db.NewIterator(util.BytesPrefix(indexPrefix), nil)
+    defer it.Release()
+    for it.Next() {
+        at, key, ok := utils.ParseExpiryIndexKey(indexPrefix, it.Key())
+        if !ok || at >= before || !cb(at, key) {
+            break
+        }
+    }
+    return wrapError(it.Error())
+}
+
+func (l leveldbImpl) Expiring(before time.Time, max int) ([]store.ExpiringKey, error) {
+    return l.ExpiringContext(context.Background(), before, max)
+}
+
+// ExpiringContext 只读取过期索引
+func (l leveldbImpl) ExpiringContext(ctx context.Context, before time.Time, max int) (result []store.ExpiringKey, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
+    if err = l.ensureIndex(); err != nil {
+        return
+    }
+    err = l.scanIndex(before.UnixNano()/int64(time.Millisecond), func(at int64, key []byte) bool {
+        result = append(result, store.ExpiringKey{
+            Key:      string(key),
+            ExpireAt: time.Unix(0, at*int64(time.Millisecond)),
+        })
+        return len(result) < max
+    })
+    return
+}
+
+// SweepExpired 从过期索引的开头删除最多 budget 个已过期的 key, 不需要 cursor, 总是返回空的 next
+func (l leveldbImpl) SweepExpired(ctx context.Context, _ string, budget int) (removed int, next string, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
+    if budget <= 0 {
+        budget = store.DefaultSweepBudget
+    }
+    if err = l.ensureIndex(); err != nil {
+        return
+    }
+    var (
+        keys []string
+        ats  []int64
+    )
+    err = l.scanIndex(utils.GetTimeNow().UnixNano()/int64(time.Millisecond), func(at int64, key []byte) bool {
+        keys = append(keys, string(key))
+        ats = append(ats, at)
+        return len(keys) < budget
+    })
+    if err != nil || len(keys) == 0 {
+        return
+    }
+    removed, err = l.deleteExpired(keys, ats)
+    return
+}
+
+// deleteExpired 持有 key 锁删除仍然过期的 key, 期间被重新写入的 key 会保留;
+// ats 为这些 key 在索引中的过期时间, 与当前数据不一致的索引项是过时的, 一并删除
+func (l leveldbImpl) deleteExpired(keys []string, ats []int64) (int, error) {
+    var expired []string
+    defer func() { l.hooks.Fire(store.HookExpire, expired...) }()
+    defer l.locks.Lock(keys...)()
+    batch := new(leveldb.Batch)
+    var removed []string
+    for i, key := range keys {
+        data, err := l.db.Get([]byte(key), nil)
+        if err != nil && err != leveldb.ErrNotFound {
+            return 0, wrapError(err)
+        }
+        if ats != nil && (data == nil || utils.ExpireAtMillis(data) != ats[i]) {
+            batch.Delete(utils.ExpiryIndexKey(indexPrefix, ats[i], []byte(key)))
+        }
+        if data == nil {
+            continue
+        }
+        if !utils.IsExpired(data) {
+            continue
+        }
+        if _, err := deleteData(l.db, batch, []byte(key)); err != nil {
+            return 0, wrapError(err)
+        }
+        removed = append(removed, key)
+    }
+    if err := l.db.Write(batch, nil); err != nil {
+        return 0, wrapError(err)
+    }
+    for _, key := range removed {
+        l.watch.Publish(store.EventExpire, key, 0)
+    }
+    expired = removed
+    return len(removed), nil
+}
+
+// migrateChunk MigrateFormat 每批改写的 key 数量
+const migrateChunk = 1000
+
+// MigrateFormat 遍历全部数据, 分批持有 key 锁改写旧格式的数据; 过期时间不变, 过期索引不需要修改
+func (l leveldbImpl) MigrateFormat(ctx context.Context) (migrated int, err error) {
+    it := l.db.NewIterator(dataRange("", ""), nil)
+    defer it.Release()
+    var keys []string
+    flush := func() error {
+        if len(keys) == 0 {
+            return nil
+        }
+        defer l.locks.Lock(keys...)()
+        batch := new(leveldb.Batch)
+        for _, key := range keys {
+            value, err := l.db.Get([]byte(key), nil)
+            if err == leveldb.ErrNotFound {
+                continue
+            }
+            if err != nil {
+                return err
+            }
+            if data, ok := utils.UpgradeData(value); ok {
+                batch.Put([]byte(key), data)
+            }
+        }
+        if err := l.db.Write(batch, nil); err != nil {
+            return err
+        }
+        migrated += batch.Len()
+        keys = keys[:0]
+        return nil
+    }
+    for it.Next() {
+        if err = ctx.Err(); err != nil {
+            return
+        }
+        if utils.IsLegacyData(it.Value()) {
+            keys = append(keys, string(it.Key()))
+        }
+        if len(keys) >= migrateChunk {
+            if err = flush(); err != nil {
+                return migrated, wrapError(err)
+            }
+        }
+    }
+    if err = it.Error(); err == nil {
+        err = flush()
+    }
+    err = wrapError(err)
+    return
+}
+
+func (l leveldbImpl) Expire(key string, ttl time.Duration) error {
+    return l.ExpireContext(context.Background(), key, ttl)
+}
+
+func (l leveldbImpl) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+    return l.ExpireAtContext(ctx, key, utils.GetTimeNow().Add(ttl))
+}
+
+func (l leveldbImpl) ExpireAt(key string, at time.Time) error {
+    return l.ExpireAtContext(context.Background(), key, at)
+}
+
+// ExpireAtContext 持有 key 锁改写数据头, 同时更新过期索引
+func (l leveldbImpl) ExpireAtContext(ctx context.Context, key string, at time.Time) error {
+    changed, err := l.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok {
+            return nil, false
+        }
+        return utils.SetExpireAt(data, at), true
+    })
+    if err == nil && !changed {
+        err = store.ErrNotFound
+    }
+    return err
+}
+
+func (l leveldbImpl) Persist(key string) error {
+    return l.PersistContext(context.Background(), key)
+}
+
+func (l leveldbImpl) PersistContext(ctx context.Context, key string) error {
+    return l.ExpireAtContext(ctx, key, time.Time{})
+}
+
+func (l leveldbImpl) Touch(key string) error {
+    return l.TouchContext(context.Background(), key)
+}
+
+// TouchContext LevelDB 没有访问顺序, 只检查 key 是否存在
+func (l leveldbImpl) TouchContext(ctx context.Context, key string) error {
+    ok, err := l.ExistContext(ctx, key)
+    if err == nil && !ok {
+        err = store.ErrNotFound
+    }
+    return err
+}
+
+func (l leveldbImpl) OnExpire(fn func(key string)) {
+    l.hooks.Add(store.HookExpire, fn)
+}
+
+func (l leveldbImpl) OnDelete(fn func(key string)) {
+    l.hooks.Add(store.HookDelete, fn)
+}
+
+// OnEvict 没有容量限制, 不会触发
+func (l leveldbImpl) OnEvict(fn func(key string)) {
+    l.hooks.Add(store.HookEvict, fn)
+}
+
+// Watch 写入在 key 锁内发布, 同一个 key 的事件顺序与生效顺序一致
+func (l leveldbImpl) Watch(ctx context.Context, prefix string) <-chan store.Event {
+    return l.watch.Watch(ctx, prefix)
+}
+
+// StartSweeper 启动后台过期清理, Close 时停止
+func (l leveldbImpl) StartSweeper(opts store.SweeperOptions) *store.Sweeper {
+    return l.sweeper.Start(l, opts)
 }
 
 func New(db *leveldb.DB) store.Store {
-    p := &leveldbImpl{db: db}
+    p := &leveldbImpl{db: db, locks: utils.NewKeyLock(), sweeper: &store.SweeperSlot{}, hooks: &store.Hooks{}, watch: &store.Watchers{}}
     return p
 }
 func FromEnv() store.Store {
@@ -149,4 +924,25 @@ func FromEnv() store.Store {
     return New(db)
 }
 
+// init 注册 leveldb:///path/to/dir, 打开的库在 Close 时关闭
+func init() {
+    store.Register("leveldb", func(u *url.URL) (store.Store, error) {
+        db, err := leveldb.OpenFile(u.Host+u.Path, nil)
+        if err != nil {
+            return nil, err
+        }
+        return New(db), nil
+    })
+}
+
 var _ = FromEnv
+var _ store.BatchStore = &leveldbImpl{}
+var _ store.CASStore = &leveldbImpl{}
+var _ store.CounterStore = &leveldbImpl{}
+var _ store.TxnStore = &leveldbImpl{}
+var _ store.SweeperStore = &leveldbImpl{}
+var _ store.ExpiryIndexStore = &leveldbImpl{}
+var _ store.FormatMigrator = &leveldbImpl{}
+var _ store.ExpireStore = &leveldbImpl{}
+var _ store.HookStore = &leveldbImpl{}
+var _ store.WatchStore = &leveldbImpl{}
@@ -2,61 +2,101 @@ package StoreMemory
 
 import (
     "bytes"
+    "context"
     "github.com/DGHeroin/store"
     "github.com/DGHeroin/store/utils"
     "io"
     "io/ioutil"
+    "net/url"
+    "sort"
     "sync"
     "time"
 )
 
 type (
     implMemory struct {
-        mu sync.RWMutex
-        m  map[string][]byte
+        mu      sync.RWMutex
+        m       map[string][]byte
+        closed  bool
+        sweeper store.SweeperSlot
+        hooks   store.Hooks
+        watch   store.Watchers
+    }
+    // memoryTxn 事务内的写入先记录在 writes 中, 提交时一次性应用, nil 表示删除
+    memoryTxn struct {
+        i      *implMemory
+        writes map[string][]byte
     }
 )
 
 func (i *implMemory) Close() error {
+    i.sweeper.Stop()
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    i.closed = true
+    i.watch.Close()
     return nil
 }
 
 func (i *implMemory) TTL(key string) (time.Duration, error) {
+    return i.TTLContext(context.Background(), key)
+}
+
+func (i *implMemory) TTLContext(ctx context.Context, key string) (time.Duration, error) {
+    if err := ctx.Err(); err != nil {
+        return 0, err
+    }
     i.mu.RLock()
     defer i.mu.RUnlock()
+    if i.closed {
+        return 0, store.ErrClosed
+    }
     p, ok := i.m[key]
     if !ok {
+        return 0, store.ErrNotFound
+    }
+    _, expired, err := utils.ReadData(p)
+    if err != nil {
+        return 0, err
+    }
+    ttl := utils.ExpireAtMillis(p)
+    if expired {
+        return 0, store.ErrExpired
+    }
+    if ttl == 0 {
         return 0, nil
     }
-    ok, ttl, _ := utils.SplitData(p)
-    if !ok {
-        return -1, nil
+    left := time.Unix(0, ttl*int64(time.Millisecond)).Sub(utils.GetTimeNow())
+    if left <= 0 {
+        return 0, store.ErrExpired
     }
-    durationSec := int64(ttl) - utils.GetTimeNow().Unix()
-    return time.Duration(durationSec) * time.Second, nil
+    return left, nil
+}
+
+func (i *implMemory) RangeKeys(prefix, limit string, max int) (store.KeysInfoSlice, error) {
+    return i.RangeKeysContext(context.Background(), prefix, limit, max)
 }
 
-func (i *implMemory) RangeKeys(prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
+func (i *implMemory) RangeKeysContext(ctx context.Context, prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
     i.mu.RLock()
     defer i.mu.RUnlock()
-    var (
-        keys []string
-        mm   = map[string]store.KeysInfo{}
-    )
+    if i.closed {
+        return nil, store.ErrClosed
+    }
+    var keys, expired []string
     for key, v := range i.m {
-        ok, _, value := utils.SplitData(v)
-        if ok {
+        if ok, _, _ := utils.SplitData(v); ok {
             keys = append(keys, key)
-            mm[key] = store.KeysInfo{
-                Key:  key,
-                Size: int64(len(value)),
-            }
-        } else {
-            go func() {
-                _ = i.Delete(key)
-            }()
+        } else if utils.IsExpired(v) {
+            expired = append(expired, key)
         }
     }
+    if len(expired) > 0 {
+        go i.deleteExpired(expired)
+    }
     keys = utils.CutStringSlice(keys, prefix, limit)
     if len(keys) > max {
         keys = keys[:max]
@@ -76,48 +116,76 @@ func (i *implMemory) Put(key string, value []byte) error {
     return i.PutTTL(key, value, 0)
 }
 
+func (i *implMemory) PutContext(ctx context.Context, key string, value []byte) error {
+    return i.PutTTLContext(ctx, key, value, 0)
+}
+
 func (i *implMemory) PutTTL(key string, value []byte, ttl time.Duration) error {
+    return i.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+func (i *implMemory) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
     i.mu.Lock()
     defer i.mu.Unlock()
-    data := utils.CombineData(ttl, value)
-    i.m[key] = data
+    if i.closed {
+        return store.ErrClosed
+    }
+    i.set(key, utils.CombineData(ttl, value))
     return nil
 }
 
 func (i *implMemory) Get(key string) ([]byte, error) {
+    return i.GetContext(context.Background(), key)
+}
+
+func (i *implMemory) GetContext(ctx context.Context, key string) ([]byte, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
     i.mu.RLock()
     defer i.mu.RUnlock()
+    if i.closed {
+        return nil, store.ErrClosed
+    }
     if data, ok := i.m[key]; ok {
-        ok, _, value := utils.SplitData(data)
-        if ok {
-            return utils.CopyBytes(value), nil
-        } else {
-            go func() {
-                _ = i.Delete(key)
-            }()
+        value, expired, err := utils.ReadData(data)
+        if err != nil {
+            return nil, err
+        }
+        if expired {
+            go i.deleteExpired([]string{key})
+            return nil, store.ErrExpired
         }
+        return utils.CopyBytes(value), nil
     }
-    return nil, nil
+    return nil, store.ErrNotFound
 }
 
 func (i *implMemory) RPut(key string, r io.Reader, size int64) error {
     return i.RPutTTL(key, r, size, 0)
 }
 
-func (i *implMemory) RPutTTL(key string, r io.Reader, _ int64, ttl time.Duration) error {
-    i.mu.Lock()
-    defer i.mu.Unlock()
+func (i *implMemory) RPutTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+    return i.RPutTTLContext(context.Background(), key, r, size, ttl)
+}
+
+func (i *implMemory) RPutTTLContext(ctx context.Context, key string, r io.Reader, _ int64, ttl time.Duration) error {
     value, err := ioutil.ReadAll(r)
     if err != nil {
         return err
     }
-    data := utils.CombineData(ttl, value)
-    i.m[key] = data
-    return nil
+    return i.PutTTLContext(ctx, key, value, ttl)
 }
 
 func (i *implMemory) RGet(key string) (io.Reader, error) {
-    data, err := i.Get(key)
+    return i.RGetContext(context.Background(), key)
+}
+
+func (i *implMemory) RGetContext(ctx context.Context, key string) (io.Reader, error) {
+    data, err := i.GetContext(ctx, key)
     if err != nil {
         return nil, err
     }
@@ -125,35 +193,76 @@ func (i *implMemory) RGet(key string) (io.Reader, error) {
 }
 
 func (i *implMemory) Exist(key string) (bool, error) {
-    if _, err := i.Get(key); err != nil {
+    return i.ExistContext(context.Background(), key)
+}
+
+func (i *implMemory) ExistContext(ctx context.Context, key string) (bool, error) {
+    if _, err := i.GetContext(ctx, key); err != nil {
+        if store.IsNotFound(err) {
+            return false, nil
+        }
         return false, err
     }
     return true, nil
 }
 
 func (i *implMemory) Delete(key string) error {
+    return i.DeleteContext(context.Background(), key)
+}
+
+func (i *implMemory) DeleteContext(ctx context.Context, key string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    var deleted []string
+    defer func() { i.hooks.Fire(store.HookDelete, deleted...) }()
     i.mu.Lock()
     defer i.mu.Unlock()
-    delete(i.m, key)
+    if i.closed {
+        return store.ErrClosed
+    }
+    i.remove(key, store.EventDelete, &deleted)
     return nil
 }
 
 func (i *implMemory) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
+    return i.RangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (i *implMemory) RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
     i.mu.RLock()
-    defer i.mu.RUnlock()
+    if i.closed {
+        i.mu.RUnlock()
+        return store.ErrClosed
+    }
     if len(i.m) == 0 {
+        i.mu.RUnlock()
         return nil
     }
     keys := make([]string, 0)
     for k := range i.m {
         keys = append(keys, k)
     }
+    i.mu.RUnlock()
     keys = utils.CutStringSlice(keys, prefix, limit)
     for _, k := range keys {
-        data := i.m[k]
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        i.mu.RLock()
+        data, ok := i.m[k]
+        i.mu.RUnlock()
+        if !ok {
+            continue
+        }
         ok, _, value := utils.SplitData(data)
         if !ok {
-            delete(i.m, k)
+            if utils.IsExpired(data) {
+                i.deleteExpired([]string{k})
+            }
             continue
         }
         if !cb(k, value) {
@@ -164,11 +273,442 @@ func (i *implMemory) Range(prefix, limit string, cb func(key string, value []byt
 }
 
 func (i *implMemory) RRange(prefix, limit string, cb func(key string, r io.Reader) bool) error {
-    return i.Range(prefix, limit, func(key string, value []byte) bool {
+    return i.RRangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (i *implMemory) RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    return i.RangeContext(ctx, prefix, limit, func(key string, value []byte) bool {
         return cb(key, bytes.NewBuffer(value))
     })
 }
 
+func (i *implMemory) MGet(keys ...string) (map[string][]byte, error) {
+    return i.MGetContext(context.Background(), keys...)
+}
+
+func (i *implMemory) MGetContext(ctx context.Context, keys ...string) (map[string][]byte, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    i.mu.RLock()
+    defer i.mu.RUnlock()
+    if i.closed {
+        return nil, store.ErrClosed
+    }
+    var expired []string
+    result := make(map[string][]byte, len(keys))
+    for _, key := range keys {
+        data, ok := i.m[key]
+        if !ok {
+            continue
+        }
+        value, isExpired, err := utils.ReadData(data)
+        if err != nil {
+            return nil, err
+        }
+        if isExpired {
+            expired = append(expired, key)
+            continue
+        }
+        result[key] = utils.CopyBytes(value)
+    }
+    if len(expired) > 0 {
+        go i.deleteExpired(expired)
+    }
+    return result, nil
+}
+
+func (i *implMemory) MPut(kvs map[string][]byte) error {
+    return i.MPutTTL(kvs, 0)
+}
+
+func (i *implMemory) MPutTTL(kvs map[string][]byte, ttl time.Duration) error {
+    return i.MPutTTLContext(context.Background(), kvs, ttl)
+}
+
+func (i *implMemory) MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    if i.closed {
+        return store.ErrClosed
+    }
+    for key, value := range kvs {
+        i.set(key, utils.CombineData(ttl, value))
+    }
+    return nil
+}
+
+func (i *implMemory) MDelete(keys ...string) error {
+    return i.MDeleteContext(context.Background(), keys...)
+}
+
+func (i *implMemory) MDeleteContext(ctx context.Context, keys ...string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    var deleted []string
+    defer func() { i.hooks.Fire(store.HookDelete, deleted...) }()
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    if i.closed {
+        return store.ErrClosed
+    }
+    for _, key := range keys {
+        i.remove(key, store.EventDelete, &deleted)
+    }
+    return nil
+}
+
+func (i *implMemory) MExist(keys ...string) (map[string]bool, error) {
+    return i.MExistContext(context.Background(), keys...)
+}
+
+func (i *implMemory) MExistContext(ctx context.Context, keys ...string) (map[string]bool, error) {
+    found, err := i.MGetContext(ctx, keys...)
+    if err != nil {
+        return nil, err
+    }
+    result := make(map[string]bool, len(keys))
+    for _, key := range keys {
+        _, result[key] = found[key]
+    }
+    return result, nil
+}
+
+func (i *implMemory) CompareAndSwap(key string, old, new []byte) (bool, error) {
+    return i.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+func (i *implMemory) CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (bool, error) {
+    return i.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(utils.ValueOf(data), old) {
+            return nil, false
+        }
+        return utils.ReplaceValue(data, new), true
+    })
+}
+
+func (i *implMemory) PutIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+    return i.PutIfAbsentContext(context.Background(), key, value, ttl)
+}
+
+func (i *implMemory) PutIfAbsentContext(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    return i.update(ctx, key, func(_ []byte, ok bool) ([]byte, bool) {
+        if ok {
+            return nil, false
+        }
+        return utils.CombineData(ttl, value), true
+    })
+}
+
+func (i *implMemory) DeleteIf(key string, expected []byte) (bool, error) {
+    return i.DeleteIfContext(context.Background(), key, expected)
+}
+
+func (i *implMemory) DeleteIfContext(ctx context.Context, key string, expected []byte) (bool, error) {
+    return i.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(utils.ValueOf(data), expected) {
+            return nil, false
+        }
+        return nil, true
+    })
+}
+
+// update 在写锁内读取 key 当前的数据 (ok 表示存在且未过期) 并决定是否修改, 新数据为 nil 表示删除
+func (i *implMemory) update(ctx context.Context, key string, fn func(data []byte, ok bool) ([]byte, bool)) (bool, error) {
+    if err := ctx.Err(); err != nil {
+        return false, err
+    }
+    var deleted []string
+    defer func() { i.hooks.Fire(store.HookDelete, deleted...) }()
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    if i.closed {
+        return false, store.ErrClosed
+    }
+    data, ok := i.m[key]
+    if ok {
+        _, expired, err := utils.ReadData(data)
+        if err != nil {
+            return false, err
+        }
+        ok = !expired
+    }
+    data, changed := fn(data, ok)
+    if !changed {
+        return false, nil
+    }
+    if data == nil {
+        i.remove(key, store.EventDelete, &deleted)
+    } else {
+        i.set(key, data)
+    }
+    return true, nil
+}
+
+func (i *implMemory) IncrBy(key string, delta int64) (int64, error) {
+    return i.IncrByTTL(key, delta, 0)
+}
+
+func (i *implMemory) IncrByTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+    return i.IncrByTTLContext(context.Background(), key, delta, ttl)
+}
+
+func (i *implMemory) IncrByTTLContext(ctx context.Context, key string, delta int64, ttl time.Duration) (n int64, err error) {
+    _, uerr := i.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok {
+            n = delta
+            return utils.CombineData(ttl, store.FormatCounter(n)), true
+        }
+        if n, err = store.AddCounter(utils.ValueOf(data), delta); err != nil {
+            return nil, false
+        }
+        return utils.ReplaceValue(data, store.FormatCounter(n)), true
+    })
+    if uerr != nil {
+        return 0, uerr
+    }
+    return
+}
+
+func (i *implMemory) Update(fn func(tx store.Txn) error) error {
+    return i.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext 事务期间持有写锁, 写入在回调成功返回后一次性应用
+func (i *implMemory) UpdateContext(ctx context.Context, fn func(tx store.Txn) error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    var deleted []string
+    defer func() { i.hooks.Fire(store.HookDelete, deleted...) }()
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    if i.closed {
+        return store.ErrClosed
+    }
+    tx := &memoryTxn{i: i, writes: map[string][]byte{}}
+    if err := fn(tx); err != nil {
+        return err
+    }
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    for key, data := range tx.writes {
+        if data == nil {
+            i.remove(key, store.EventDelete, &deleted)
+        } else {
+            i.set(key, data)
+        }
+    }
+    return nil
+}
+
+func (t *memoryTxn) lookup(key string) ([]byte, bool) {
+    if data, ok := t.writes[key]; ok {
+        return data, data != nil
+    }
+    data, ok := t.i.m[key]
+    return data, ok
+}
+
+func (t *memoryTxn) Get(key string) ([]byte, error) {
+    data, ok := t.lookup(key)
+    if !ok {
+        return nil, store.ErrNotFound
+    }
+    value, expired, err := utils.ReadData(data)
+    if err != nil {
+        return nil, err
+    }
+    if expired {
+        return nil, store.ErrExpired
+    }
+    return utils.CopyBytes(value), nil
+}
+
+func (t *memoryTxn) Put(key string, value []byte) error {
+    return t.PutTTL(key, value, 0)
+}
+
+func (t *memoryTxn) PutTTL(key string, value []byte, ttl time.Duration) error {
+    t.writes[key] = utils.CombineData(ttl, value)
+    return nil
+}
+
+func (t *memoryTxn) Delete(key string) error {
+    t.writes[key] = nil
+    return nil
+}
+
+func (t *memoryTxn) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
+    keys := make([]string, 0, len(t.i.m))
+    for key := range t.i.m {
+        if _, ok := t.writes[key]; !ok {
+            keys = append(keys, key)
+        }
+    }
+    for key := range t.writes {
+        keys = append(keys, key)
+    }
+    for _, key := range utils.CutStringSlice(keys, prefix, limit) {
+        data, ok := t.lookup(key)
+        if !ok {
+            continue
+        }
+        if ok, _, value := utils.SplitData(data); ok && !cb(key, utils.CopyBytes(value)) {
+            break
+        }
+    }
+    return nil
+}
+
+// set 写入 key 并发布变更, 调用方持有写锁
+func (i *implMemory) set(key string, data []byte) {
+    i.m[key] = data
+    i.watch.Publish(store.EventPut, key, int64(len(utils.ValueOf(data))))
+}
+
+// remove 删除 key, 删除前存在时发布 t 并记录到 removed 中, 调用方持有写锁并在释放锁之后触发回调
+func (i *implMemory) remove(key string, t store.EventType, removed *[]string) {
+    if _, ok := i.m[key]; ok {
+        delete(i.m, key)
+        i.watch.Publish(t, key, 0)
+        *removed = append(*removed, key)
+    }
+}
+
+// deleteExpired 删除 keys 中仍然过期的 key, 期间被重新写入的 key 会保留; 返回删除的数量
+func (i *implMemory) deleteExpired(keys []string) int {
+    var expired []string
+    defer func() { i.hooks.Fire(store.HookExpire, expired...) }()
+    i.mu.Lock()
+    defer i.mu.Unlock()
+    if i.closed {
+        return 0
+    }
+    for _, key := range keys {
+        data, ok := i.m[key]
+        if !ok {
+            continue
+        }
+        if utils.IsExpired(data) {
+            i.remove(key, store.EventExpire, &expired)
+        }
+    }
+    return len(expired)
+}
+
+// SweepExpired 按 key 升序从 cursor 开始检查最多 budget 个 key
+func (i *implMemory) SweepExpired(ctx context.Context, cursor string, budget int) (removed int, next string, err error) {
+    if err = ctx.Err(); err != nil {
+        return
+    }
+    if budget <= 0 {
+        budget = store.DefaultSweepBudget
+    }
+    i.mu.RLock()
+    if i.closed {
+        i.mu.RUnlock()
+        return 0, "", store.ErrClosed
+    }
+    keys := make([]string, 0, len(i.m))
+    for key := range i.m {
+        if key >= cursor {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    if len(keys) > budget {
+        next = keys[budget-1] + "\x00"
+        keys = keys[:budget]
+    }
+    var expired []string
+    for _, key := range keys {
+        if utils.IsExpired(i.m[key]) {
+            expired = append(expired, key)
+        }
+    }
+    i.mu.RUnlock()
+    if len(expired) > 0 {
+        removed = i.deleteExpired(expired)
+    }
+    return
+}
+
+func (i *implMemory) Expire(key string, ttl time.Duration) error {
+    return i.ExpireContext(context.Background(), key, ttl)
+}
+
+func (i *implMemory) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+    return i.ExpireAtContext(ctx, key, utils.GetTimeNow().Add(ttl))
+}
+
+func (i *implMemory) ExpireAt(key string, at time.Time) error {
+    return i.ExpireAtContext(context.Background(), key, at)
+}
+
+// ExpireAtContext 在写锁内改写数据头, value 不变
+func (i *implMemory) ExpireAtContext(ctx context.Context, key string, at time.Time) error {
+    changed, err := i.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok {
+            return nil, false
+        }
+        return utils.SetExpireAt(data, at), true
+    })
+    if err == nil && !changed {
+        err = store.ErrNotFound
+    }
+    return err
+}
+
+func (i *implMemory) Persist(key string) error {
+    return i.PersistContext(context.Background(), key)
+}
+
+func (i *implMemory) PersistContext(ctx context.Context, key string) error {
+    return i.ExpireAtContext(ctx, key, time.Time{})
+}
+
+func (i *implMemory) Touch(key string) error {
+    return i.TouchContext(context.Background(), key)
+}
+
+// TouchContext 内存中没有访问顺序, 只检查 key 是否存在
+func (i *implMemory) TouchContext(ctx context.Context, key string) error {
+    ok, err := i.ExistContext(ctx, key)
+    if err == nil && !ok {
+        err = store.ErrNotFound
+    }
+    return err
+}
+
+func (i *implMemory) OnExpire(fn func(key string)) {
+    i.hooks.Add(store.HookExpire, fn)
+}
+
+func (i *implMemory) OnDelete(fn func(key string)) {
+    i.hooks.Add(store.HookDelete, fn)
+}
+
+// OnEvict 没有容量限制, 不会触发
+func (i *implMemory) OnEvict(fn func(key string)) {
+    i.hooks.Add(store.HookEvict, fn)
+}
+
+// Watch 写入在写锁内发布, 事件顺序与生效顺序一致
+func (i *implMemory) Watch(ctx context.Context, prefix string) <-chan store.Event {
+    return i.watch.Watch(ctx, prefix)
+}
+
+// StartSweeper 启动后台过期清理, Close 时停止
+func (i *implMemory) StartSweeper(opts store.SweeperOptions) *store.Sweeper {
+    return i.sweeper.Start(i, opts)
+}
+
 func New() store.Store {
     m := &implMemory{
         m: make(map[string][]byte),
@@ -176,4 +716,19 @@ func New() store.Store {
     return m
 }
 
+// init 注册 memory 和 memory://
+func init() {
+    store.Register("memory", func(*url.URL) (store.Store, error) {
+        return New(), nil
+    })
+}
+
 var _ = New
+var _ store.BatchStore = &implMemory{}
+var _ store.CASStore = &implMemory{}
+var _ store.CounterStore = &implMemory{}
+var _ store.TxnStore = &implMemory{}
+var _ store.SweeperStore = &implMemory{}
+var _ store.ExpireStore = &implMemory{}
+var _ store.HookStore = &implMemory{}
+var _ store.WatchStore = &implMemory{}
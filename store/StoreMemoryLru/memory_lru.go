@@ -2,37 +2,84 @@ package StoreMemoryLru
 
 import (
     "bytes"
+    "context"
     "github.com/DGHeroin/store"
     "github.com/DGHeroin/store/utils"
     "io"
     "io/ioutil"
+    "net/url"
+    "sort"
+    "strconv"
+    "sync/atomic"
     "time"
 )
 
 type (
     implMemoryLRU struct {
-        m *utils.LRU
+        m       *utils.LRU
+        locks   *utils.KeyLock
+        closed  int32
+        sweeper store.SweeperSlot
+        hooks   store.Hooks
+        watch   store.Watchers
     }
 )
 
 func (i *implMemoryLRU) Close() error {
+    i.sweeper.Stop()
+    atomic.StoreInt32(&i.closed, 1)
+    i.watch.Close()
+    return nil
+}
+
+func (i *implMemoryLRU) check(ctx context.Context) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    if atomic.LoadInt32(&i.closed) == 1 {
+        return store.ErrClosed
+    }
     return nil
 }
 
 func (i *implMemoryLRU) TTL(key string) (time.Duration, error) {
+    return i.TTLContext(context.Background(), key)
+}
+
+func (i *implMemoryLRU) TTLContext(ctx context.Context, key string) (time.Duration, error) {
+    if err := i.check(ctx); err != nil {
+        return 0, err
+    }
     p, ok := i.m.Get(key)
     if !ok {
+        return 0, store.ErrNotFound
+    }
+    _, expired, err := utils.ReadData(p.([]byte))
+    if err != nil {
+        return 0, err
+    }
+    ttl := utils.ExpireAtMillis(p.([]byte))
+    if expired {
+        return 0, store.ErrExpired
+    }
+    if ttl == 0 {
         return 0, nil
     }
-    ok, ttl, _ := utils.SplitData(p.([]byte))
-    if !ok {
-        return -1, nil
+    left := time.Unix(0, ttl*int64(time.Millisecond)).Sub(utils.GetTimeNow())
+    if left <= 0 {
+        return 0, store.ErrExpired
     }
-    durationSec := int64(ttl) - utils.GetTimeNow().Unix()
-    return time.Duration(durationSec) * time.Second, nil
+    return left, nil
 }
 
-func (i *implMemoryLRU) RangeKeys(prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
+func (i *implMemoryLRU) RangeKeys(prefix, limit string, max int) (store.KeysInfoSlice, error) {
+    return i.RangeKeysContext(context.Background(), prefix, limit, max)
+}
+
+func (i *implMemoryLRU) RangeKeysContext(ctx context.Context, prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
+    if err = i.check(ctx); err != nil {
+        return
+    }
     keysPtr := i.m.Keys()
     var keys []string
     for _, k := range keysPtr {
@@ -59,42 +106,92 @@ func (i *implMemoryLRU) Put(key string, value []byte) error {
     return i.PutTTL(key, value, 0)
 }
 
+func (i *implMemoryLRU) PutContext(ctx context.Context, key string, value []byte) error {
+    return i.PutTTLContext(ctx, key, value, 0)
+}
+
 func (i *implMemoryLRU) PutTTL(key string, value []byte, ttl time.Duration) error {
+    return i.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+func (i *implMemoryLRU) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    if err := i.check(ctx); err != nil {
+        return err
+    }
     data := utils.CombineData(ttl, value)
-    i.m.Add(key, data)
+    unlock := i.locks.Lock(key)
+    evicted, ok := i.add(key, data)
+    unlock()
+    if ok {
+        i.hooks.Fire(store.HookEvict, evicted)
+    }
     return nil
 }
 
+// add 写入 key 并发布变更, 返回因容量限制被淘汰的 key; 调用方持有 key 的锁
+func (i *implMemoryLRU) add(key string, data []byte) (string, bool) {
+    evicted, _, ok := i.m.Push(key, data)
+    i.watch.Publish(store.EventPut, key, int64(len(utils.ValueOf(data))))
+    if !ok {
+        return "", false
+    }
+    i.watch.Publish(store.EventEvict, evicted.(string), 0)
+    return evicted.(string), true
+}
+
+// remove 删除 key, 删除前存在时发布 t; 调用方持有 key 的锁
+func (i *implMemoryLRU) remove(key string, t store.EventType) bool {
+    if !i.m.Remove(key) {
+        return false
+    }
+    i.watch.Publish(t, key, 0)
+    return true
+}
+
 func (i *implMemoryLRU) Get(key string) ([]byte, error) {
+    return i.GetContext(context.Background(), key)
+}
+
+func (i *implMemoryLRU) GetContext(ctx context.Context, key string) ([]byte, error) {
+    if err := i.check(ctx); err != nil {
+        return nil, err
+    }
     if p, ok := i.m.Get(key); ok {
-        ok, _, value := utils.SplitData(p.([]byte))
-        if ok {
-            return utils.CopyBytes(value), nil
-        } else {
-            go func() {
-                _ = i.Delete(key)
-            }()
+        value, expired, err := utils.ReadData(p.([]byte))
+        if err != nil {
+            return nil, err
+        }
+        if expired {
+            go i.deleteExpired(key)
+            return nil, store.ErrExpired
         }
+        return utils.CopyBytes(value), nil
     }
-    return nil, nil
+    return nil, store.ErrNotFound
 }
 
 func (i *implMemoryLRU) RPut(key string, r io.Reader, size int64) error {
     return i.RPutTTL(key, r, size, 0)
 }
 
-func (i *implMemoryLRU) RPutTTL(key string, r io.Reader, _ int64, ttl time.Duration) error {
+func (i *implMemoryLRU) RPutTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+    return i.RPutTTLContext(context.Background(), key, r, size, ttl)
+}
+
+func (i *implMemoryLRU) RPutTTLContext(ctx context.Context, key string, r io.Reader, _ int64, ttl time.Duration) error {
     value, err := ioutil.ReadAll(r)
     if err != nil {
         return err
     }
-    data := utils.CombineData(ttl, value)
-    i.m.Add(key, data)
-    return nil
+    return i.PutTTLContext(ctx, key, value, ttl)
 }
 
 func (i *implMemoryLRU) RGet(key string) (io.Reader, error) {
-    data, err := i.Get(key)
+    return i.RGetContext(context.Background(), key)
+}
+
+func (i *implMemoryLRU) RGetContext(ctx context.Context, key string) (io.Reader, error) {
+    data, err := i.GetContext(ctx, key)
     if err != nil {
         return nil, err
     }
@@ -102,18 +199,44 @@ func (i *implMemoryLRU) RGet(key string) (io.Reader, error) {
 }
 
 func (i *implMemoryLRU) Exist(key string) (bool, error) {
-    if _, err := i.Get(key); err != nil {
+    return i.ExistContext(context.Background(), key)
+}
+
+func (i *implMemoryLRU) ExistContext(ctx context.Context, key string) (bool, error) {
+    if _, err := i.GetContext(ctx, key); err != nil {
+        if store.IsNotFound(err) {
+            return false, nil
+        }
         return false, err
     }
     return true, nil
 }
 
 func (i *implMemoryLRU) Delete(key string) error {
-    i.m.Remove(key)
+    return i.DeleteContext(context.Background(), key)
+}
+
+func (i *implMemoryLRU) DeleteContext(ctx context.Context, key string) error {
+    if err := i.check(ctx); err != nil {
+        return err
+    }
+    unlock := i.locks.Lock(key)
+    ok := i.remove(key, store.EventDelete)
+    unlock()
+    if ok {
+        i.hooks.Fire(store.HookDelete, key)
+    }
     return nil
 }
 
 func (i *implMemoryLRU) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
+    return i.RangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (i *implMemoryLRU) RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error {
+    if err := i.check(ctx); err != nil {
+        return err
+    }
     if i.m.Len() == 0 {
         return nil
     }
@@ -124,9 +247,12 @@ func (i *implMemoryLRU) Range(prefix, limit string, cb func(key string, value []
     }
     keys = utils.CutStringSlice(keys, prefix, limit)
     for _, k := range keys {
-        value, err := i.Get(k)
+        value, err := i.GetContext(ctx, k)
         if err != nil {
-            continue
+            if store.IsNotFound(err) {
+                continue
+            }
+            return err
         }
         if !cb(k, value) {
             break
@@ -136,14 +262,266 @@ func (i *implMemoryLRU) Range(prefix, limit string, cb func(key string, value []
 }
 
 func (i *implMemoryLRU) RRange(prefix, limit string, cb func(key string, r io.Reader) bool) error {
-    return i.Range(prefix, limit, func(key string, value []byte) bool {
+    return i.RRangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (i *implMemoryLRU) RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    return i.RangeContext(ctx, prefix, limit, func(key string, value []byte) bool {
         return cb(key, bytes.NewBuffer(value))
     })
 }
 
+func (i *implMemoryLRU) CompareAndSwap(key string, old, new []byte) (bool, error) {
+    return i.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+func (i *implMemoryLRU) CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (bool, error) {
+    return i.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(utils.ValueOf(data), old) {
+            return nil, false
+        }
+        return utils.ReplaceValue(data, new), true
+    })
+}
+
+func (i *implMemoryLRU) PutIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+    return i.PutIfAbsentContext(context.Background(), key, value, ttl)
+}
+
+func (i *implMemoryLRU) PutIfAbsentContext(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    return i.update(ctx, key, func(_ []byte, ok bool) ([]byte, bool) {
+        if ok {
+            return nil, false
+        }
+        return utils.CombineData(ttl, value), true
+    })
+}
+
+func (i *implMemoryLRU) DeleteIf(key string, expected []byte) (bool, error) {
+    return i.DeleteIfContext(context.Background(), key, expected)
+}
+
+func (i *implMemoryLRU) DeleteIfContext(ctx context.Context, key string, expected []byte) (bool, error) {
+    return i.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(utils.ValueOf(data), expected) {
+            return nil, false
+        }
+        return nil, true
+    })
+}
+
+// update 持有 key 的写锁读取当前数据 (ok 表示存在且未过期) 并决定是否修改, 新数据为 nil 表示删除
+func (i *implMemoryLRU) update(ctx context.Context, key string, fn func(data []byte, ok bool) ([]byte, bool)) (bool, error) {
+    if err := i.check(ctx); err != nil {
+        return false, err
+    }
+    var deleted, evicted []string
+    defer func() {
+        i.hooks.Fire(store.HookDelete, deleted...)
+        i.hooks.Fire(store.HookEvict, evicted...)
+    }()
+    defer i.locks.Lock(key)()
+    var data []byte
+    p, ok := i.m.Peek(key)
+    if ok {
+        data = p.([]byte)
+        _, expired, err := utils.ReadData(data)
+        if err != nil {
+            return false, err
+        }
+        ok = !expired
+    }
+    data, changed := fn(data, ok)
+    if !changed {
+        return false, nil
+    }
+    if data == nil {
+        if i.remove(key, store.EventDelete) {
+            deleted = append(deleted, key)
+        }
+    } else if k, ok := i.add(key, data); ok {
+        evicted = append(evicted, k)
+    }
+    return true, nil
+}
+
+func (i *implMemoryLRU) IncrBy(key string, delta int64) (int64, error) {
+    return i.IncrByTTL(key, delta, 0)
+}
+
+func (i *implMemoryLRU) IncrByTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+    return i.IncrByTTLContext(context.Background(), key, delta, ttl)
+}
+
+func (i *implMemoryLRU) IncrByTTLContext(ctx context.Context, key string, delta int64, ttl time.Duration) (n int64, err error) {
+    _, uerr := i.update(ctx, key, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok {
+            n = delta
+            return utils.CombineData(ttl, store.FormatCounter(n)), true
+        }
+        if n, err = store.AddCounter(utils.ValueOf(data), delta); err != nil {
+            return nil, false
+        }
+        return utils.ReplaceValue(data, store.FormatCounter(n)), true
+    })
+    if uerr != nil {
+        return 0, uerr
+    }
+    return
+}
+
+// deleteExpired 删除仍然过期的 key, 期间被重新写入的 key 会保留
+func (i *implMemoryLRU) deleteExpired(key string) bool {
+    unlock := i.locks.Lock(key)
+    removed := false
+    if p, ok := i.m.Peek(key); ok {
+        if utils.IsExpired(p.([]byte)) {
+            removed = i.remove(key, store.EventExpire)
+        }
+    }
+    unlock()
+    if removed {
+        i.hooks.Fire(store.HookExpire, key)
+    }
+    return removed
+}
+
+// SweepExpired 按 key 升序从 cursor 开始检查最多 budget 个 key, 检查不会改变 LRU 顺序
+func (i *implMemoryLRU) SweepExpired(ctx context.Context, cursor string, budget int) (removed int, next string, err error) {
+    if err = i.check(ctx); err != nil {
+        return
+    }
+    if budget <= 0 {
+        budget = store.DefaultSweepBudget
+    }
+    var keys []string
+    for _, k := range i.m.Keys() {
+        if key := k.(string); key >= cursor {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    if len(keys) > budget {
+        next = keys[budget-1] + "\x00"
+        keys = keys[:budget]
+    }
+    for _, key := range keys {
+        if err = ctx.Err(); err != nil {
+            return removed, "", err
+        }
+        if i.deleteExpired(key) {
+            removed++
+        }
+    }
+    return
+}
+
+func (i *implMemoryLRU) Expire(key string, ttl time.Duration) error {
+    return i.ExpireContext(context.Background(), key, ttl)
+}
+
+func (i *implMemoryLRU) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+    return i.ExpireAtContext(ctx, key, utils.GetTimeNow().Add(ttl))
+}
+
+func (i *implMemoryLRU) ExpireAt(key string, at time.Time) error {
+    return i.ExpireAtContext(context.Background(), key, at)
+}
+
+// ExpireAtContext 持有 key 锁原地改写数据头, 不改变 LRU 顺序
+func (i *implMemoryLRU) ExpireAtContext(ctx context.Context, key string, at time.Time) error {
+    if err := i.check(ctx); err != nil {
+        return err
+    }
+    var deleted []string
+    defer func() {
+        i.hooks.Fire(store.HookDelete, deleted...)
+    }()
+    defer i.locks.Lock(key)()
+    p, ok := i.m.Peek(key)
+    if !ok {
+        return store.ErrNotFound
+    }
+    _, expired, err := utils.ReadData(p.([]byte))
+    if err != nil {
+        return err
+    }
+    if expired {
+        return store.ErrNotFound
+    }
+    data := utils.SetExpireAt(p.([]byte), at)
+    if data == nil {
+        if i.remove(key, store.EventDelete) {
+            deleted = append(deleted, key)
+        }
+        return nil
+    }
+    if !i.m.Replace(key, data) {
+        return store.ErrNotFound
+    }
+    i.watch.Publish(store.EventPut, key, int64(len(utils.ValueOf(data))))
+    return nil
+}
+
+func (i *implMemoryLRU) Persist(key string) error {
+    return i.PersistContext(context.Background(), key)
+}
+
+func (i *implMemoryLRU) PersistContext(ctx context.Context, key string) error {
+    return i.ExpireAtContext(ctx, key, time.Time{})
+}
+
+func (i *implMemoryLRU) Touch(key string) error {
+    return i.TouchContext(context.Background(), key)
+}
+
+// TouchContext 把 key 移到 LRU 的最前面
+func (i *implMemoryLRU) TouchContext(ctx context.Context, key string) error {
+    if err := i.check(ctx); err != nil {
+        return err
+    }
+    p, ok := i.m.Get(key)
+    if !ok {
+        return store.ErrNotFound
+    }
+    _, expired, err := utils.ReadData(p.([]byte))
+    if err == nil && expired {
+        err = store.ErrExpired
+    }
+    return err
+}
+
+func (i *implMemoryLRU) OnExpire(fn func(key string)) {
+    i.hooks.Add(store.HookExpire, fn)
+}
+
+func (i *implMemoryLRU) OnDelete(fn func(key string)) {
+    i.hooks.Add(store.HookDelete, fn)
+}
+
+// OnEvict 只在写入超出容量时触发, 不包括删除和过期
+func (i *implMemoryLRU) OnEvict(fn func(key string)) {
+    i.hooks.Add(store.HookEvict, fn)
+}
+
+// Watch 写入在 key 锁内发布, 同一个 key 的事件顺序与生效顺序一致; 淘汰发布为 EventEvict
+func (i *implMemoryLRU) Watch(ctx context.Context, prefix string) <-chan store.Event {
+    return i.watch.Watch(ctx, prefix)
+}
+
+// StartSweeper 启动后台过期清理, Close 时停止
+func (i *implMemoryLRU) StartSweeper(opts store.SweeperOptions) *store.Sweeper {
+    return i.sweeper.Start(i, opts)
+}
+
+// New cb 在未过期的 key 被移除时调用, 包括删除和淘汰, 可以为 nil; 只关心淘汰时使用 OnEvict
 func New(size int, cb func(key string, value []byte)) store.Store {
     m := &implMemoryLRU{
+        locks: utils.NewKeyLock(),
         m: utils.NewLRU(size, func(key interface{}, value interface{}) {
+            if cb == nil {
+                return
+            }
             k := key.(string)
             v := value.([]byte)
             if ok, _, data := utils.SplitData(v); ok {
@@ -155,4 +533,25 @@ func New(size int, cb func(key string, value []byte)) store.Store {
     return m
 }
 
+// init 注册 lru://?size=1000, size 默认为 utils.DefaultEvictedBufferSize
+func init() {
+    store.Register("lru", func(u *url.URL) (store.Store, error) {
+        size := utils.DefaultEvictedBufferSize
+        if v := u.Query().Get("size"); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil {
+                return nil, err
+            }
+            size = n
+        }
+        return New(size, nil), nil
+    })
+}
+
 var _ = New
+var _ store.CASStore = &implMemoryLRU{}
+var _ store.CounterStore = &implMemoryLRU{}
+var _ store.SweeperStore = &implMemoryLRU{}
+var _ store.ExpireStore = &implMemoryLRU{}
+var _ store.HookStore = &implMemoryLRU{}
+var _ store.WatchStore = &implMemoryLRU{}
@@ -3,6 +3,7 @@ package StoreS3
 import (
     "bytes"
     "context"
+    "fmt"
     "github.com/DGHeroin/store"
     "github.com/DGHeroin/store/utils"
     "github.com/minio/minio-go/v7"
@@ -10,7 +11,10 @@ import (
     "io"
     "io/ioutil"
     "math"
+    "net/http"
+    "net/url"
     "os"
+    "strconv"
     "strings"
     "time"
 )
@@ -19,30 +23,112 @@ type (
     s3Impl struct {
         bucketName string
         client     *minio.Client
+        locks      *utils.KeyLock
+        sweeper    *store.SweeperSlot
+        hooks      *store.Hooks
+    }
+    // condition 随 ctx 传给 conditionalTransport 的条件请求头
+    condition struct {
+        match     string
+        noneMatch bool
+    }
+    conditionKey struct{}
+    // conditionalTransport 当前使用的 minio-go 不能为 PUT/DELETE 设置 If-Match, 在发送前补上请求头
+    conditionalTransport struct {
+        http.RoundTripper
     }
 )
 
 func (s s3Impl) Close() error {
+    s.sweeper.Stop()
     return nil
 }
 
-func (s s3Impl) TTL(_ string) (time.Duration, error) {
-    return 0, nil
+func wrapError(err error) error {
+    if err == nil {
+        return nil
+    }
+    switch minio.ToErrorResponse(err).Code {
+    case "NoSuchKey":
+        return store.ErrNotFound
+    case "EntityTooLarge":
+        return store.ErrTooLarge
+    }
+    return err
+}
+
+// isPreconditionFailed 条件请求未满足; 并发的条件写入冲突时 AWS 返回 409 ConditionalRequestConflict
+func isPreconditionFailed(err error) bool {
+    switch minio.ToErrorResponse(err).Code {
+    case "PreconditionFailed", "ConditionalRequestConflict":
+        return true
+    }
+    return false
+}
+
+func (t conditionalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    cond, ok := req.Context().Value(conditionKey{}).(condition)
+    if !ok || (req.Method != http.MethodPut && req.Method != http.MethodDelete) {
+        return t.RoundTripper.RoundTrip(req)
+    }
+    req = req.Clone(req.Context())
+    if cond.match != "" {
+        req.Header.Set("If-Match", `"`+cond.match+`"`)
+    }
+    if cond.noneMatch {
+        req.Header.Set("If-None-Match", "*")
+    }
+    return t.RoundTripper.RoundTrip(req)
+}
+
+func (s s3Impl) TTL(key string) (time.Duration, error) {
+    return s.TTLContext(context.Background(), key)
 }
 
-func (s s3Impl) RangeKeys(prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
-    ch := s.client.ListObjects(context.Background(), s.bucketName, minio.ListObjectsOptions{
-        Prefix:    prefix,
-        Recursive: true,
-        MaxKeys:   max,
+// TTLContext 过期时间保存在对象的 user-metadata 中
+func (s s3Impl) TTLContext(ctx context.Context, key string) (time.Duration, error) {
+    info, err := s.client.StatObject(ctx, s.bucketName, key, minio.StatObjectOptions{})
+    if err != nil {
+        return 0, wrapError(err)
+    }
+    at := expireAtOf(info)
+    if at.IsZero() {
+        return 0, nil
+    }
+    left := at.Sub(utils.GetTimeNow())
+    if left <= 0 {
+        return 0, store.ErrExpired
+    }
+    return left, nil
+}
+
+func (s s3Impl) RangeKeys(prefix, limit string, max int) (store.KeysInfoSlice, error) {
+    return s.RangeKeysContext(context.Background(), prefix, limit, max)
+}
+
+func (s s3Impl) RangeKeysContext(ctx context.Context, prefix, limit string, max int) (result store.KeysInfoSlice, err error) {
+    ch := s.client.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{
+        Prefix:       prefix,
+        Recursive:    true,
+        MaxKeys:      max,
+        WithMetadata: true,
     })
     var keys []string
     var mm = map[string]store.KeysInfo{}
     for info := range ch {
+        if info.Err != nil {
+            err = wrapError(info.Err)
+            return
+        }
         key := info.Key
         if strings.HasSuffix(key, "/") {
             continue
         }
+        if expired, err := s.listedExpired(ctx, info); err != nil {
+            return nil, err
+        } else if expired {
+            continue
+        }
         keys = append(keys, key)
         mm[key] = store.KeysInfo{
             Key:  key,
@@ -60,7 +146,11 @@ func (s s3Impl) RangeKeys(prefix, limit string, max int) (result store.KeysInfoS
 }
 
 func (s s3Impl) Range(prefix, limit string, cb func(key string, value []byte) bool) error {
-    return s.RRange(prefix, limit, func(key string, r io.Reader) bool {
+    return s.RangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (s s3Impl) RangeContext(ctx context.Context, prefix, limit string, cb func(key string, value []byte) bool) error {
+    return s.RRangeContext(ctx, prefix, limit, func(key string, r io.Reader) bool {
         if data, err := ioutil.ReadAll(r); err == nil {
             return cb(key, data)
         }
@@ -69,86 +159,501 @@ func (s s3Impl) Range(prefix, limit string, cb func(key string, value []byte) bo
 }
 
 func (s s3Impl) RRange(prefix, limit string, cb func(key string, r io.Reader) bool) error {
-    arr, err := s.RangeKeys(prefix, limit, math.MaxInt64)
+    return s.RRangeContext(context.Background(), prefix, limit, cb)
+}
+
+func (s s3Impl) RRangeContext(ctx context.Context, prefix, limit string, cb func(key string, r io.Reader) bool) error {
+    arr, err := s.RangeKeysContext(ctx, prefix, limit, math.MaxInt64)
     if err != nil {
         return err
     }
     for _, info := range arr {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
         key := info.Key
-        if r, err := s.RGet(key); err == nil {
-            if !cb(key, r) {
-                return nil
-            }
+        r, err := s.RGetContext(ctx, key)
+        if store.IsNotFound(err) {
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        if !cb(key, r) {
+            return nil
         }
     }
-    return nil
+    return ctx.Err()
 }
 
 func (s s3Impl) RPut(key string, r io.Reader, size int64) error {
     return s.RPutTTL(key, r, size, 0)
 }
 
-func (s s3Impl) RPutTTL(key string, r io.Reader, size int64, _ time.Duration) error {
-    _, err := s.client.PutObject(context.Background(), s.bucketName, key, r, size, minio.PutObjectOptions{})
-    return err
+func (s s3Impl) RPutTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+    return s.RPutTTLContext(context.Background(), key, r, size, ttl)
+}
+
+func (s s3Impl) RPutTTLContext(ctx context.Context, key string, r io.Reader, size int64, ttl time.Duration) error {
+    defer s.locks.Lock(key)()
+    _, err := s.client.PutObject(ctx, s.bucketName, key, r, size, putOptions(ttl))
+    return wrapError(err)
 }
 
 func (s s3Impl) RGet(key string) (io.Reader, error) {
-    return s.client.GetObject(context.Background(), s.bucketName, key, minio.GetObjectOptions{})
+    return s.RGetContext(context.Background(), key)
+}
+
+func (s s3Impl) RGetContext(ctx context.Context, key string) (io.Reader, error) {
+    obj, err := s.client.GetObject(ctx, s.bucketName, key, minio.GetObjectOptions{})
+    if err != nil {
+        return nil, wrapError(err)
+    }
+    info, err := obj.Stat()
+    if err == nil && isExpired(info) {
+        err = store.ErrExpired
+    }
+    if err != nil {
+        _ = obj.Close()
+        return nil, wrapError(err)
+    }
+    return obj, nil
 }
 
 func (s s3Impl) Put(key string, value []byte) error {
     return s.PutTTL(key, value, 0)
 }
 
-func (s s3Impl) PutTTL(key string, value []byte, _ time.Duration) error {
-    return s.RPutTTL(key, bytes.NewBuffer(value), int64(len(value)), 0)
+func (s s3Impl) PutContext(ctx context.Context, key string, value []byte) error {
+    return s.PutTTLContext(ctx, key, value, 0)
+}
+
+func (s s3Impl) PutTTL(key string, value []byte, ttl time.Duration) error {
+    return s.PutTTLContext(context.Background(), key, value, ttl)
+}
+
+func (s s3Impl) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    return s.RPutTTLContext(ctx, key, bytes.NewBuffer(value), int64(len(value)), ttl)
 }
 
 func (s s3Impl) Get(key string) ([]byte, error) {
-    obj, err := s.RGet(key)
+    return s.GetContext(context.Background(), key)
+}
+
+// GetContext minio-go 先 Stat 再以读到的 ETag 为条件读取, 期间对象被覆盖时返回 412, 此时重新读取
+func (s s3Impl) GetContext(ctx context.Context, key string) ([]byte, error) {
+    for {
+        data, err := s.get(ctx, key)
+        if !isPreconditionFailed(err) {
+            return data, err
+        }
+    }
+}
+
+func (s s3Impl) get(ctx context.Context, key string) ([]byte, error) {
+    obj, err := s.RGetContext(ctx, key)
     if err != nil {
         return nil, err
     }
-    return ioutil.ReadAll(obj)
+    defer obj.(io.Closer).Close()
+    data, err := ioutil.ReadAll(obj)
+    return data, wrapError(err)
 }
 
 func (s s3Impl) Exist(key string) (bool, error) {
-    obj, err := s.client.StatObject(context.Background(), s.bucketName, key, minio.StatObjectOptions{})
+    return s.ExistContext(context.Background(), key)
+}
+
+func (s s3Impl) ExistContext(ctx context.Context, key string) (bool, error) {
+    obj, err := s.client.StatObject(ctx, s.bucketName, key, minio.StatObjectOptions{})
     if err != nil {
+        if err = wrapError(err); store.IsNotFound(err) {
+            return false, nil
+        }
         return false, err
     }
-    return obj.Key != "", nil
+    return obj.Key != "" && !isExpired(obj), nil
 }
 
 func (s s3Impl) Delete(key string) error {
-    return s.client.RemoveObject(context.Background(), s.bucketName, key, minio.RemoveObjectOptions{})
+    return s.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext S3 删除不存在的对象也会成功, 注册了 OnDelete 时先用 StatObject 确认对象存在
+func (s s3Impl) DeleteContext(ctx context.Context, key string) error {
+    var deleted []string
+    defer func() { s.hooks.Fire(store.HookDelete, deleted...) }()
+    defer s.locks.Lock(key)()
+    existed := false
+    if s.hooks.Has(store.HookDelete) {
+        _, err := s.client.StatObject(ctx, s.bucketName, key, minio.StatObjectOptions{})
+        existed = err == nil
+    }
+    if err := s.client.RemoveObject(ctx, s.bucketName, key, minio.RemoveObjectOptions{}); err != nil {
+        return wrapError(err)
+    }
+    if existed {
+        deleted = append(deleted, key)
+    }
+    return nil
+}
+
+func (s s3Impl) CompareAndSwap(key string, old, new []byte) (bool, error) {
+    return s.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+func (s s3Impl) CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (bool, error) {
+    return s.update(ctx, key, 0, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(data, old) {
+            return nil, false
+        }
+        return new, true
+    })
+}
+
+func (s s3Impl) PutIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+    return s.PutIfAbsentContext(context.Background(), key, value, ttl)
+}
+
+func (s s3Impl) PutIfAbsentContext(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    return s.update(ctx, key, ttl, func(_ []byte, ok bool) ([]byte, bool) {
+        if ok {
+            return nil, false
+        }
+        return value, true
+    })
+}
+
+func (s s3Impl) DeleteIf(key string, expected []byte) (bool, error) {
+    return s.DeleteIfContext(context.Background(), key, expected)
+}
+
+func (s s3Impl) DeleteIfContext(ctx context.Context, key string, expected []byte) (bool, error) {
+    return s.update(ctx, key, 0, func(data []byte, ok bool) ([]byte, bool) {
+        if !ok || !bytes.Equal(data, expected) {
+            return nil, false
+        }
+        return nil, true
+    })
+}
+
+// update 读改写: 进程内由 key 锁串行化; 写入和删除带上读到的 ETag (If-Match),
+// 读到不存在时写入带 If-None-Match: *, 对象在此期间被其他进程修改时服务端返回 412, 视为比较失败.
+// 已过期的对象视为不存在; ttl 为 0 时保留原有的过期时间
+func (s s3Impl) update(ctx context.Context, key string, ttl time.Duration, fn func(data []byte, ok bool) ([]byte, bool)) (bool, error) {
+    var deleted []string
+    defer func() { s.hooks.Fire(store.HookDelete, deleted...) }()
+    defer s.locks.Lock(key)()
+    var (
+        data   []byte
+        etag   string
+        exists bool
+        opts   = putOptions(ttl)
+    )
+    obj, err := s.client.GetObject(ctx, s.bucketName, key, minio.GetObjectOptions{})
+    if err != nil {
+        return false, wrapError(err)
+    }
+    info, err := obj.Stat()
+    if err == nil {
+        etag = info.ETag
+        if exists = !isExpired(info); exists {
+            data, err = ioutil.ReadAll(obj)
+            if at := expireAtOf(info); ttl <= 0 && !at.IsZero() {
+                opts.UserMetadata = map[string]string{metaExpireAt: info.UserMetadata[metaExpireAt]}
+            }
+        }
+    }
+    _ = obj.Close()
+    if isPreconditionFailed(err) {
+        // 读取过程中对象被修改, minio-go 分段读取时以第一次读到的 ETag 为条件
+        return false, nil
+    }
+    if err = wrapError(err); err != nil && !store.IsNotFound(err) {
+        return false, err
+    }
+    next, changed := fn(data, exists)
+    if !changed {
+        return false, nil
+    }
+    cond := condition{match: etag}
+    if etag == "" {
+        cond.noneMatch = true
+    }
+    ctx = context.WithValue(ctx, conditionKey{}, cond)
+    if next == nil {
+        err = s.client.RemoveObject(ctx, s.bucketName, key, minio.RemoveObjectOptions{})
+    } else {
+        // 分片上传的每个请求都会带上条件, 只用单个 PUT
+        opts.DisableMultipart = true
+        _, err = s.client.PutObject(ctx, s.bucketName, key, bytes.NewReader(next), int64(len(next)), opts)
+    }
+    if err != nil {
+        if isPreconditionFailed(err) {
+            return false, nil
+        }
+        return false, wrapError(err)
+    }
+    if next == nil && etag != "" {
+        deleted = append(deleted, key)
+    }
+    return true, nil
+}
+
+func (s s3Impl) IncrBy(key string, delta int64) (int64, error) {
+    return s.IncrByTTL(key, delta, 0)
+}
+
+func (s s3Impl) IncrByTTL(key string, delta int64, ttl time.Duration) (int64, error) {
+    return s.IncrByTTLContext(context.Background(), key, delta, ttl)
+}
+
+// IncrByTTLContext S3 没有原子自增, 用条件写入重试实现; 跨进程的原子性依赖服务端支持条件 PUT
+func (s s3Impl) IncrByTTLContext(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+    return store.IncrByCAS(ctx, s, key, delta, ttl)
+}
+
+// metaExpireAt 保存过期时间 (Unix 毫秒) 的 user-metadata
+const metaExpireAt = "Store-Expire-At"
+
+// expireAtOf 对象的过期时间, 没有过期时间时返回零值
+func expireAtOf(info minio.ObjectInfo) time.Time {
+    ms, err := strconv.ParseInt(info.UserMetadata[metaExpireAt], 10, 64)
+    if err != nil || ms <= 0 {
+        return time.Time{}
+    }
+    return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// isExpired 对象是否已过期
+func isExpired(info minio.ObjectInfo) bool {
+    at := expireAtOf(info)
+    return !at.IsZero() && !at.After(utils.GetTimeNow())
+}
+
+// putOptions ttl > 0 时把过期时间写入 user-metadata
+func putOptions(ttl time.Duration) minio.PutObjectOptions {
+    if ttl <= 0 {
+        return minio.PutObjectOptions{}
+    }
+    at := utils.GetTimeNow().Add(ttl)
+    return minio.PutObjectOptions{UserMetadata: map[string]string{metaExpireAt: formatExpireAt(at)}}
+}
+
+func formatExpireAt(at time.Time) string {
+    return strconv.FormatInt((at.UnixNano()+int64(time.Millisecond)-1)/int64(time.Millisecond), 10)
+}
+
+// listedExpired 列举结果中的对象是否已过期. MinIO 列举时可以带上 user-metadata (键保留 X-Amz-Meta- 前缀),
+// 不支持的 S3 实现列举结果中没有 user-metadata, 此时逐个 StatObject
+func (s s3Impl) listedExpired(ctx context.Context, info minio.ObjectInfo) (bool, error) {
+    if info.UserMetadata == nil {
+        stat, err := s.client.StatObject(ctx, s.bucketName, info.Key, minio.StatObjectOptions{})
+        if err = wrapError(err); store.IsNotFound(err) {
+            return true, nil
+        } else if err != nil {
+            return false, err
+        }
+        return isExpired(stat), nil
+    }
+    if v, ok := info.UserMetadata[listedMetaPrefix+metaExpireAt]; ok {
+        info.UserMetadata = minio.StringMap{metaExpireAt: v}
+    }
+    return isExpired(info), nil
+}
+
+// listedMetaPrefix MinIO 列举结果中 user-metadata 的键前缀
+const listedMetaPrefix = "X-Amz-Meta-"
+
+// SweepExpired 按 key 升序从 cursor 之后列举最多 budget 个对象, 删除其中已过期的
+func (s s3Impl) SweepExpired(ctx context.Context, cursor string, budget int) (removed int, next string, err error) {
+    listCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    ch := s.client.ListObjects(listCtx, s.bucketName, minio.ListObjectsOptions{
+        Recursive:    true,
+        StartAfter:   cursor,
+        MaxKeys:      budget,
+        WithMetadata: true,
+    })
+    scanned := 0
+    for info := range ch {
+        if info.Err != nil {
+            return removed, cursor, wrapError(info.Err)
+        }
+        scanned++
+        expired, err := s.listedExpired(ctx, info)
+        if err != nil {
+            return removed, cursor, err
+        }
+        if expired {
+            ok, err := s.deleteExpired(ctx, info.Key)
+            if err != nil {
+                return removed, cursor, err
+            }
+            if ok {
+                removed++
+            }
+        }
+        if scanned >= budget {
+            return removed, info.Key, ctx.Err()
+        }
+    }
+    return removed, "", ctx.Err()
+}
+
+// deleteExpired 重新确认对象已过期后删除. 其他进程在确认之后写入的新值也会被删除
+func (s s3Impl) deleteExpired(ctx context.Context, key string) (bool, error) {
+    var expired []string
+    defer func() { s.hooks.Fire(store.HookExpire, expired...) }()
+    defer s.locks.Lock(key)()
+    info, err := s.client.StatObject(ctx, s.bucketName, key, minio.StatObjectOptions{})
+    if err = wrapError(err); store.IsNotFound(err) {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
+    if !isExpired(info) {
+        return false, nil
+    }
+    if err := s.client.RemoveObject(ctx, s.bucketName, key, minio.RemoveObjectOptions{}); err != nil {
+        return false, wrapError(err)
+    }
+    expired = append(expired, key)
+    return true, nil
+}
+
+// OnExpire 由后台清理删除过期对象时触发
+func (s s3Impl) OnExpire(fn func(key string)) {
+    s.hooks.Add(store.HookExpire, fn)
+}
+
+func (s s3Impl) OnDelete(fn func(key string)) {
+    s.hooks.Add(store.HookDelete, fn)
+}
+
+// OnEvict 没有容量限制, 不会触发
+func (s s3Impl) OnEvict(fn func(key string)) {
+    s.hooks.Add(store.HookEvict, fn)
+}
+
+// StartSweeper 启动后台清理过期对象, Close 时停止
+func (s s3Impl) StartSweeper(opts store.SweeperOptions) *store.Sweeper {
+    return s.sweeper.Start(s, opts)
+}
+
+func (s s3Impl) Expire(key string, ttl time.Duration) error {
+    return s.ExpireContext(context.Background(), key, ttl)
+}
+
+func (s s3Impl) ExpireContext(ctx context.Context, key string, ttl time.Duration) error {
+    return s.ExpireAtContext(ctx, key, utils.GetTimeNow().Add(ttl))
+}
+
+func (s s3Impl) ExpireAt(key string, at time.Time) error {
+    return s.ExpireAtContext(context.Background(), key, at)
+}
+
+// ExpireAtContext 用服务端复制把对象复制到自身并替换 user-metadata, 不需要传输 value;
+// 复制以读到的 ETag 为条件, 对象在此期间被修改时返回错误. 单次复制最大 5GiB
+func (s s3Impl) ExpireAtContext(ctx context.Context, key string, at time.Time) error {
+    var deleted []string
+    defer func() { s.hooks.Fire(store.HookDelete, deleted...) }()
+    defer s.locks.Lock(key)()
+    info, err := s.client.StatObject(ctx, s.bucketName, key, minio.StatObjectOptions{})
+    if err != nil {
+        return wrapError(err)
+    }
+    if old := expireAtOf(info); !old.IsZero() && !old.After(utils.GetTimeNow()) {
+        return store.ErrExpired
+    }
+    if !at.IsZero() && !at.After(utils.GetTimeNow()) {
+        if err := s.client.RemoveObject(ctx, s.bucketName, key, minio.RemoveObjectOptions{}); err != nil {
+            return wrapError(err)
+        }
+        deleted = append(deleted, key)
+        return nil
+    }
+    meta := make(map[string]string, len(info.UserMetadata)+1)
+    for k, v := range info.UserMetadata {
+        if k != metaExpireAt {
+            meta[k] = v
+        }
+    }
+    if !at.IsZero() {
+        meta[metaExpireAt] = formatExpireAt(at)
+    }
+    _, err = s.client.CopyObject(ctx, minio.CopyDestOptions{
+        Bucket:          s.bucketName,
+        Object:          key,
+        UserMetadata:    meta,
+        ReplaceMetadata: true,
+    }, minio.CopySrcOptions{
+        Bucket:    s.bucketName,
+        Object:    key,
+        MatchETag: info.ETag,
+    })
+    return wrapError(err)
+}
+
+func (s s3Impl) Persist(key string) error {
+    return s.PersistContext(context.Background(), key)
+}
+
+func (s s3Impl) PersistContext(ctx context.Context, key string) error {
+    return s.ExpireAtContext(ctx, key, time.Time{})
+}
+
+func (s s3Impl) Touch(key string) error {
+    return s.TouchContext(context.Background(), key)
+}
+
+// TouchContext S3 没有访问时间, 只检查对象是否存在
+func (s s3Impl) TouchContext(ctx context.Context, key string) error {
+    _, err := s.TTLContext(ctx, key)
+    return err
 }
 
 func New(bucketName, endpoint, accessKeyID, secretAccessKey string) store.Store {
+    s, err := newS3(bucketName, endpoint, accessKeyID, secretAccessKey, false)
+    if err != nil {
+        return nil
+    }
+    return s
+}
+
+// newS3 连接 endpoint, bucket 不存在时创建
+func newS3(bucketName, endpoint, accessKeyID, secretAccessKey string, secure bool) (*s3Impl, error) {
+    transport, err := minio.DefaultTransport(secure)
+    if err != nil {
+        return nil, err
+    }
     minioClient, err := minio.New(endpoint, &minio.Options{
-        Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-        Secure: false,
+        Creds:     credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
+        Secure:    secure,
+        Transport: conditionalTransport{transport},
     })
     if err != nil {
-        return nil
+        return nil, err
     }
     s := &s3Impl{
         bucketName: bucketName,
         client:     minioClient,
+        locks:      utils.NewKeyLock(),
+        sweeper:    &store.SweeperSlot{},
+        hooks:      &store.Hooks{},
     }
-    if ok, err := minioClient.BucketExists(context.Background(), bucketName); err != nil {
-        return nil
-    } else {
-        if !ok {
-            err = minioClient.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{})
-            if err != nil {
-                return nil
-            }
+    ok, err := minioClient.BucketExists(context.Background(), bucketName)
+    if err != nil {
+        return nil, err
+    }
+    if !ok {
+        if err = minioClient.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{}); err != nil {
+            return nil, err
         }
     }
-    return s
+    return s, nil
 }
+
 func FromEnv() store.Store {
     bucketName := os.Getenv("bucketName")
     endpoint := os.Getenv("endpoint")
@@ -158,4 +663,33 @@ func FromEnv() store.Store {
     return New(bucketName, endpoint, accessKeyID, secretAccessKey)
 }
 
+// init 注册 s3://key:secret@host:9000/bucket?secure=false&sweep=10m, secure 默认为 true
+func init() {
+    store.Register("s3", func(u *url.URL) (store.Store, error) {
+        bucket := strings.Trim(u.Path, "/")
+        if bucket == "" {
+            return nil, fmt.Errorf("missing bucket")
+        }
+        var accessKeyID, secretAccessKey string
+        if u.User != nil {
+            accessKeyID = u.User.Username()
+            secretAccessKey, _ = u.User.Password()
+        }
+        secure := true
+        if v := u.Query().Get("secure"); v != "" {
+            b, err := strconv.ParseBool(v)
+            if err != nil {
+                return nil, fmt.Errorf("invalid secure %q", v)
+            }
+            secure = b
+        }
+        return newS3(bucket, u.Host, accessKeyID, secretAccessKey, secure)
+    })
+}
+
 var _ = FromEnv
+var _ store.CASStore = &s3Impl{}
+var _ store.CounterStore = &s3Impl{}
+var _ store.ExpireStore = &s3Impl{}
+var _ store.SweeperStore = &s3Impl{}
+var _ store.HookStore = &s3Impl{}
@@ -0,0 +1,160 @@
+package store
+
+import (
+    "context"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// DefaultSweepBudget 每次清理默认最多检查的 key 数量
+const DefaultSweepBudget = 1000
+
+type (
+    // Sweepable 支持增量清理过期数据的后端
+    Sweepable interface {
+        // SweepExpired 从 cursor 开始最多检查 budget 个 key 并删除其中已过期的, budget <= 0 时使用 DefaultSweepBudget;
+        // 返回删除的数量和下一次的 cursor, next 为空表示已扫描到末尾
+        SweepExpired(ctx context.Context, cursor string, budget int) (removed int, next string, err error)
+    }
+    // SweeperStore 支持后台过期清理的 Store, 同一个 Store 重复 StartSweeper 会替换之前的 Sweeper,
+    // Close 时停止
+    SweeperStore interface {
+        Store
+        Sweepable
+        StartSweeper(opts SweeperOptions) *Sweeper
+    }
+    // SweeperOptions 后台过期清理配置
+    SweeperOptions struct {
+        // Interval 两次清理之间的间隔, 默认 1m
+        Interval time.Duration
+        // Budget 每次清理最多检查的 key 数量, 默认 1000
+        Budget int
+        // OnSweep 每次清理后回调, 用于上报
+        OnSweep func(removed int, err error)
+    }
+    // Sweeper 后台过期清理, 每个间隔从上次的位置继续扫描 Budget 个 key, 扫描到末尾后从头开始
+    Sweeper struct {
+        s       Sweepable
+        opts    SweeperOptions
+        mu      sync.Mutex
+        cursor  string
+        removed uint64
+        passes  uint64
+        done    chan struct{}
+        stopped chan struct{}
+        once    sync.Once
+    }
+    // SweeperSlot 后端持有的 Sweeper, 零值可用; Start 会停止并替换之前的 Sweeper
+    SweeperSlot struct {
+        mu sync.Mutex
+        sw *Sweeper
+    }
+)
+
+// NewSweeper 启动后台清理, 由后端的 StartSweeper 调用, 后端 Close 时停止
+func NewSweeper(s Sweepable, opts SweeperOptions) *Sweeper {
+    if opts.Interval <= 0 {
+        opts.Interval = time.Minute
+    }
+    if opts.Budget <= 0 {
+        opts.Budget = DefaultSweepBudget
+    }
+    sw := &Sweeper{
+        s:       s,
+        opts:    opts,
+        done:    make(chan struct{}),
+        stopped: make(chan struct{}),
+    }
+    go sw.loop()
+    return sw
+}
+
+// StartSweeper 为 s 启动后台过期清理, 不支持时返回 ErrNotSupported
+func StartSweeper(s Store, opts SweeperOptions) (*Sweeper, error) {
+    ss, ok := s.(SweeperStore)
+    if !ok {
+        return nil, ErrNotSupported
+    }
+    return ss.StartSweeper(opts), nil
+}
+
+func (sw *Sweeper) loop() {
+    defer close(sw.stopped)
+    ticker := time.NewTicker(sw.opts.Interval)
+    defer ticker.Stop()
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go func() {
+        select {
+        case <-sw.done:
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+    for {
+        select {
+        case <-sw.done:
+            return
+        case <-ticker.C:
+            removed, err := sw.SweepOnce(ctx)
+            if err == ErrClosed {
+                return
+            }
+            if sw.opts.OnSweep != nil && ctx.Err() == nil {
+                sw.opts.OnSweep(removed, err)
+            }
+        }
+    }
+}
+
+// SweepOnce 立即执行一次清理
+func (sw *Sweeper) SweepOnce(ctx context.Context) (int, error) {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+    removed, next, err := sw.s.SweepExpired(ctx, sw.cursor, sw.opts.Budget)
+    atomic.AddUint64(&sw.removed, uint64(removed))
+    atomic.AddUint64(&sw.passes, 1)
+    if err == nil {
+        sw.cursor = next
+    }
+    return removed, err
+}
+
+// Removed 累计删除的过期 key 数量
+func (sw *Sweeper) Removed() uint64 {
+    return atomic.LoadUint64(&sw.removed)
+}
+
+// Passes 累计清理次数
+func (sw *Sweeper) Passes() uint64 {
+    return atomic.LoadUint64(&sw.passes)
+}
+
+// Stop 停止后台清理并等待进行中的清理结束, 可以重复调用
+func (sw *Sweeper) Stop() {
+    if sw == nil {
+        return
+    }
+    sw.once.Do(func() {
+        close(sw.done)
+    })
+    <-sw.stopped
+}
+
+// Start 为 s 启动新的 Sweeper, 之前的 Sweeper 会被停止
+func (slot *SweeperSlot) Start(s Sweepable, opts SweeperOptions) *Sweeper {
+    slot.mu.Lock()
+    defer slot.mu.Unlock()
+    slot.sw.Stop()
+    slot.sw = NewSweeper(s, opts)
+    return slot.sw
+}
+
+// Stop 停止当前的 Sweeper, 后端 Close 时在释放资源之前调用
+func (slot *SweeperSlot) Stop() {
+    slot.mu.Lock()
+    defer slot.mu.Unlock()
+    slot.sw.Stop()
+    slot.sw = nil
+}
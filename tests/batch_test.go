@@ -0,0 +1,56 @@
+package tests
+
+import (
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "sync/atomic"
+    "testing"
+)
+
+func testBatch(t *testing.T, name string, s store.Store) {
+    tIfError(t, store.MPut(s, map[string][]byte{
+        "batch_1": {1},
+        "batch_2": {2},
+        "batch_3": {},
+    }))
+    found, err := store.MGet(s, "batch_1", "batch_2", "batch_3", "batch_missing")
+    tIfError(t, err)
+    if len(found) != 3 || found["batch_1"][0] != 1 || found["batch_2"][0] != 2 || len(found["batch_3"]) != 0 {
+        t.Errorf("%s: MGet got %v", name, found)
+    }
+    tIfError(t, store.MDelete(s, "batch_1", "batch_missing"))
+    exist, err := store.MExist(s, "batch_1", "batch_2", "batch_missing")
+    tIfError(t, err)
+    if len(exist) != 3 || exist["batch_1"] || !exist["batch_2"] || exist["batch_missing"] {
+        t.Errorf("%s: MExist got %v", name, exist)
+    }
+}
+
+func TestBatch(t *testing.T) {
+    for name, s := range openTestStores(t) {
+        testBatch(t, name, s)
+    }
+    testBatch(t, "fallback", plainStore{StoreMemory.New()})
+}
+
+func TestChainBatch(t *testing.T) {
+    front := StoreMemory.New()
+    back := &countingGetStore{Store: StoreMemory.New()}
+    c := store.NewChainWithOptions(store.ChainOptions{ReadThrough: true}, front, back)
+    defer c.Close()
+
+    tIfError(t, back.Put("key_1", []byte{1}))
+    tIfError(t, front.Put("key_2", []byte{2}))
+    found, err := c.MGet("key_1", "key_2", "key_3")
+    tIfError(t, err)
+    if len(found) != 2 || found["key_1"][0] != 1 || found["key_2"][0] != 2 {
+        t.Error("MGet got", found)
+    }
+    // 最后一层只查询第一层未命中的 key_1 和 key_3
+    if gets := atomic.LoadInt32(&back.gets); gets != 2 {
+        t.Error("deep tier queried for front hits, gets:", gets)
+    }
+    if data, err := front.Get("key_1"); err != nil || data[0] != 1 {
+        t.Error("batch miss not promoted:", data, err)
+    }
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "strconv"
+    "sync"
+    "testing"
+)
+
+func testCAS(t *testing.T, name string, s store.Store) {
+    if ok, err := store.PutIfAbsent(s, "cas", []byte("a"), 0); !ok || err != nil {
+        t.Errorf("%s: PutIfAbsent new key got %v, %v", name, ok, err)
+    }
+    if ok, err := store.PutIfAbsent(s, "cas", []byte("b"), 0); ok || err != nil {
+        t.Errorf("%s: PutIfAbsent existing key got %v, %v", name, ok, err)
+    }
+    if ok, err := store.CompareAndSwap(s, "cas", []byte("x"), []byte("b")); ok || err != nil {
+        t.Errorf("%s: CompareAndSwap mismatch got %v, %v", name, ok, err)
+    }
+    if ok, err := store.CompareAndSwap(s, "cas", []byte("a"), []byte("b")); !ok || err != nil {
+        t.Errorf("%s: CompareAndSwap match got %v, %v", name, ok, err)
+    }
+    if data, err := s.Get("cas"); err != nil || string(data) != "b" {
+        t.Errorf("%s: Get after CompareAndSwap got %q, %v", name, data, err)
+    }
+    if ok, err := store.CompareAndSwap(s, "cas_missing", nil, []byte("b")); ok || err != nil {
+        t.Errorf("%s: CompareAndSwap missing key got %v, %v", name, ok, err)
+    }
+    if ok, err := store.DeleteIf(s, "cas", []byte("a")); ok || err != nil {
+        t.Errorf("%s: DeleteIf mismatch got %v, %v", name, ok, err)
+    }
+    if ok, err := store.DeleteIf(s, "cas", []byte("b")); !ok || err != nil {
+        t.Errorf("%s: DeleteIf match got %v, %v", name, ok, err)
+    }
+    if ok, _ := s.Exist("cas"); ok {
+        t.Errorf("%s: key exists after DeleteIf", name)
+    }
+
+    // 并发用 CompareAndSwap 自增, 不应丢失更新
+    tIfError(t, s.Put("cas_counter", []byte("0")))
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 20; {
+                old, err := s.Get("cas_counter")
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                n, _ := strconv.Atoi(string(old))
+                ok, err := store.CompareAndSwap(s, "cas_counter", old, []byte(strconv.Itoa(n+1)))
+                if err != nil {
+                    t.Error(err)
+                    return
+                }
+                if ok {
+                    j++
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    if data, _ := s.Get("cas_counter"); string(data) != "160" {
+        t.Errorf("%s: counter lost updates: %s", name, data)
+    }
+}
+
+func TestCAS(t *testing.T) {
+    for name, s := range openTestStores(t) {
+        testCAS(t, name, s)
+    }
+    if _, err := store.CompareAndSwap(plainStore{StoreMemory.New()}, "key", nil, nil); !errors.Is(err, store.ErrNotSupported) {
+        t.Error("CompareAndSwap on plain store:", err)
+    }
+}
@@ -0,0 +1,128 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+type downStore struct {
+    store.Store
+    down  int32
+    calls int32
+}
+
+func (s *downStore) fail() error {
+    atomic.AddInt32(&s.calls, 1)
+    if atomic.LoadInt32(&s.down) == 1 {
+        return errors.New("tier down")
+    }
+    return nil
+}
+
+func (s *downStore) Get(key string) ([]byte, error) {
+    if err := s.fail(); err != nil {
+        return nil, err
+    }
+    return s.Store.Get(key)
+}
+
+func (s *downStore) PutTTL(key string, value []byte, ttl time.Duration) error {
+    if err := s.fail(); err != nil {
+        return err
+    }
+    return s.Store.PutTTL(key, value, ttl)
+}
+
+func (s *downStore) Delete(key string) error {
+    if err := s.fail(); err != nil {
+        return err
+    }
+    return s.Store.Delete(key)
+}
+
+func TestChainHealth(t *testing.T) {
+    front := &downStore{Store: StoreMemory.New()}
+    back := StoreMemory.New()
+    c := store.NewChainWithOptions(store.ChainOptions{
+        Health: &store.HealthOptions{
+            FailureThreshold: 2,
+            Cooldown:         time.Millisecond * 200,
+        },
+    }, front, back)
+    defer c.Close()
+
+    tIfError(t, c.Put("key_1", []byte{1}))
+    atomic.StoreInt32(&front.down, 1)
+
+    // 前面的层故障时写入和读取都不受影响
+    tIfError(t, c.Put("key_1", []byte{2}))
+    tIfError(t, c.Put("key_2", []byte{2}))
+    if data, err := c.Get("key_1"); err != nil || data[0] != 2 {
+        t.Error("read with front tier down:", data, err)
+    }
+    if st := c.TierStatus(); st[0].State != store.TierBypassed || st[0].DirtyKeys != 2 {
+        t.Error("front tier not bypassed:", st[0])
+    }
+    calls := atomic.LoadInt32(&front.calls)
+    for i := 0; i < 10; i++ {
+        _, _ = c.Get("key_3")
+    }
+    if n := atomic.LoadInt32(&front.calls); n != calls {
+        t.Error("bypassed tier still called:", n-calls)
+    }
+
+    // 冷却后探测成功恢复, 写入失败期间的旧值不会被读到
+    atomic.StoreInt32(&front.down, 0)
+    time.Sleep(time.Millisecond * 300)
+    if data, err := c.Get("key_1"); err != nil || data[0] != 2 {
+        t.Error("stale value read after recovery:", data, err)
+    }
+    _, _ = c.Get("key_3")
+    if st := c.TierStatus(); st[0].State != store.TierHealthy {
+        t.Error("front tier not recovered:", st[0])
+    }
+    for i := 0; i < 100 && c.TierStatus()[0].DirtyKeys != 0; i++ {
+        time.Sleep(time.Millisecond * 10)
+    }
+    if ok, _ := front.Store.Exist("key_1"); ok {
+        t.Error("stale value not purged from front tier")
+    }
+
+    // 最后一层失败仍然返回错误
+    tIfError(t, back.Close())
+    if err := c.Put("key_4", []byte{4}); err == nil {
+        t.Error("put should fail when the last tier fails")
+    }
+}
+
+// hangStore 写入阻塞到 ctx 结束
+type hangStore struct {
+    store.ContextStore
+}
+
+func (s hangStore) PutTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    <-ctx.Done()
+    return ctx.Err()
+}
+
+func TestChainHealthCallerContext(t *testing.T) {
+    c := store.NewChainWithOptions(store.ChainOptions{
+        Health: &store.HealthOptions{FailureThreshold: 1},
+    }, hangStore{StoreMemory.New().(store.ContextStore)}, StoreMemory.New())
+    defer c.Close()
+
+    // 调用方的 ctx 结束时前面的层返回的错误原样返回, 不计入该层的失败
+    ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+    defer cancel()
+    if err := c.PutContext(ctx, "key", []byte{1}); !errors.Is(err, context.DeadlineExceeded) {
+        t.Error("put with expired ctx got", err)
+    }
+    if st := c.TierStatus()[0]; st.State != store.TierHealthy || st.Failures != 0 {
+        t.Error("caller ctx counted against the front tier:", st)
+    }
+}
@@ -0,0 +1,110 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "testing"
+    "time"
+)
+
+type failingBus struct {
+    store.InvalidationBus
+}
+
+func (failingBus) Publish(context.Context, store.Invalidation) error {
+    return errors.New("bus down")
+}
+
+func TestChainInvalidation(t *testing.T) {
+    bus := store.NewMemoryBus()
+    shared := StoreMemory.New()
+    opts := store.ChainOptions{
+        ReadThrough:  true,
+        Invalidation: &store.InvalidationOptions{Bus: bus},
+    }
+    front1, front2 := StoreMemory.New(), StoreMemory.New()
+    c1 := store.NewChainWithOptions(opts, front1, shared)
+    c2 := store.NewChainWithOptions(opts, front2, shared)
+
+    cached := func(s store.Store, key string) bool {
+        ok, err := s.Exist(key)
+        tIfError(t, err)
+        return ok
+    }
+
+    tIfError(t, c1.Put("k", []byte("v1")))
+    if data, err := c2.Get("k"); err != nil || string(data) != "v1" {
+        t.Fatal("c2 get:", string(data), err)
+    }
+    if !cached(front2, "k") {
+        t.Fatal("c2 did not promote")
+    }
+    tIfError(t, c1.Put("k", []byte("v2")))
+    if cached(front2, "k") {
+        t.Error("Put did not invalidate the other front tier")
+    }
+    if !cached(front1, "k") {
+        t.Error("writer invalidated its own front tier")
+    }
+    if data, err := c2.Get("k"); err != nil || string(data) != "v2" {
+        t.Error("c2 get after invalidation:", string(data), err)
+    }
+
+    tIfError(t, c1.Delete("k"))
+    if cached(front2, "k") {
+        t.Error("Delete did not invalidate the other front tier")
+    }
+
+    tIfError(t, c1.MPut(map[string][]byte{"a": []byte("1"), "b": []byte("2")}))
+    for _, key := range []string{"a", "b"} {
+        if _, err := c2.Get(key); err != nil {
+            t.Fatal(err)
+        }
+    }
+    _, err := c1.IncrBy("a", 1)
+    tIfError(t, err)
+    tIfError(t, c1.MDelete("b"))
+    if cached(front2, "a") || cached(front2, "b") {
+        t.Error("IncrBy or MDelete did not invalidate the other front tier")
+    }
+
+    // 异步写在刷新到最后一层之后才广播
+    c3 := store.NewChainWithOptions(store.ChainOptions{
+        WriteBack:    &store.WriteBackOptions{FlushInterval: time.Hour},
+        Invalidation: &store.InvalidationOptions{Bus: bus},
+    }, StoreMemory.New(), shared)
+    if _, err := c2.Get("a"); err != nil {
+        t.Fatal(err)
+    }
+    tIfError(t, c3.Put("a", []byte("3")))
+    if !cached(front2, "a") {
+        t.Error("write-back invalidated before flush")
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+    defer cancel()
+    tIfError(t, c3.Flush(ctx))
+    if cached(front2, "a") {
+        t.Error("write-back flush did not invalidate the other front tier")
+    }
+
+    // 广播失败不影响写入
+    var failed []string
+    c4 := store.NewChainWithOptions(store.ChainOptions{
+        Invalidation: &store.InvalidationOptions{
+            Bus: failingBus{bus},
+            OnError: func(keys []string, err error) {
+                failed = append(failed, keys...)
+            },
+        },
+    }, StoreMemory.New(), StoreMemory.New())
+    tIfError(t, c4.Put("x", []byte{1}))
+    if len(failed) != 1 || failed[0] != "x" {
+        t.Error("OnError keys:", failed)
+    }
+    tIfError(t, c4.Close())
+    for _, c := range []*store.Chain{c1, c2, c3} {
+        tIfError(t, c.Close())
+    }
+}
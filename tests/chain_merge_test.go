@@ -0,0 +1,160 @@
+package tests
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreBoltDB"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "go.etcd.io/bbolt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestChainMergedRange(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    db, err := bbolt.Open(path.Join(tmpDir, "db0"), os.ModePerm, bbolt.DefaultOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    front, back := StoreMemory.New(), StoreBoltDB.New(db)
+    tIfError(t, front.Put("key_1", []byte("A")))
+    tIfError(t, front.Put("key_3", []byte("C")))
+    tIfError(t, back.Put("key_1", []byte("X")))
+    tIfError(t, back.Put("key_2", []byte("B")))
+    tIfError(t, back.Put("key_4", []byte("D")))
+
+    c := store.NewChainWithOptions(store.ChainOptions{
+        WriteBack: &store.WriteBackOptions{FlushInterval: time.Hour},
+    }, front, back)
+    defer c.Close()
+
+    var got []string
+    tIfError(t, c.Range("key_", "", func(key string, value []byte) bool {
+        got = append(got, key+"="+string(value))
+        return true
+    }))
+    want := []string{"key_1=A", "key_2=B", "key_3=C", "key_4=D"}
+    if !reflect.DeepEqual(got, want) {
+        t.Error("Range:", got)
+    }
+
+    got = nil
+    tIfError(t, c.Range("key_", "", func(key string, value []byte) bool {
+        got = append(got, key)
+        return len(got) < 2
+    }))
+    if !reflect.DeepEqual(got, []string{"key_1", "key_2"}) {
+        t.Error("Range early termination:", got)
+    }
+
+    tIfError(t, c.Delete("key_2"))
+    infos, err := c.RangeKeys("key_", "", 3)
+    tIfError(t, err)
+    if keys := infos.ToKeys(); !reflect.DeepEqual(keys, []string{"key_1", "key_3", "key_4"}) {
+        t.Error("RangeKeys:", keys)
+    }
+}
+
+func TestChainRangeBoltValues(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    db, err := bbolt.Open(path.Join(tmpDir, "db0"), os.ModePerm, &bbolt.Options{NoSync: true, InitialMmapSize: 1 << 24})
+    if err != nil {
+        t.Fatal(err)
+    }
+    front, back := StoreMemory.New(), StoreBoltDB.New(db)
+    c := store.NewChain(front, back)
+    defer c.Close()
+
+    // key_b 只在 bolt 中, 合并在回调 key_a 时已经取出 key_b, bolt 的读事务随后结束;
+    // 回调中改写 key_b 使旧的页被复用, 合并中暂存的值不能指向这些页
+    value := strings.Repeat("b", 1024)
+    for _, rr := range []bool{false, true} {
+        tIfError(t, front.Put("key_a", []byte("a")))
+        tIfError(t, front.Put("key_c", []byte("c")))
+        tIfError(t, back.Put("key_b", []byte(value)))
+        var got []string
+        cb := func(key string, data []byte) bool {
+            got = append(got, key)
+            if key == "key_b" && string(data) != value {
+                t.Errorf("range (rrange=%v) key_b got %.16q...", rr, data)
+            }
+            if key == "key_a" {
+                // 等待 bolt 的读事务结束
+                time.Sleep(time.Millisecond * 50)
+                for i := 0; i < 8; i++ {
+                    tIfError(t, back.Put("key_b", bytes.Repeat([]byte("Z"), len(value))))
+                }
+            }
+            return true
+        }
+        if rr {
+            tIfError(t, c.RRange("key_", "", func(key string, r io.Reader) bool {
+                data, err := ioutil.ReadAll(r)
+                tIfError(t, err)
+                return cb(key, data)
+            }))
+        } else {
+            tIfError(t, c.Range("key_", "", cb))
+        }
+        if !reflect.DeepEqual(got, []string{"key_a", "key_b", "key_c"}) {
+            t.Errorf("range (rrange=%v) got %v", rr, got)
+        }
+    }
+}
+
+func TestChainRangeWriteInCallback(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    db, err := bbolt.Open(path.Join(tmpDir, "db0"), os.ModePerm, &bbolt.Options{NoSync: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    front, back := StoreMemory.New(), StoreBoltDB.New(db)
+    c := store.NewChain(front, back)
+    defer c.Close()
+
+    // 超过一页, 覆盖翻页
+    var want []string
+    for i := 0; i < 600; i++ {
+        key := fmt.Sprintf("key_%04d", i)
+        want = append(want, key)
+        if i%2 == 0 {
+            tIfError(t, front.Put(key, []byte("v")))
+        } else {
+            tIfError(t, back.Put(key, []byte("v")))
+        }
+    }
+    value := strings.Repeat("x", 4096)
+    for _, rr := range []bool{false, true} {
+        var got []string
+        cb := func(key string) bool {
+            got = append(got, key)
+            // 回调中经由存储链写入, bolt 扩容需要等待所有读事务结束
+            tIfError(t, c.Put(fmt.Sprintf("a_%v_%s", rr, key), []byte(value)))
+            return true
+        }
+        done := make(chan error, 1)
+        go func() {
+            if rr {
+                done <- c.RRange("key_", "", func(key string, r io.Reader) bool { return cb(key) })
+            } else {
+                done <- c.Range("key_", "", func(key string, value []byte) bool { return cb(key) })
+            }
+        }()
+        select {
+        case err := <-done:
+            tIfError(t, err)
+        case <-time.After(time.Second * 10):
+            t.Fatalf("range (rrange=%v) deadlocked", rr)
+        }
+        if !reflect.DeepEqual(got, want) {
+            t.Errorf("range (rrange=%v) got %d keys", rr, len(got))
+        }
+    }
+}
@@ -0,0 +1,54 @@
+package tests
+
+import (
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+type countingGetStore struct {
+    store.Store
+    gets int32
+}
+
+func (s *countingGetStore) Get(key string) ([]byte, error) {
+    atomic.AddInt32(&s.gets, 1)
+    return s.Store.Get(key)
+}
+
+func TestChainNegativeCache(t *testing.T) {
+    back := &countingGetStore{Store: StoreMemory.New()}
+    c := store.NewChainWithOptions(store.ChainOptions{
+        NegativeTTL: time.Minute,
+    }, StoreMemory.New(), back)
+    defer c.Close()
+
+    for i := 0; i < 3; i++ {
+        if _, err := c.Get("missing"); !errors.Is(err, store.ErrNotFound) {
+            t.Error("Get missing:", err)
+        }
+    }
+    if ok, err := c.Exist("missing"); ok || err != nil {
+        t.Error("Exist missing:", ok, err)
+    }
+    if gets := atomic.LoadInt32(&back.gets); gets != 1 {
+        t.Error("miss not cached, deep tier gets:", gets)
+    }
+
+    tIfError(t, c.Put("missing", []byte{1}))
+    if data, err := c.Get("missing"); err != nil || len(data) != 1 {
+        t.Error("Put did not invalidate cached miss:", data, err)
+    }
+    tIfError(t, c.Delete("missing"))
+    if _, err := c.Get("missing"); !errors.Is(err, store.ErrNotFound) {
+        t.Error("Get after Delete:", err)
+    }
+    infos, err := c.RangeKeys("", "", 10)
+    tIfError(t, err)
+    if len(infos) != 0 {
+        t.Error("cached miss visible in RangeKeys:", infos.ToKeys())
+    }
+}
@@ -0,0 +1,46 @@
+package tests
+
+import (
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "io/ioutil"
+    "testing"
+    "time"
+)
+
+func TestChainReadThrough(t *testing.T) {
+    front, middle, back := StoreMemory.New(), StoreMemory.New(), StoreMemory.New()
+    c := store.NewChainWithOptions(store.ChainOptions{
+        ReadThrough: true,
+        Tiers:       []store.TierOptions{{MaxValueSize: 2}},
+    }, front, middle, back)
+
+    tIfError(t, back.PutTTL("small", []byte{1}, time.Second*10))
+    tIfError(t, back.Put("large", []byte{1, 2, 3}))
+
+    if data, err := c.Get("small"); err != nil || len(data) != 1 {
+        t.Fatal("chain get:", data, err)
+    }
+    for _, s := range []store.Store{front, middle} {
+        ttl, err := s.TTL("small")
+        if err != nil || ttl <= 0 || ttl > time.Second*10 {
+            t.Error("promoted ttl:", ttl, err)
+        }
+    }
+
+    r, err := c.RGet("large")
+    tIfError(t, err)
+    if data, _ := ioutil.ReadAll(r); len(data) != 3 {
+        t.Error("chain rget:", data)
+    }
+    if _, err := front.Get("large"); !errors.Is(err, store.ErrNotFound) {
+        t.Error("large value promoted into size limited tier:", err)
+    }
+    if data, err := middle.Get("large"); err != nil || len(data) != 3 {
+        t.Error("large value not promoted:", data, err)
+    }
+    if ttl, err := middle.TTL("large"); err != nil || ttl != 0 {
+        t.Error("promoted persistent value got ttl:", ttl, err)
+    }
+}
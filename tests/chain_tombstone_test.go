@@ -0,0 +1,178 @@
+package tests
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "github.com/DGHeroin/store/utils"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+type flakyDeleteStore struct {
+    store.Store
+    down int32
+}
+
+func (s *flakyDeleteStore) Delete(key string) error {
+    if atomic.LoadInt32(&s.down) == 1 {
+        return errors.New("tier unavailable")
+    }
+    return s.Store.Delete(key)
+}
+
+func TestChainTombstone(t *testing.T) {
+    front := StoreMemory.New()
+    back := &flakyDeleteStore{Store: StoreMemory.New(), down: 1}
+    c := store.NewChainWithOptions(store.ChainOptions{
+        TombstoneTTL:   time.Minute,
+        RepairInterval: time.Hour,
+    }, front, back)
+    defer c.Close()
+
+    tIfError(t, c.Put("key_1", []byte{1}))
+    tIfError(t, c.Put("key_2", []byte{2}))
+    tIfError(t, c.Delete("key_1"))
+    if n := c.PendingRepairs(); n != 1 {
+        t.Error("failed deep delete not queued:", n)
+    }
+    if _, err := c.Get("key_1"); !errors.Is(err, store.ErrNotFound) {
+        t.Error("deleted key resurrected by Get:", err)
+    }
+    if ok, err := c.Exist("key_1"); ok || err != nil {
+        t.Error("deleted key resurrected by Exist:", ok, err)
+    }
+    if _, err := c.RGet("key_1"); !errors.Is(err, store.ErrNotFound) {
+        t.Error("deleted key resurrected by RGet:", err)
+    }
+    infos, err := c.RangeKeys("key_", "", 10)
+    tIfError(t, err)
+    if keys := infos.ToKeys(); len(keys) != 1 || keys[0] != "key_2" {
+        t.Error("deleted key resurrected by RangeKeys:", keys)
+    }
+    tIfError(t, c.Range("key_", "", func(key string, value []byte) bool {
+        if key == "key_1" {
+            t.Error("deleted key resurrected by Range")
+        }
+        return true
+    }))
+
+    if err := c.Repair(context.Background()); err == nil {
+        t.Error("repair should fail while the tier is down")
+    }
+    atomic.StoreInt32(&back.down, 0)
+    tIfError(t, c.Repair(context.Background()))
+    if ok, _ := back.Exist("key_1"); ok || c.PendingRepairs() != 0 {
+        t.Error("repair did not delete from the deep tier")
+    }
+
+    tIfError(t, c.Put("key_1", []byte{3}))
+    if data, err := c.Get("key_1"); err != nil || data[0] != 3 {
+        t.Error("put after delete:", data, err)
+    }
+}
+
+// slowDeleteStore Delete 在 block 关闭前一直阻塞, 用来模拟缓慢的最后一层
+type slowDeleteStore struct {
+    store.Store
+    slow  int32
+    block chan struct{}
+}
+
+func (s *slowDeleteStore) Delete(key string) error {
+    if atomic.LoadInt32(&s.slow) == 1 {
+        <-s.block
+        return errors.New("tier timeout")
+    }
+    return s.Store.Delete(key)
+}
+
+// 修复访问最后一层时不阻塞其他 key 的写入; 同一个 key 的写入等待修复结束, 修复失败后不再删除新值
+func TestChainRepairNotBlocking(t *testing.T) {
+    back := &slowDeleteStore{Store: StoreMemory.New(), block: make(chan struct{})}
+    c := store.NewChainWithOptions(store.ChainOptions{
+        TombstoneTTL:   time.Minute,
+        RepairInterval: time.Hour,
+    }, StoreMemory.New(), back)
+    defer c.Close()
+
+    tIfError(t, c.Put("a", []byte{1}))
+    atomic.StoreInt32(&back.slow, 1)
+    go close(back.block)
+    tIfError(t, c.Delete("a"))
+    back.block = make(chan struct{})
+
+    repaired := make(chan error, 1)
+    go func() {
+        repaired <- c.Repair(context.Background())
+    }()
+    time.Sleep(time.Millisecond * 50)
+    put := make(chan error, 1)
+    go func() {
+        put <- c.Put("b", []byte{2})
+    }()
+    select {
+    case err := <-put:
+        tIfError(t, err)
+    case <-time.After(time.Second):
+        t.Fatal("put of another key blocked by repair")
+    }
+
+    go func() {
+        put <- c.Put("a", []byte{3})
+    }()
+    select {
+    case <-put:
+        t.Fatal("put of the same key did not wait for repair")
+    case <-time.After(time.Millisecond * 50):
+    }
+    atomic.StoreInt32(&back.slow, 0)
+    close(back.block)
+    if err := <-repaired; err == nil {
+        t.Error("repair want error")
+    }
+    tIfError(t, <-put)
+    if n := c.PendingRepairs(); n != 0 {
+        t.Error("forgotten key still pending:", n)
+    }
+    if data, err := c.Get("a"); err != nil || data[0] != 3 {
+        t.Error("put during repair got", data, err)
+    }
+}
+
+func TestChainTombstoneReserved(t *testing.T) {
+    sentinel := []byte("\x00\x00store:tombstone\x00\x00")
+    c := store.NewChainWithOptions(store.ChainOptions{TombstoneTTL: time.Minute}, StoreMemory.New(), StoreMemory.New())
+    defer c.Close()
+
+    if err := c.Put("k", sentinel); !errors.Is(err, store.ErrReservedValue) {
+        t.Error("Put sentinel:", err)
+    }
+    if err := c.MPut(map[string][]byte{"a": {1}, "k": sentinel}); !errors.Is(err, store.ErrReservedValue) {
+        t.Error("MPut sentinel:", err)
+    }
+    if err := c.RPut("k", bytes.NewReader(sentinel), -1); !errors.Is(err, store.ErrReservedValue) {
+        t.Error("RPut sentinel:", err)
+    }
+    if _, err := c.PutIfAbsent("k", sentinel, 0); !errors.Is(err, store.ErrReservedValue) {
+        t.Error("PutIfAbsent sentinel:", err)
+    }
+    if ok, err := c.Exist("a"); ok || err != nil {
+        t.Error("rejected MPut wrote other keys:", ok, err)
+    }
+
+    // 同样长度的其他值可以写入
+    value := append(utils.CopyBytes(sentinel), 'x')
+    tIfError(t, c.RPut("k", bytes.NewReader(value), int64(len(value))))
+    if data, err := c.Get("k"); err != nil || !bytes.Equal(data, value) {
+        t.Error("RPut after peek:", data, err)
+    }
+
+    // 没有删除标记的存储链不受限制
+    plain := store.NewChain(StoreMemory.New(), StoreMemory.New())
+    defer plain.Close()
+    tIfError(t, plain.Put("k", sentinel))
+}
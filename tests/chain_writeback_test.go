@@ -0,0 +1,134 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+type countingStore struct {
+    store.Store
+    puts  int32
+    fails int32
+}
+
+func (s *countingStore) PutTTL(key string, value []byte, ttl time.Duration) error {
+    if atomic.AddInt32(&s.fails, -1) >= 0 {
+        return errors.New("tier unavailable")
+    }
+    atomic.AddInt32(&s.puts, 1)
+    return s.Store.PutTTL(key, value, ttl)
+}
+
+func TestChainWriteBack(t *testing.T) {
+    front := StoreMemory.New()
+    back := &countingStore{Store: StoreMemory.New(), fails: 2}
+    c := store.NewChainWithOptions(store.ChainOptions{
+        WriteBack: &store.WriteBackOptions{
+            FlushInterval: time.Hour,
+            RetryBackoff:  time.Millisecond * 10,
+        },
+    }, front, back)
+
+    for i := byte(0); i < 3; i++ {
+        tIfError(t, c.Put("key", []byte{i}))
+    }
+    tIfError(t, c.Put("other", []byte{9}))
+    if _, err := back.Get("key"); !errors.Is(err, store.ErrNotFound) {
+        t.Error("write reached back tier synchronously:", err)
+    }
+    tIfError(t, front.Delete("key"))
+    if data, err := c.Get("key"); err != nil || len(data) != 1 || data[0] != 2 {
+        t.Error("pending write not visible to Get:", data, err)
+    }
+    n := 0
+    tIfError(t, c.Range("", "", func(key string, value []byte) bool {
+        n++
+        return true
+    }))
+    if n != 2 {
+        t.Error("pending writes not visible to Range:", n)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+    defer cancel()
+    tIfError(t, c.Flush(ctx))
+    if data, err := back.Get("key"); err != nil || data[0] != 2 {
+        t.Error("flushed value:", data, err)
+    }
+    if puts := atomic.LoadInt32(&back.puts); puts != 2 {
+        t.Error("writes to the same key not coalesced, puts:", puts)
+    }
+
+    tIfError(t, c.Delete("other"))
+    tIfError(t, c.Close())
+    if ok, _ := back.Exist("other"); ok {
+        t.Error("Close did not drain pending delete")
+    }
+    if err := c.Put("key", nil); !errors.Is(err, store.ErrClosed) {
+        t.Error("Put after Close:", err)
+    }
+}
+
+// batchCountingStore 记录批量写入的次数, blocked 时写入一直阻塞到 ctx 结束
+type batchCountingStore struct {
+    store.BatchStore
+    mputs   int32
+    mdels   int32
+    blocked bool
+}
+
+func (s *batchCountingStore) MPutTTLContext(ctx context.Context, kvs map[string][]byte, ttl time.Duration) error {
+    atomic.AddInt32(&s.mputs, 1)
+    if s.blocked {
+        <-ctx.Done()
+        return ctx.Err()
+    }
+    return s.BatchStore.MPutTTLContext(ctx, kvs, ttl)
+}
+
+func (s *batchCountingStore) MDeleteContext(ctx context.Context, keys ...string) error {
+    atomic.AddInt32(&s.mdels, 1)
+    return s.BatchStore.MDeleteContext(ctx, keys...)
+}
+
+func TestChainWriteBackBatch(t *testing.T) {
+    back := &batchCountingStore{BatchStore: StoreMemory.New().(store.BatchStore)}
+    c := store.NewChainWithOptions(store.ChainOptions{
+        WriteBack: &store.WriteBackOptions{FlushInterval: time.Hour},
+    }, StoreMemory.New(), back)
+    for i := 0; i < 10; i++ {
+        tIfError(t, c.Put(fmt.Sprintf("key_%d", i), []byte{byte(i)}))
+    }
+    tIfError(t, c.MDelete("key_0", "key_1"))
+    tIfError(t, c.Flush(context.Background()))
+    if mputs, mdels := atomic.LoadInt32(&back.mputs), atomic.LoadInt32(&back.mdels); mputs != 1 || mdels != 1 {
+        t.Errorf("batch flush got %d MPut, %d MDelete", mputs, mdels)
+    }
+    if data, err := back.Get("key_9"); err != nil || data[0] != 9 {
+        t.Error("flushed value:", data, err)
+    }
+    if ok, _ := back.Exist("key_0"); ok {
+        t.Error("flushed delete left key_0")
+    }
+    tIfError(t, c.Close())
+
+    // Close 超时后中断卡住的写入
+    back = &batchCountingStore{BatchStore: StoreMemory.New().(store.BatchStore), blocked: true}
+    c = store.NewChainWithOptions(store.ChainOptions{
+        WriteBack: &store.WriteBackOptions{CloseTimeout: time.Millisecond * 100},
+    }, StoreMemory.New(), back)
+    tIfError(t, c.Put("key", []byte{1}))
+    start := time.Now()
+    if err := c.Close(); err == nil {
+        t.Error("Close with hung tier want error")
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Error("Close blocked by hung tier:", d)
+    }
+}
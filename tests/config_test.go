@@ -0,0 +1,72 @@
+package tests
+
+import (
+    "errors"
+    "github.com/DGHeroin/store"
+    "os"
+    "path"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestConfig(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    cfg, err := store.ParseConfig([]byte(`
+buckets:
+  config_cache:
+    type: lru
+    size: 100
+  config_main:
+    type: chain
+    read_through: true
+    tiers:
+      - use: config_cache
+        max_ttl: 1m
+      - type: bolt
+        path: ` + path.Join(tmpDir, "bolt") + `
+        bucket: users
+`))
+    tIfError(t, err)
+    tIfError(t, cfg.Apply())
+    main, cache := store.Get("config_main"), store.Get("config_cache")
+    if main == nil || cache == nil {
+        t.Fatal("buckets not registered:", store.Buckets())
+    }
+    tIfError(t, main.Put("key", []byte{1}))
+    if ttl, err := cache.TTL("key"); err != nil || ttl <= 0 || ttl > time.Minute {
+        t.Error("front tier ttl not capped:", ttl, err)
+    }
+    if data, err := main.Get("key"); err != nil || data[0] != 1 {
+        t.Error("chain Get:", data, err)
+    }
+
+    cfg, err = store.ParseConfig([]byte(`{"buckets": {"config_json": {"dsn": "memory"}}}`))
+    tIfError(t, err)
+    tIfError(t, cfg.Apply())
+    if store.Get("config_json") == nil {
+        t.Error("json bucket not registered")
+    }
+}
+
+func TestConfigErrors(t *testing.T) {
+    for _, c := range []struct{ doc, field string }{
+        {`buckets: {a: {type: foo}}`, "buckets.a.type"},
+        {`buckets: {a: {type: bolt}}`, "buckets.a.path"},
+        {`buckets: {a: {type: chain, tiers: [{type: memory}, {use: b}]}}`, "buckets.a.tiers[1].use"},
+        {`buckets: {a: {type: chain, tiers: [{type: redis}]}}`, "buckets.a.tiers[0].addr"},
+        {`buckets: {a: {type: chain, tiers: [{use: b}]}, b: {type: chain, tiers: [{use: a}]}}`, ".use"},
+    } {
+        doc, field := c.doc, c.field
+        cfg, err := store.ParseConfig([]byte(doc))
+        tIfError(t, err)
+        err = cfg.Validate()
+        var cfgErr *store.ConfigError
+        if !errors.As(err, &cfgErr) || !strings.HasSuffix(cfgErr.Field, field) {
+            t.Errorf("%s: want error at %s, got %v", doc, field, err)
+        }
+    }
+    if _, err := store.ParseConfig([]byte("buckets:\n  a:\n    typo: memory\n")); err == nil || !strings.Contains(err.Error(), "line 3") {
+        t.Error("unknown field:", err)
+    }
+}
@@ -0,0 +1,42 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "testing"
+)
+
+type plainStore struct {
+    store.Store
+}
+
+func TestContextRange(t *testing.T) {
+    mem := StoreMemory.New()
+    for i := 0; i < 10; i++ {
+        tIfError(t, mem.Put(fmt.Sprintf("key_%02d", i), []byte{byte(i)}))
+    }
+    for _, s := range []store.Store{mem, plainStore{mem}, store.NewChain(mem)} {
+        cs := store.WithContext(s)
+        ctx, cancel := context.WithCancel(context.Background())
+        n := 0
+        err := cs.RangeContext(ctx, "key_", "", func(key string, value []byte) bool {
+            n++
+            if n == 3 {
+                cancel()
+            }
+            return true
+        })
+        if !errors.Is(err, context.Canceled) {
+            t.Errorf("%T: want context.Canceled, got %v", s, err)
+        }
+        if n != 3 {
+            t.Errorf("%T: iteration not stopped, visited %d", s, n)
+        }
+        if _, err := cs.GetContext(ctx, "key_01"); !errors.Is(err, context.Canceled) {
+            t.Errorf("%T: want context.Canceled, got %v", s, err)
+        }
+    }
+}
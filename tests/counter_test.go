@@ -0,0 +1,71 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "sync"
+    "testing"
+    "time"
+)
+
+func testCounter(t *testing.T, name string, s store.Store) {
+    if n, err := store.Incr(s, "counter"); n != 1 || err != nil {
+        t.Errorf("%s: Incr new key got %v, %v", name, n, err)
+    }
+    if n, err := store.IncrBy(s, "counter", 41); n != 42 || err != nil {
+        t.Errorf("%s: IncrBy got %v, %v", name, n, err)
+    }
+    if data, err := s.Get("counter"); err != nil || string(data) != "42" {
+        t.Errorf("%s: Get counter got %q, %v", name, data, err)
+    }
+    tIfError(t, s.Put("counter", []byte("-5")))
+    if n, err := store.Decr(s, "counter"); n != -6 || err != nil {
+        t.Errorf("%s: Decr got %v, %v", name, n, err)
+    }
+    tIfError(t, s.Put("counter_text", []byte("abc")))
+    if _, err := store.Incr(s, "counter_text"); !errors.Is(err, store.ErrNotInteger) {
+        t.Errorf("%s: Incr text want ErrNotInteger, got %v", name, err)
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 50; j++ {
+                if _, err := store.Incr(s, "counter_concurrent"); err != nil {
+                    t.Error(err)
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    if data, _ := s.Get("counter_concurrent"); string(data) != "400" {
+        t.Errorf("%s: counter lost updates: %s", name, data)
+    }
+}
+
+func TestCounter(t *testing.T) {
+    for name, s := range openTestStores(t) {
+        testCounter(t, name, s)
+    }
+    // 不支持计数器的后端退化为条件写入重试
+    testCounter(t, "cas", casOnlyStore{StoreMemory.New().(store.CASStore)})
+
+    s := StoreMemory.New()
+    n, err := store.IncrByTTLContext(context.Background(), s, "counter_ttl", 1, time.Minute)
+    tIfError(t, err)
+    if n != 1 {
+        t.Error("IncrByTTL got", n)
+    }
+    if ttl, _ := s.TTL("counter_ttl"); ttl <= 0 || ttl > time.Minute {
+        t.Error("ttl not set on creation:", ttl)
+    }
+}
+
+type casOnlyStore struct {
+    store.CASStore
+}
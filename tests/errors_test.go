@@ -0,0 +1,62 @@
+package tests
+
+import (
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreBoltDB"
+    "github.com/DGHeroin/store/store/StoreLeveldb"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "github.com/DGHeroin/store/store/StoreMemoryLru"
+    "github.com/syndtr/goleveldb/leveldb"
+    "go.etcd.io/bbolt"
+    "os"
+    "path"
+    "testing"
+    "time"
+)
+
+func openTestStores(t *testing.T) map[string]store.Store {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    bdb, err := bbolt.Open(path.Join(tmpDir, "bolt"), os.ModePerm, bbolt.DefaultOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ldb, err := leveldb.OpenFile(path.Join(tmpDir, "leveldb"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return map[string]store.Store{
+        "memory":  StoreMemory.New(),
+        "lru":     StoreMemoryLru.New(16, func(key string, value []byte) {}),
+        "bolt":    StoreBoltDB.New(bdb),
+        "leveldb": StoreLeveldb.New(ldb),
+        "chain":   store.NewChain(StoreMemory.New(), StoreMemory.New()),
+    }
+}
+
+func TestErrors(t *testing.T) {
+    stores := openTestStores(t)
+    for name, s := range stores {
+        if _, err := s.Get("missing"); !errors.Is(err, store.ErrNotFound) {
+            t.Errorf("%s: Get missing want ErrNotFound, got %v", name, err)
+        }
+        if ok, err := s.Exist("missing"); ok || err != nil {
+            t.Errorf("%s: Exist missing want false, nil, got %v, %v", name, ok, err)
+        }
+        tIfError(t, s.Put("empty", []byte{}))
+        if data, err := s.Get("empty"); err != nil || len(data) != 0 {
+            t.Errorf("%s: Get empty want [], nil, got %v, %v", name, data, err)
+        }
+        tIfError(t, s.PutTTL("short", []byte{1}, time.Second))
+    }
+    time.Sleep(time.Millisecond * 2100)
+    for name, s := range stores {
+        if _, err := s.Get("short"); !errors.Is(err, store.ErrNotFound) {
+            t.Errorf("%s: Get expired want ErrNotFound, got %v", name, err)
+        }
+        tIfError(t, s.Close())
+        if _, err := s.Get("empty"); !errors.Is(err, store.ErrClosed) {
+            t.Errorf("%s: Get after Close want ErrClosed, got %v", name, err)
+        }
+    }
+}
@@ -0,0 +1,121 @@
+package tests
+
+import (
+    "bytes"
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreBoltDB"
+    "github.com/DGHeroin/store/store/StoreLeveldb"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "github.com/DGHeroin/store/store/StoreMemoryLru"
+    "github.com/syndtr/goleveldb/leveldb"
+    "go.etcd.io/bbolt"
+    "os"
+    "path"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestExpire(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    bdb, err := bbolt.Open(path.Join(tmpDir, "bolt"), os.ModePerm, bbolt.DefaultOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ldb, err := leveldb.OpenFile(path.Join(tmpDir, "leveldb"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, s := range map[string]store.Store{
+        "memory":  StoreMemory.New(),
+        "lru":     StoreMemoryLru.New(100, func(key string, value []byte) {}),
+        "bolt":    StoreBoltDB.New(bdb),
+        "leveldb": StoreLeveldb.New(ldb),
+    } {
+        tIfError(t, s.PutTTL("key", []byte("value"), time.Minute))
+        tIfError(t, store.Expire(s, "key", time.Hour))
+        if ttl, _ := s.TTL("key"); ttl < time.Minute*59 || ttl > time.Hour+time.Second {
+            t.Errorf("%s: ttl after Expire got %v", name, ttl)
+        }
+        if data, _ := s.Get("key"); !bytes.Equal(data, []byte("value")) {
+            t.Errorf("%s: value after Expire got %q", name, data)
+        }
+
+        tIfError(t, store.Persist(s, "key"))
+        if ttl, _ := s.TTL("key"); ttl != 0 {
+            t.Errorf("%s: ttl after Persist got %v", name, ttl)
+        }
+        tIfError(t, store.Touch(s, "key"))
+
+        tIfError(t, store.ExpireAt(s, "key", time.Now().Add(-time.Second)))
+        if ok, _ := s.Exist("key"); ok {
+            t.Errorf("%s: key exists after ExpireAt in the past", name)
+        }
+        if err := store.Expire(s, "missing", time.Minute); !store.IsNotFound(err) {
+            t.Errorf("%s: Expire missing want ErrNotFound, got %v", name, err)
+        }
+        if err := store.Touch(s, "missing"); !store.IsNotFound(err) {
+            t.Errorf("%s: Touch missing want ErrNotFound, got %v", name, err)
+        }
+
+        // 过期索引跟随过期时间变化
+        if _, ok := s.(store.ExpiryIndexStore); ok {
+            tIfError(t, s.Put("indexed", []byte{1}))
+            tIfError(t, store.Expire(s, "indexed", time.Minute))
+            keys, err := store.Expiring(s, time.Now().Add(time.Hour), 10)
+            tIfError(t, err)
+            if got := expiringKeys(keys); !reflect.DeepEqual(got, []string{"indexed"}) {
+                t.Errorf("%s: expiring after Expire got %v", name, got)
+            }
+            tIfError(t, store.Persist(s, "indexed"))
+            if keys, _ := store.Expiring(s, time.Now().Add(time.Hour), 10); len(keys) != 0 {
+                t.Errorf("%s: expiring after Persist got %v", name, keys)
+            }
+        }
+        tIfError(t, s.Close())
+    }
+
+    if err := store.Expire(plainStore{StoreMemory.New()}, "key", time.Minute); !errors.Is(err, store.ErrNotSupported) {
+        t.Error("plain store Expire want ErrNotSupported, got", err)
+    }
+}
+
+func TestChainExpire(t *testing.T) {
+    front, plain, last := StoreMemory.New(), StoreMemory.New(), StoreMemory.New()
+    c := store.NewChainWithOptions(store.ChainOptions{
+        Tiers: []store.TierOptions{{MaxTTL: time.Minute}},
+    }, front, plainStore{plain}, last)
+    tIfError(t, c.Put("key", []byte("value")))
+
+    tIfError(t, c.Expire("key", time.Hour))
+    if ttl, _ := last.TTL("key"); ttl < time.Minute*59 {
+        t.Error("last tier ttl got", ttl)
+    }
+    // 前面的层不超过 MaxTTL, 不支持 ExpireStore 的层被删除
+    if ttl, _ := front.TTL("key"); ttl <= 0 || ttl > time.Minute+time.Second {
+        t.Error("front tier ttl got", ttl)
+    }
+    if ok, _ := plain.Exist("key"); ok {
+        t.Error("plain tier not invalidated")
+    }
+
+    tIfError(t, c.Persist("key"))
+    if ttl, _ := last.TTL("key"); ttl != 0 {
+        t.Error("last tier ttl after Persist got", ttl)
+    }
+    if ttl, _ := front.TTL("key"); ttl <= 0 || ttl > time.Minute+time.Second {
+        t.Error("front tier ttl after Persist got", ttl)
+    }
+    tIfError(t, c.Touch("key"))
+
+    tIfError(t, c.ExpireAt("key", time.Now().Add(-time.Second)))
+    for i, s := range []store.Store{front, plain, last} {
+        if ok, _ := s.Exist("key"); ok {
+            t.Errorf("tier %d: key exists after ExpireAt in the past", i)
+        }
+    }
+    if err := c.Expire("key", time.Minute); !store.IsNotFound(err) {
+        t.Error("Expire missing want ErrNotFound, got", err)
+    }
+}
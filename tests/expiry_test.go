@@ -0,0 +1,143 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreBoltDB"
+    "github.com/DGHeroin/store/store/StoreLeveldb"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "github.com/DGHeroin/store/utils"
+    "github.com/syndtr/goleveldb/leveldb"
+    "go.etcd.io/bbolt"
+    "os"
+    "path"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestExpiryIndex(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    bdb, err := bbolt.Open(path.Join(tmpDir, "bolt"), os.ModePerm, bbolt.DefaultOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ldb, err := leveldb.OpenFile(path.Join(tmpDir, "leveldb"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 建立索引之前写入的数据, 第一次查询时补建索引
+    tIfError(t, ldb.Put([]byte("legacy"), utils.CombineData(time.Minute*5, []byte{0}), nil))
+    tIfError(t, bdb.Update(func(tx *bbolt.Tx) error {
+        b, err := tx.CreateBucketIfNotExists([]byte("default"))
+        if err != nil {
+            return err
+        }
+        return b.Put([]byte("legacy"), utils.CombineData(time.Minute*5, []byte{0}))
+    }))
+
+    for name, s := range map[string]store.Store{
+        "bolt":    StoreBoltDB.New(bdb),
+        "leveldb": StoreLeveldb.New(ldb),
+    } {
+        tIfError(t, s.PutTTL("hour", []byte{1}, time.Hour))
+        tIfError(t, s.PutTTL("ten", []byte{2}, time.Minute*10))
+        tIfError(t, s.Put("forever", []byte{3}))
+        tIfError(t, s.PutTTL("soon", []byte{4}, time.Minute))
+        tIfError(t, s.PutTTL("gone", []byte{5}, time.Minute))
+        tIfError(t, s.Delete("gone"))
+
+        keys, err := store.Expiring(s, time.Now().Add(time.Minute*30), 10)
+        tIfError(t, err)
+        if got := expiringKeys(keys); !reflect.DeepEqual(got, []string{"soon", "legacy", "ten"}) {
+            t.Errorf("%s: expiring want [soon legacy ten], got %v", name, got)
+        }
+        if keys, _ := store.Expiring(s, time.Now().Add(time.Minute*30), 1); len(keys) != 1 || keys[0].ExpireAt.Before(time.Now()) {
+            t.Errorf("%s: expiring max 1 got %v", name, keys)
+        }
+
+        tIfError(t, s.Put("ten", []byte{2}))
+        _, err = s.(store.CASStore).CompareAndSwap("soon", []byte{4}, []byte{6})
+        tIfError(t, err)
+        keys, err = store.Expiring(s, time.Now().Add(time.Minute*30), 10)
+        tIfError(t, err)
+        if got := expiringKeys(keys); !reflect.DeepEqual(got, []string{"soon", "legacy"}) {
+            t.Errorf("%s: expiring after overwrite want [soon legacy], got %v", name, got)
+        }
+
+        infos, err := s.RangeKeys("", "", 100)
+        tIfError(t, err)
+        if got := infos.ToKeys(); !reflect.DeepEqual(got, []string{"forever", "hour", "legacy", "soon", "ten"}) {
+            t.Errorf("%s: index visible to RangeKeys: %v", name, got)
+        }
+        tIfError(t, s.Close())
+    }
+
+    if _, err := store.Expiring(StoreMemory.New(), time.Now(), 10); !errors.Is(err, store.ErrNotSupported) {
+        t.Error("memory Expiring want ErrNotSupported, got", err)
+    }
+}
+
+func TestExpiryIndexReserved(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    ldb, err := leveldb.OpenFile(path.Join(tmpDir, "leveldb"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := StoreLeveldb.New(ldb)
+    defer s.Close()
+    if err := s.Put("\xff\xffexpire:x", []byte{1}); err == nil {
+        t.Error("reserved key accepted")
+    }
+}
+
+func TestExpiryIndexBoltMarker(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    bdb, err := bbolt.Open(path.Join(tmpDir, "bolt"), os.ModePerm, bbolt.DefaultOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 旧版本的就绪标记和无法解析的项在索引 bucket 中, 不能挡住后面的索引项
+    tIfError(t, bdb.Update(func(tx *bbolt.Tx) error {
+        b, err := tx.CreateBucketIfNotExists([]byte("default"))
+        if err != nil {
+            return err
+        }
+        if err = b.Put([]byte("legacy"), utils.CombineData(time.Millisecond, []byte{0})); err != nil {
+            return err
+        }
+        index, err := tx.CreateBucketIfNotExists([]byte("\x00expire:default"))
+        if err != nil {
+            return err
+        }
+        if err = index.Put([]byte("ready"), []byte{}); err != nil {
+            return err
+        }
+        return index.Put([]byte{0}, []byte{})
+    }))
+    time.Sleep(time.Millisecond * 5)
+    s := StoreBoltDB.New(bdb)
+    defer s.Close()
+    keys, err := store.Expiring(s, time.Now(), 10)
+    tIfError(t, err)
+    if got := expiringKeys(keys); !reflect.DeepEqual(got, []string{"legacy"}) {
+        t.Error("expiring got", got)
+    }
+    if n, _, err := s.(store.Sweepable).SweepExpired(context.Background(), "", 10); n != 1 || err != nil {
+        t.Error("sweep got", n, err)
+    }
+    tIfError(t, bdb.View(func(tx *bbolt.Tx) error {
+        if tx.Bucket([]byte("\x00expire:default")).Get([]byte("ready")) != nil {
+            t.Error("legacy ready marker left in the index")
+        }
+        return nil
+    }))
+}
+
+func expiringKeys(keys []store.ExpiringKey) (result []string) {
+    for _, k := range keys {
+        result = append(result, k.Key)
+    }
+    return
+}
@@ -0,0 +1,203 @@
+package tests
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreBoltDB"
+    "github.com/DGHeroin/store/store/StoreLeveldb"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "github.com/DGHeroin/store/utils"
+    "github.com/syndtr/goleveldb/leveldb"
+    "go.etcd.io/bbolt"
+    "os"
+    "path"
+    "testing"
+    "time"
+)
+
+// legacyData 旧格式: 4 字节大端的过期时间 (Unix 秒) + value
+func legacyData(expireAt time.Time, value string) []byte {
+    data := make([]byte, 4)
+    if !expireAt.IsZero() {
+        binary.BigEndian.PutUint32(data, uint32(expireAt.Unix()))
+    }
+    return append(data, value...)
+}
+
+func TestDataFormat(t *testing.T) {
+    expireAt := time.Now().Add(time.Minute)
+    ok, sec, value := utils.SplitData(legacyData(expireAt, "abc"))
+    if !ok || sec != int(expireAt.Unix()) || string(value) != "abc" {
+        t.Error("legacy decode:", ok, sec, string(value))
+    }
+    if ok, _, _ := utils.SplitData(legacyData(time.Now().Add(-time.Second), "abc")); ok {
+        t.Error("expired legacy data reported as live")
+    }
+
+    data := utils.CombineData(time.Millisecond*1500, []byte("abc"))
+    if utils.IsLegacyData(data) || string(utils.ValueOf(data)) != "abc" {
+        t.Error("new format decode:", data)
+    }
+    if left := time.Duration(utils.ExpireAtMillis(data))*time.Millisecond - time.Duration(time.Now().UnixNano()); left < time.Millisecond*1400 || left > time.Millisecond*1500 {
+        t.Error("sub-second ttl truncated:", left)
+    }
+    far := time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+    if h, _, err := utils.DecodeData(utils.EncodeData(utils.Header{ExpireAt: far.UnixNano() / 1e6}, nil)); err != nil || h.Expired(time.Now()) {
+        t.Error("expiry after 2106:", h, err)
+    }
+
+    sum := utils.EncodeData(utils.Header{Flags: utils.FlagChecksum | utils.FlagCompressed}, []byte("abc"))
+    h, value, err := utils.DecodeData(sum)
+    if err != nil || string(value) != "abc" || h.Flags&utils.FlagCompressed == 0 {
+        t.Error("checksum decode:", h, string(value), err)
+    }
+    if replaced := utils.ReplaceValue(sum, []byte("xyz")); string(utils.ValueOf(replaced)) != "xyz" {
+        t.Error("ReplaceValue with checksum:", replaced)
+    }
+    sum[len(sum)-1] ^= 0xff
+    if _, _, err := utils.DecodeData(sum); !errors.Is(err, utils.ErrCorruptData) {
+        t.Error("corrupted checksum want ErrCorruptData, got", err)
+    }
+
+    s := StoreMemory.New()
+    tIfError(t, s.PutTTL("short", []byte{1}, time.Millisecond*200))
+    if ok, _ := s.Exist("short"); !ok {
+        t.Error("sub-second ttl expired immediately")
+    }
+    time.Sleep(time.Millisecond * 300)
+    if ok, _ := s.Exist("short"); ok {
+        t.Error("sub-second ttl never expired")
+    }
+}
+
+func TestMigrateFormat(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    bdb, err := bbolt.Open(path.Join(tmpDir, "bolt"), os.ModePerm, bbolt.DefaultOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ldb, err := leveldb.OpenFile(path.Join(tmpDir, "leveldb"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expireAt := time.Now().Add(time.Hour)
+    tIfError(t, bdb.Update(func(tx *bbolt.Tx) error {
+        b, err := tx.CreateBucketIfNotExists([]byte("default"))
+        if err != nil {
+            return err
+        }
+        tIfError(t, b.Put([]byte("forever"), legacyData(time.Time{}, "v1")))
+        return b.Put([]byte("hour"), legacyData(expireAt, "v2"))
+    }))
+    tIfError(t, ldb.Put([]byte("forever"), legacyData(time.Time{}, "v1"), nil))
+    tIfError(t, ldb.Put([]byte("hour"), legacyData(expireAt, "v2"), nil))
+
+    raw := map[string]func(key string) []byte{
+        "bolt": func(key string) (data []byte) {
+            _ = bdb.View(func(tx *bbolt.Tx) error {
+                data = utils.CopyBytes(tx.Bucket([]byte("default")).Get([]byte(key)))
+                return nil
+            })
+            return
+        },
+        "leveldb": func(key string) []byte {
+            data, _ := ldb.Get([]byte(key), nil)
+            return data
+        },
+    }
+    for name, s := range map[string]store.Store{
+        "bolt":    StoreBoltDB.New(bdb),
+        "leveldb": StoreLeveldb.New(ldb),
+    } {
+        tIfError(t, s.Put("current", []byte("v3")))
+        n, err := store.MigrateFormat(context.Background(), s)
+        if err != nil || n != 2 {
+            t.Errorf("%s: migrate want 2, got %d %v", name, n, err)
+        }
+        if n, _ := store.MigrateFormat(context.Background(), s); n != 0 {
+            t.Errorf("%s: second migrate want 0, got %d", name, n)
+        }
+        if data, err := s.Get("hour"); err != nil || string(data) != "v2" {
+            t.Errorf("%s: migrated value: %q %v", name, data, err)
+        }
+        if ttl, err := s.TTL("hour"); err != nil || ttl < time.Minute*59 || ttl > time.Hour {
+            t.Errorf("%s: migrated ttl: %v %v", name, ttl, err)
+        }
+        if ttl, err := s.TTL("forever"); err != nil || ttl != 0 {
+            t.Errorf("%s: migrated no ttl: %v %v", name, ttl, err)
+        }
+        for _, key := range []string{"forever", "hour", "current"} {
+            if utils.IsLegacyData(raw[name](key)) {
+                t.Errorf("%s: %s still in legacy format", name, key)
+            }
+        }
+        tIfError(t, s.Close())
+    }
+}
+
+func TestCorruptDataKept(t *testing.T) {
+    tmpDir, _ := os.MkdirTemp(os.TempDir(), "store_")
+    bdb, err := bbolt.Open(path.Join(tmpDir, "bolt"), os.ModePerm, bbolt.DefaultOptions)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ldb, err := leveldb.OpenFile(path.Join(tmpDir, "leveldb"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    flipped := utils.EncodeData(utils.Header{Flags: utils.FlagChecksum}, []byte("value"))
+    flipped[len(flipped)-1] ^= 1
+    future := utils.EncodeData(utils.Header{}, []byte("value"))
+    future[1] = utils.HeaderVersion + 1
+    want := map[string]error{"flipped": store.ErrCorruptData, "future": store.ErrUnsupportedVersion}
+    tIfError(t, bdb.Update(func(tx *bbolt.Tx) error {
+        b, err := tx.CreateBucketIfNotExists([]byte("default"))
+        if err != nil {
+            return err
+        }
+        tIfError(t, b.Put([]byte("flipped"), flipped))
+        return b.Put([]byte("future"), future)
+    }))
+    tIfError(t, ldb.Put([]byte("flipped"), flipped, nil))
+    tIfError(t, ldb.Put([]byte("future"), future, nil))
+
+    for name, s := range map[string]store.Store{
+        "bolt":    StoreBoltDB.New(bdb),
+        "leveldb": StoreLeveldb.New(ldb),
+    } {
+        var expired []string
+        tIfError(t, store.OnExpire(s, func(key string) {
+            expired = append(expired, key)
+        }))
+        for key, wantErr := range want {
+            if _, err := s.Get(key); !errors.Is(err, wantErr) || store.IsNotFound(err) {
+                t.Errorf("%s: Get %s want %v, got %v", name, key, wantErr, err)
+            }
+            if _, err := s.TTL(key); !errors.Is(err, wantErr) {
+                t.Errorf("%s: TTL %s want %v, got %v", name, key, wantErr, err)
+            }
+            if _, err := store.MGet(s, key); !errors.Is(err, wantErr) {
+                t.Errorf("%s: MGet %s want %v, got %v", name, key, wantErr, err)
+            }
+            if _, err := store.Incr(s, key); !errors.Is(err, wantErr) {
+                t.Errorf("%s: Incr %s want %v, got %v", name, key, wantErr, err)
+            }
+        }
+        if _, _, err := s.(store.SweeperStore).SweepExpired(context.Background(), "", 100); err != nil {
+            t.Errorf("%s: sweep: %v", name, err)
+        }
+        // 等待可能的异步删除
+        time.Sleep(time.Millisecond * 50)
+        if len(expired) > 0 {
+            t.Errorf("%s: undecodable data reported as expired: %v", name, expired)
+        }
+        for key := range want {
+            if _, err := s.Get(key); !errors.Is(err, want[key]) {
+                t.Errorf("%s: %s was removed: %v", name, key, err)
+            }
+        }
+        tIfError(t, s.Close())
+    }
+}
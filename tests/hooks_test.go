@@ -0,0 +1,150 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "github.com/DGHeroin/store/store/StoreMemoryLru"
+    "reflect"
+    "sort"
+    "sync"
+    "testing"
+    "time"
+)
+
+type hookRecorder struct {
+    mu     sync.Mutex
+    events []string
+}
+
+func (r *hookRecorder) record(event string) func(key string) {
+    return func(key string) {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        r.events = append(r.events, event+":"+key)
+    }
+}
+
+func (r *hookRecorder) take() []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    events := r.events
+    r.events = nil
+    sort.Strings(events)
+    return events
+}
+
+func TestHooks(t *testing.T) {
+    stores := openTestStores(t)
+    delete(stores, "chain")
+    _, dsn := newFakeS3(t, "hooks", true)
+    s3, err := store.Open(dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stores["s3"] = s3
+    for name, s := range stores {
+        r := &hookRecorder{}
+        tIfError(t, store.OnExpire(s, r.record("expire")))
+        tIfError(t, store.OnDelete(s, r.record("delete")))
+        tIfError(t, store.OnEvict(s, r.record("evict")))
+        // 回调中可以访问 Store
+        tIfError(t, store.OnDelete(s, func(key string) {
+            if ok, err := s.Exist(key); ok || err != nil {
+                r.record("exist")(key)
+            }
+        }))
+
+        for _, key := range []string{"a", "b", "c"} {
+            tIfError(t, s.Put(key, []byte(key)))
+        }
+        tIfError(t, s.PutTTL("x", []byte("x"), time.Millisecond*50))
+        tIfError(t, s.Delete("a"))
+        tIfError(t, s.Delete("missing"))
+        tIfError(t, store.MDelete(s, "b", "missing"))
+        ok, err := store.DeleteIf(s, "c", []byte("c"))
+        if !ok || err != nil {
+            t.Errorf("%s: DeleteIf got %v %v", name, ok, err)
+        }
+        if got := r.take(); !reflect.DeepEqual(got, []string{"delete:a", "delete:b", "delete:c"}) {
+            t.Errorf("%s: delete events got %v", name, got)
+        }
+
+        time.Sleep(time.Millisecond * 100)
+        removed, _, err := s.(store.Sweepable).SweepExpired(context.Background(), "", 100)
+        tIfError(t, err)
+        if got := r.take(); removed != 1 || !reflect.DeepEqual(got, []string{"expire:x"}) {
+            t.Errorf("%s: sweep removed %d, events %v", name, removed, got)
+        }
+
+        if ts, ok := s.(store.TxnStore); ok {
+            tIfError(t, s.Put("a", []byte{1}))
+            tIfError(t, s.Put("t", []byte{1}))
+            tIfError(t, ts.Update(func(tx store.Txn) error {
+                return tx.Delete("t")
+            }))
+            rollback := errors.New("rollback")
+            if err := ts.Update(func(tx store.Txn) error {
+                if err := tx.Delete("a"); err != nil {
+                    return err
+                }
+                return rollback
+            }); err != rollback {
+                t.Errorf("%s: txn want rollback, got %v", name, err)
+            }
+            if got := r.take(); !reflect.DeepEqual(got, []string{"delete:t"}) {
+                t.Errorf("%s: txn events got %v", name, got)
+            }
+        }
+        tIfError(t, s.Close())
+    }
+
+    if err := store.OnExpire(plainStore{StoreMemory.New()}, func(string) {}); !errors.Is(err, store.ErrNotSupported) {
+        t.Error("plain store OnExpire want ErrNotSupported, got", err)
+    }
+}
+
+func TestHooksEvict(t *testing.T) {
+    s := StoreMemoryLru.New(2, nil)
+    r := &hookRecorder{}
+    tIfError(t, store.OnEvict(s, r.record("evict")))
+    tIfError(t, store.OnDelete(s, r.record("delete")))
+    for i := 0; i < 3; i++ {
+        tIfError(t, s.Put(fmt.Sprintf("k%d", i), []byte{byte(i)}))
+    }
+    ok, err := store.PutIfAbsent(s, "k3", []byte{3}, 0)
+    if !ok || err != nil {
+        t.Error("PutIfAbsent got", ok, err)
+    }
+    tIfError(t, s.Delete("k2"))
+    if got := r.take(); !reflect.DeepEqual(got, []string{"delete:k2", "evict:k0", "evict:k1"}) {
+        t.Error("lru events got", got)
+    }
+}
+
+// MGet 读到的过期 key 按过期处理, 触发 OnExpire 而不是 OnDelete
+func TestHooksMGetExpired(t *testing.T) {
+    stores := openTestStores(t)
+    delete(stores, "chain")
+    for name, s := range stores {
+        r := &hookRecorder{}
+        tIfError(t, store.OnExpire(s, r.record("expire")))
+        tIfError(t, store.OnDelete(s, r.record("delete")))
+        tIfError(t, s.PutTTL("m", []byte("m"), time.Millisecond*50))
+        time.Sleep(time.Millisecond * 100)
+        if result, err := store.MGet(s, "m"); len(result) != 0 || err != nil {
+            t.Errorf("%s: MGet expired got %v %v", name, result, err)
+        }
+        var got []string
+        for i := 0; i < 50 && len(got) == 0; i++ {
+            time.Sleep(time.Millisecond * 10)
+            got = r.take()
+        }
+        if !reflect.DeepEqual(got, []string{"expire:m"}) {
+            t.Errorf("%s: MGet expired events got %v", name, got)
+        }
+        tIfError(t, s.Close())
+    }
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+    "encoding/json"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/server/ServerHTTP"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// onlyReader 隐藏 Bytes 和 Seek, 模拟只能读一次的流
+type onlyReader struct {
+    io.Reader
+}
+
+type streamStore struct {
+    store.Store
+}
+
+func (s streamStore) RGet(key string) (io.Reader, error) {
+    r, err := s.Store.RGet(key)
+    if err != nil {
+        return nil, err
+    }
+    return onlyReader{r}, nil
+}
+
+func doHTTP(t *testing.T, method, url string, body io.Reader, header map[string]string) (*http.Response, string) {
+    req, err := http.NewRequest(method, url, body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for k, v := range header {
+        req.Header.Set(k, v)
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    data, err := ioutil.ReadAll(resp.Body)
+    tIfError(t, err)
+    return resp, string(data)
+}
+
+func testHTTP(t *testing.T, name string, base string) {
+    expectStatus := func(what string, resp *http.Response, code int) {
+        if resp.StatusCode != code {
+            t.Errorf("%s: %s status got %d, want %d", name, what, resp.StatusCode, code)
+        }
+    }
+    url := base + "/" + name
+
+    resp, _ := doHTTP(t, http.MethodGet, url+"/missing", nil, nil)
+    expectStatus("GET missing", resp, http.StatusNotFound)
+
+    resp, _ = doHTTP(t, http.MethodPut, url+"/dir/a", strings.NewReader("hello world"), nil)
+    expectStatus("PUT", resp, http.StatusNoContent)
+    tag := resp.Header.Get("ETag")
+    if tag == "" {
+        t.Errorf("%s: PUT without ETag", name)
+    }
+    resp, body := doHTTP(t, http.MethodGet, url+"/dir/a", nil, nil)
+    expectStatus("GET", resp, http.StatusOK)
+    if body != "hello world" || resp.Header.Get("ETag") != tag || resp.ContentLength != 11 {
+        t.Errorf("%s: GET got %q, etag %q, length %d", name, body, resp.Header.Get("ETag"), resp.ContentLength)
+    }
+    if resp.Header.Get(ServerHTTP.TTLHeader) != "" {
+        t.Errorf("%s: GET without ttl got %s", name, resp.Header.Get(ServerHTTP.TTLHeader))
+    }
+    resp, _ = doHTTP(t, http.MethodGet, url+"/dir/a", nil, map[string]string{"If-None-Match": tag})
+    expectStatus("GET If-None-Match", resp, http.StatusNotModified)
+    resp, body = doHTTP(t, http.MethodGet, url+"/dir/a", nil, map[string]string{"Range": "bytes=6-"})
+    expectStatus("GET Range", resp, http.StatusPartialContent)
+    if body != "world" || resp.Header.Get("Content-Range") != "bytes 6-10/11" {
+        t.Errorf("%s: GET Range got %q, %q", name, body, resp.Header.Get("Content-Range"))
+    }
+    resp, body = doHTTP(t, http.MethodHead, url+"/dir/a", nil, nil)
+    expectStatus("HEAD", resp, http.StatusOK)
+    if body != "" || resp.ContentLength != 11 || resp.Header.Get("ETag") != tag {
+        t.Errorf("%s: HEAD got %q, length %d", name, body, resp.ContentLength)
+    }
+
+    resp, _ = doHTTP(t, http.MethodPut, url+"/dir/b", strings.NewReader("b"), map[string]string{ServerHTTP.TTLHeader: "1h"})
+    expectStatus("PUT ttl", resp, http.StatusNoContent)
+    resp, _ = doHTTP(t, http.MethodGet, url+"/dir/b", nil, nil)
+    if ttl, err := time.ParseDuration(resp.Header.Get(ServerHTTP.TTLHeader)); err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+        t.Errorf("%s: GET ttl got %v, %v", name, ttl, err)
+    }
+    resp, _ = doHTTP(t, http.MethodPut, url+"/dir/c", strings.NewReader("c"), map[string]string{ServerHTTP.TTLHeader: "-1"})
+    expectStatus("PUT bad ttl", resp, http.StatusBadRequest)
+    resp, _ = doHTTP(t, http.MethodPut, url+"/short", strings.NewReader("s"), map[string]string{ServerHTTP.TTLHeader: "1"})
+    expectStatus("PUT short ttl", resp, http.StatusNoContent)
+    resp, _ = doHTTP(t, http.MethodPut, url+"/other", strings.NewReader("o"), nil)
+    expectStatus("PUT other", resp, http.StatusNoContent)
+
+    // 没有 Content-Length 的分块上传
+    req, _ := http.NewRequest(http.MethodPut, url+"/chunked", ioutil.NopCloser(strings.NewReader("x")))
+    req.ContentLength = -1
+    if resp, err := http.DefaultClient.Do(req); err != nil {
+        t.Fatal(err)
+    } else {
+        _ = resp.Body.Close()
+        expectStatus("PUT chunked", resp, http.StatusLengthRequired)
+    }
+
+    resp, body = doHTTP(t, http.MethodGet, url+"?prefix=dir/", nil, nil)
+    expectStatus("list", resp, http.StatusOK)
+    var infos []map[string]interface{}
+    tIfError(t, json.Unmarshal([]byte(body), &infos))
+    want := []map[string]interface{}{{"key": "dir/a", "size": 11.0}, {"key": "dir/b", "size": 1.0}}
+    if !reflect.DeepEqual(infos, want) {
+        t.Errorf("%s: list got %s", name, body)
+    }
+    resp, body = doHTTP(t, http.MethodGet, url+"?prefix=dir/&max=1", nil, nil)
+    if !strings.Contains(body, `"dir/a"`) || strings.Contains(body, `"dir/b"`) {
+        t.Errorf("%s: list max=1 got %s", name, body)
+    }
+    resp, _ = doHTTP(t, http.MethodGet, url+"?max=x", nil, nil)
+    expectStatus("list bad max", resp, http.StatusBadRequest)
+
+    resp, _ = doHTTP(t, http.MethodDelete, url+"/dir/a", nil, nil)
+    expectStatus("DELETE", resp, http.StatusNoContent)
+    resp, _ = doHTTP(t, http.MethodDelete, url+"/dir/a", nil, nil)
+    expectStatus("DELETE missing", resp, http.StatusNotFound)
+    resp, _ = doHTTP(t, http.MethodGet, url+"/dir/a", nil, nil)
+    expectStatus("GET deleted", resp, http.StatusNotFound)
+    resp, _ = doHTTP(t, http.MethodPost, url+"/dir/a", nil, nil)
+    expectStatus("POST", resp, http.StatusMethodNotAllowed)
+}
+
+func TestHTTP(t *testing.T) {
+    stores := openTestStores(t)
+    delete(stores, "lru")
+    stores["stream"] = streamStore{StoreMemory.New()}
+    srv := httptest.NewServer(ServerHTTP.New(func(bucket string) store.Store {
+        return stores[bucket]
+    }))
+    defer srv.Close()
+
+    for name := range stores {
+        testHTTP(t, name, srv.URL)
+    }
+    time.Sleep(time.Millisecond * 1100)
+    for name, s := range stores {
+        resp, _ := doHTTP(t, http.MethodGet, srv.URL+"/"+name+"/short", nil, nil)
+        if resp.StatusCode != http.StatusNotFound {
+            t.Errorf("%s: GET expired status got %d", name, resp.StatusCode)
+        }
+        tIfError(t, s.Close())
+    }
+    resp, _ := doHTTP(t, http.MethodGet, srv.URL+"/nobucket/a", nil, nil)
+    if resp.StatusCode != http.StatusNotFound {
+        t.Errorf("unknown bucket status got %d", resp.StatusCode)
+    }
+
+    // 默认使用已注册的 bucket
+    store.InitStore("http_registry", StoreMemory.New())
+    registry := httptest.NewServer(ServerHTTP.New(nil))
+    defer registry.Close()
+    resp, _ = doHTTP(t, http.MethodPut, registry.URL+"/http_registry/k", strings.NewReader("v"), nil)
+    if resp.StatusCode != http.StatusNoContent {
+        t.Errorf("registry PUT status got %d", resp.StatusCode)
+    }
+    if data, err := store.Get("http_registry").Get("k"); err != nil || string(data) != "v" {
+        t.Errorf("registry Get got %q, %v", data, err)
+    }
+}
@@ -1,8 +1,11 @@
 package tests
 
 import (
+    "github.com/DGHeroin/store"
     "github.com/DGHeroin/store/store/StoreMemoryLru"
+    "reflect"
     "testing"
+    "time"
 )
 
 func TestLRU(t *testing.T) {
@@ -11,3 +14,25 @@ func TestLRU(t *testing.T) {
     })
     doTestStore(t, s)
 }
+
+func TestLRUExpireKeepsOrder(t *testing.T) {
+    var evicted []string
+    s := StoreMemoryLru.New(2, func(key string, value []byte) {
+        evicted = append(evicted, key)
+    })
+    tIfError(t, s.Put("a", []byte("1")))
+    tIfError(t, s.Put("b", []byte("2")))
+    // 修改过期时间不改变 LRU 顺序, a 仍然最先被淘汰
+    tIfError(t, store.Expire(s, "a", time.Minute))
+    tIfError(t, store.Persist(s, "a"))
+    tIfError(t, s.Put("c", []byte("3")))
+    if !reflect.DeepEqual(evicted, []string{"a"}) {
+        t.Error("evicted after expire:", evicted)
+    }
+    // Touch 把 key 移到最前面
+    tIfError(t, store.Touch(s, "b"))
+    tIfError(t, s.Put("d", []byte("4")))
+    if !reflect.DeepEqual(evicted, []string{"a", "c"}) {
+        t.Error("evicted after touch:", evicted)
+    }
+}
@@ -1,9 +1,16 @@
 package tests
 
 import (
+    "context"
+    "github.com/DGHeroin/redcon"
+    "github.com/DGHeroin/store"
     "github.com/DGHeroin/store/store/StoreRedis"
     "github.com/go-redis/redis/v8"
+    "reflect"
+    "strings"
+    "sync"
     "testing"
+    "time"
 )
 
 func TestRedis(t *testing.T) {
@@ -15,3 +22,129 @@ func TestRedis(t *testing.T) {
     }
     doTestStore(t, s)
 }
+
+// fakeNotifyRedis 只支持 CONFIG, 订阅和 EVAL 命令的 Redis, 记录收到的 CONFIG SET 和 EVAL 的参数.
+// redcon 的 Close 与仍在处理的连接有数据竞争, 测试结束时不关闭
+type fakeNotifyRedis struct {
+    mu     sync.Mutex
+    flags  string
+    noConf bool
+    sets   []string
+    evals  [][]string
+    ps     redcon.PubSub
+    srv    *redcon.Server
+}
+
+func newFakeNotifyRedis(t *testing.T, flags string, noConf bool) (*fakeNotifyRedis, *redis.Client) {
+    f := &fakeNotifyRedis{flags: flags, noConf: noConf}
+    f.srv = redcon.NewServer("127.0.0.1:0", f.serve, nil, nil)
+    signal := make(chan error, 1)
+    go func() {
+        _ = f.srv.ListenServeAndSignal(signal)
+    }()
+    if err := <-signal; err != nil {
+        t.Fatal(err)
+    }
+    return f, redis.NewClient(&redis.Options{Addr: f.srv.Addr().String()})
+}
+
+func (f *fakeNotifyRedis) serve(conn redcon.Conn, cmd redcon.Command) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    args := make([]string, len(cmd.Args))
+    for i, a := range cmd.Args {
+        args[i] = strings.ToLower(string(a))
+    }
+    switch {
+    case args[0] == "config" && f.noConf:
+        conn.WriteError("ERR unknown command 'config'")
+    case args[0] == "config" && len(args) == 3 && args[1] == "get":
+        conn.WriteArray(2)
+        conn.WriteBulkString(args[2])
+        conn.WriteBulkString(f.flags)
+    case args[0] == "config" && len(args) == 4 && args[1] == "set":
+        f.flags = string(cmd.Args[3])
+        f.sets = append(f.sets, f.flags)
+        conn.WriteString("OK")
+    case args[0] == "subscribe":
+        for _, ch := range cmd.Args[1:] {
+            f.ps.Subscribe(conn, string(ch))
+        }
+    case args[0] == "psubscribe":
+        for _, ch := range cmd.Args[1:] {
+            f.ps.Psubscribe(conn, string(ch))
+        }
+    case args[0] == "evalsha":
+        conn.WriteError("NOSCRIPT No matching script")
+    case args[0] == "eval":
+        f.evals = append(f.evals, args[2:])
+        conn.WriteInt(1)
+    case args[0] == "ping":
+        conn.WriteString("PONG")
+    default:
+        conn.WriteError("ERR unknown command '" + args[0] + "'")
+    }
+}
+
+func (f *fakeNotifyRedis) configSets() []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.sets
+}
+
+func (f *fakeNotifyRedis) evalArgs() [][]string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.evals
+}
+
+func TestRedisIncrSubMillisecondTTL(t *testing.T) {
+    f, cli := newFakeNotifyRedis(t, "", false)
+    s := StoreRedis.New(cli)
+    // 不足 1ms 的 ttl 不能取整为 0, 否则 PEXPIRE 0 会删除新建的 key
+    _, err := store.IncrByTTLContext(context.Background(), s, "counter", 1, time.Microsecond)
+    tIfError(t, err)
+    if evals := f.evalArgs(); !reflect.DeepEqual(evals, [][]string{{"1", "counter", "1", "1"}}) {
+        t.Error("IncrByTTL eval args got", evals)
+    }
+    tIfError(t, s.Close())
+}
+
+func TestRedisNotifyConfig(t *testing.T) {
+    // 默认不修改服务端配置
+    f, cli := newFakeNotifyRedis(t, "", false)
+    s := StoreRedis.New(cli)
+    tIfError(t, store.OnExpire(s, func(string) {}))
+    ctx, cancel := context.WithCancel(context.Background())
+    _, err := store.Watch(ctx, s, "")
+    tIfError(t, err)
+    time.Sleep(time.Millisecond * 100)
+    if sets := f.configSets(); len(sets) != 0 {
+        t.Error("default options ran CONFIG SET:", sets)
+    }
+    if err := StoreRedis.CheckNotify(context.Background(), cli); err == nil || !strings.Contains(err.Error(), `missing "EgxeK$"`) {
+        t.Error("CheckNotify without flags got", err)
+    }
+    cancel()
+    tIfError(t, s.Close())
+
+    // notify_config=true 时补上缺少的标记
+    f, _ = newFakeNotifyRedis(t, "K", false)
+    s, err = store.Open("redis://" + f.srv.Addr().String() + "?notify_config=true")
+    tIfError(t, err)
+    tIfError(t, store.OnExpire(s, func(string) {}))
+    if sets := f.configSets(); !reflect.DeepEqual(sets, []string{"KEgxe"}) {
+        t.Error("notify_config CONFIG SET got", sets)
+    }
+    tIfError(t, s.Close())
+
+    // 标记齐全时检查通过, 禁用 CONFIG 时返回错误
+    f, cli = newFakeNotifyRedis(t, "AKE", false)
+    tIfError(t, StoreRedis.CheckNotify(context.Background(), cli))
+    tIfError(t, cli.Close())
+    f, cli = newFakeNotifyRedis(t, "", true)
+    if err := StoreRedis.CheckNotify(context.Background(), cli); err == nil {
+        t.Error("CheckNotify without CONFIG want error")
+    }
+    tIfError(t, cli.Close())
+}
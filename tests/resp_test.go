@@ -0,0 +1,162 @@
+package tests
+
+import (
+    "context"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/server/ServerRESP"
+    "github.com/go-redis/redis/v8"
+    "reflect"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+func testRESP(t *testing.T, name string, s store.Store) {
+    srv := ServerRESP.New(s)
+    signal := make(chan error, 1)
+    go func() {
+        _ = srv.ListenServeAndSignal("127.0.0.1:0", signal)
+    }()
+    if err := <-signal; err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Close()
+    cli := redis.NewClient(&redis.Options{Addr: srv.Addr().String()})
+    defer cli.Close()
+    ctx := context.Background()
+
+    if v, err := cli.Ping(ctx).Result(); v != "PONG" || err != nil {
+        t.Fatalf("%s: PING got %q, %v", name, v, err)
+    }
+    if _, err := cli.Get(ctx, "missing").Result(); err != redis.Nil {
+        t.Errorf("%s: GET missing want nil, got %v", name, err)
+    }
+    tIfError(t, cli.Set(ctx, "k", "v", 0).Err())
+    if v, err := cli.Get(ctx, "k").Result(); v != "v" || err != nil {
+        t.Errorf("%s: GET got %q, %v", name, v, err)
+    }
+    if ok, err := cli.SetNX(ctx, "k", "v2", 0).Result(); ok || err != nil {
+        t.Errorf("%s: SET NX existing got %v, %v", name, ok, err)
+    }
+    if ok, err := cli.SetXX(ctx, "k", "v2", 0).Result(); !ok || err != nil {
+        t.Errorf("%s: SET XX existing got %v, %v", name, ok, err)
+    }
+    if ok, err := cli.SetXX(ctx, "nx", "v", 0).Result(); ok || err != nil {
+        t.Errorf("%s: SET XX missing got %v, %v", name, ok, err)
+    }
+    if ok, err := cli.SetNX(ctx, "nx", "v", time.Minute).Result(); !ok || err != nil {
+        t.Errorf("%s: SET NX missing got %v, %v", name, ok, err)
+    }
+    if err := cli.Do(ctx, "set", "k", "v", "ex", "0").Err(); err == nil || !strings.Contains(err.Error(), "invalid expire") {
+        t.Errorf("%s: SET EX 0 got %v", name, err)
+    }
+    if err := cli.Do(ctx, "set", "k", "v", "ex", "9223372036854775807").Err(); err == nil || !strings.Contains(err.Error(), "invalid expire") {
+        t.Errorf("%s: SET EX overflow got %v", name, err)
+    }
+    if err := cli.Do(ctx, "set", "k", "v", "bogus").Err(); err == nil {
+        t.Errorf("%s: SET bogus option want error", name)
+    }
+
+    if d, err := cli.TTL(ctx, "nx").Result(); d < 59*time.Second || d > time.Minute || err != nil {
+        t.Errorf("%s: TTL got %v, %v", name, d, err)
+    }
+    if d, err := cli.TTL(ctx, "k").Result(); d != -1 || err != nil {
+        t.Errorf("%s: TTL no expiry got %v, %v", name, d, err)
+    }
+    if d, err := cli.PTTL(ctx, "missing").Result(); d != -2 || err != nil {
+        t.Errorf("%s: PTTL missing got %v, %v", name, d, err)
+    }
+    if ok, err := cli.Expire(ctx, "k", time.Hour).Result(); !ok || err != nil {
+        t.Errorf("%s: EXPIRE got %v, %v", name, ok, err)
+    }
+    if d, err := cli.PTTL(ctx, "k").Result(); d <= 59*time.Minute || err != nil {
+        t.Errorf("%s: PTTL after EXPIRE got %v, %v", name, d, err)
+    }
+    if ok, err := cli.Persist(ctx, "k").Result(); !ok || err != nil {
+        t.Errorf("%s: PERSIST got %v, %v", name, ok, err)
+    }
+    if ok, err := cli.Expire(ctx, "missing", time.Hour).Result(); ok || err != nil {
+        t.Errorf("%s: EXPIRE missing got %v, %v", name, ok, err)
+    }
+    tIfError(t, cli.Set(ctx, "short", "v", time.Millisecond*50).Err())
+    time.Sleep(time.Millisecond * 1100)
+    if _, err := cli.Get(ctx, "short").Result(); err != redis.Nil {
+        t.Errorf("%s: GET expired want nil, got %v", name, err)
+    }
+
+    tIfError(t, cli.MSet(ctx, "user:1", "a", "user:2", "b", "user:3", "c", "user:10", "e", "other", "d").Err())
+    if vs, err := cli.MGet(ctx, "user:1", "missing", "user:3").Result(); err != nil ||
+        !reflect.DeepEqual(vs, []interface{}{"a", nil, "c"}) {
+        t.Errorf("%s: MGET got %v, %v", name, vs, err)
+    }
+    if n, err := cli.Exists(ctx, "user:1", "user:1", "missing").Result(); n != 2 || err != nil {
+        t.Errorf("%s: EXISTS got %v, %v", name, n, err)
+    }
+    if keys, err := cli.Keys(ctx, "user:*").Result(); err != nil ||
+        !reflect.DeepEqual(keys, []string{"user:1", "user:10", "user:2", "user:3"}) {
+        t.Errorf("%s: KEYS got %v, %v", name, keys, err)
+    }
+    var scanned []string
+    cursor := uint64(0)
+    for i := 0; ; i++ {
+        keys, next, err := cli.Scan(ctx, cursor, "user:?", 1).Result()
+        if err != nil || i > 10 {
+            t.Fatalf("%s: SCAN got %v after %d calls", name, err, i)
+        }
+        scanned = append(scanned, keys...)
+        if cursor = next; cursor == 0 {
+            break
+        }
+    }
+    sort.Strings(scanned)
+    if !reflect.DeepEqual(scanned, []string{"user:1", "user:2", "user:3"}) {
+        t.Errorf("%s: SCAN got %v", name, scanned)
+    }
+    // count 过大时 cursor + count 溢出会使 RangeKeys 的 max 为负数
+    for _, count := range []string{"9223372036854775807", "2147483647"} {
+        if err := cli.Do(ctx, "scan", "1", "count", count).Err(); err == nil || !strings.Contains(err.Error(), "out of range") {
+            t.Errorf("%s: SCAN COUNT %s got %v", name, count, err)
+        }
+    }
+    if err := cli.Do(ctx, "scan", "9223372036854775807").Err(); err == nil {
+        t.Errorf("%s: SCAN huge cursor want error", name)
+    }
+    if err := cli.Ping(ctx).Err(); err != nil {
+        t.Fatalf("%s: server died after SCAN overflow: %v", name, err)
+    }
+    if n, err := cli.Del(ctx, "user:1", "user:2", "missing").Result(); n != 2 || err != nil {
+        t.Errorf("%s: DEL got %v, %v", name, n, err)
+    }
+    if n, err := cli.Exists(ctx, "user:1").Result(); n != 0 || err != nil {
+        t.Errorf("%s: EXISTS after DEL got %v, %v", name, n, err)
+    }
+
+    if n, err := cli.IncrBy(ctx, "counter", 41).Result(); n != 41 || err != nil {
+        t.Errorf("%s: INCRBY got %v, %v", name, n, err)
+    }
+    if n, err := cli.Incr(ctx, "counter").Result(); n != 42 || err != nil {
+        t.Errorf("%s: INCR got %v, %v", name, n, err)
+    }
+    if n, err := cli.DecrBy(ctx, "counter", 2).Result(); n != 40 || err != nil {
+        t.Errorf("%s: DECRBY got %v, %v", name, n, err)
+    }
+    if err := cli.Incr(ctx, "other").Err(); err == nil || !strings.Contains(err.Error(), "not an integer") {
+        t.Errorf("%s: INCR text got %v", name, err)
+    }
+    if err := cli.Do(ctx, "hgetall", "k").Err(); err == nil || !strings.Contains(err.Error(), "unknown command") {
+        t.Errorf("%s: unknown command got %v", name, err)
+    }
+}
+
+func TestRESP(t *testing.T) {
+    for name, s := range openTestStores(t) {
+        if name == "lru" {
+            // 容量太小, 测试中的 key 会被淘汰
+            tIfError(t, s.Close())
+            continue
+        }
+        testRESP(t, name, s)
+        tIfError(t, s.Close())
+    }
+}
@@ -1,8 +1,25 @@
 package tests
 
 import (
+    "bufio"
+    "context"
+    "crypto/md5"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "github.com/DGHeroin/store"
     "github.com/DGHeroin/store/store/StoreS3"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
     "testing"
+    "time"
 )
 
 func TestS3(t *testing.T) {
@@ -12,3 +29,400 @@ func TestS3(t *testing.T) {
     s := StoreS3.New("666", endpoint, accessKeyID, secretAccessKey)
     doTestStore(t, s)
 }
+
+type (
+    // fakeS3 只实现 StoreS3 用到的接口: 单个 PUT 上传, 服务端复制, ListObjectsV2 (可带 MinIO 的 metadata 扩展)
+    fakeS3 struct {
+        mu      sync.Mutex
+        buckets map[string]map[string]*fakeObject
+        // listMetadata 为 false 时列举结果不带 user-metadata, 和 AWS S3 一致
+        listMetadata bool
+    }
+    fakeObject struct {
+        data    []byte
+        meta    http.Header
+        etag    string
+        modTime time.Time
+    }
+    fakeMetaEntry struct {
+        XMLName xml.Name
+        Value   string `xml:",chardata"`
+    }
+    fakeListEntry struct {
+        Key          string
+        LastModified string
+        ETag         string
+        Size         int
+        UserMetadata *struct {
+            Entries []fakeMetaEntry
+        } `xml:",omitempty"`
+    }
+    fakeListResult struct {
+        XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+        Name                  string
+        Prefix                string
+        KeyCount              int
+        MaxKeys               int
+        IsTruncated           bool
+        NextContinuationToken string `xml:",omitempty"`
+        Contents              []fakeListEntry
+    }
+)
+
+// newFakeS3 启动一个本地的 S3 兼容服务, 返回可以传给 store.Open 的 DSN
+func newFakeS3(t *testing.T, bucket string, listMetadata bool) (*fakeS3, string) {
+    f := &fakeS3{buckets: map[string]map[string]*fakeObject{}, listMetadata: listMetadata}
+    srv := httptest.NewServer(f)
+    t.Cleanup(srv.Close)
+    return f, fmt.Sprintf("s3://key:secret@%s/%s?secure=false", strings.TrimPrefix(srv.URL, "http://"), bucket)
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(status)
+    _, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+    bucket, key := parts[0], ""
+    if len(parts) == 2 {
+        key = parts[1]
+    }
+    objects, ok := f.buckets[bucket]
+    q := r.URL.Query()
+    _, location := q["location"]
+    switch {
+    case key == "" && r.Method == http.MethodGet && location:
+        _, _ = io.WriteString(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+    case key == "" && r.Method == http.MethodPut:
+        if !ok {
+            f.buckets[bucket] = map[string]*fakeObject{}
+        }
+    case !ok:
+        f.fail(w, http.StatusNotFound, "NoSuchBucket")
+    case key == "" && r.Method == http.MethodHead:
+    case key == "" && r.Method == http.MethodGet:
+        f.list(w, bucket, objects, q)
+    case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+        f.copy(w, r, objects, key)
+    case (r.Method == http.MethodPut || r.Method == http.MethodDelete) && !conditionMet(objects[key], r.Header):
+        f.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+    case r.Method == http.MethodPut:
+        data, err := readFakeBody(r)
+        if err != nil {
+            f.fail(w, http.StatusBadRequest, "IncompleteBody")
+            return
+        }
+        obj := newFakeObject(data, r.Header)
+        objects[key] = obj
+        w.Header().Set("ETag", `"`+obj.etag+`"`)
+    case r.Method == http.MethodDelete:
+        delete(objects, key)
+        w.WriteHeader(http.StatusNoContent)
+    case r.Method == http.MethodGet || r.Method == http.MethodHead:
+        obj, ok := objects[key]
+        if !ok {
+            f.fail(w, http.StatusNotFound, "NoSuchKey")
+            return
+        }
+        if m := r.Header.Get("If-Match"); m != "" && strings.Trim(m, `"`) != obj.etag {
+            f.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+            return
+        }
+        for k, v := range obj.meta {
+            w.Header()[k] = v
+        }
+        w.Header().Set("ETag", `"`+obj.etag+`"`)
+        w.Header().Set("Last-Modified", obj.modTime.Format(http.TimeFormat))
+        w.Header().Set("Content-Type", "application/octet-stream")
+        w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+        if r.Method == http.MethodGet {
+            _, _ = w.Write(obj.data)
+        }
+    default:
+        f.fail(w, http.StatusNotImplemented, "NotImplemented")
+    }
+}
+
+// conditionMet 写入和删除的 If-Match / If-None-Match
+func conditionMet(obj *fakeObject, h http.Header) bool {
+    if m := h.Get("If-Match"); m != "" {
+        if obj == nil || strings.Trim(m, `"`) != obj.etag {
+            return false
+        }
+    }
+    if h.Get("If-None-Match") == "*" && obj != nil {
+        return false
+    }
+    return true
+}
+
+func newFakeObject(data []byte, h http.Header) *fakeObject {
+    sum := md5.Sum(data)
+    obj := &fakeObject{data: data, meta: http.Header{}, etag: hex.EncodeToString(sum[:]), modTime: time.Now().UTC()}
+    for k, v := range h {
+        if strings.HasPrefix(k, "X-Amz-Meta-") {
+            obj.meta[k] = v
+        }
+    }
+    return obj
+}
+
+// readFakeBody 解码 minio-go 在非 TLS 连接上使用的 aws-chunked 流式签名上传
+func readFakeBody(r *http.Request) ([]byte, error) {
+    if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+        return ioutil.ReadAll(r.Body)
+    }
+    var data []byte
+    br := bufio.NewReader(r.Body)
+    for {
+        line, err := br.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+        if err != nil {
+            return nil, err
+        }
+        chunk := make([]byte, size+2)
+        if _, err := io.ReadFull(br, chunk); err != nil {
+            return nil, err
+        }
+        if size == 0 {
+            return data, nil
+        }
+        data = append(data, chunk[:size]...)
+    }
+}
+
+func (f *fakeS3) copy(w http.ResponseWriter, r *http.Request, objects map[string]*fakeObject, key string) {
+    src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+    parts := strings.SplitN(strings.TrimPrefix(src, "/"), "/", 2)
+    srcObjects, ok := f.buckets[parts[0]]
+    if !ok || len(parts) != 2 || srcObjects[parts[1]] == nil {
+        f.fail(w, http.StatusNotFound, "NoSuchKey")
+        return
+    }
+    obj := srcObjects[parts[1]]
+    if m := r.Header.Get("X-Amz-Copy-Source-If-Match"); m != "" && strings.Trim(m, `"`) != obj.etag {
+        f.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+        return
+    }
+    meta := obj.meta
+    if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+        meta = newFakeObject(nil, r.Header).meta
+    }
+    copied := newFakeObject(obj.data, meta)
+    objects[key] = copied
+    _, _ = fmt.Fprintf(w, `<CopyObjectResult><LastModified>%s</LastModified><ETag>"%s"</ETag></CopyObjectResult>`,
+        copied.modTime.Format(time.RFC3339), copied.etag)
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, objects map[string]*fakeObject, q url.Values) {
+    maxKeys := 1000
+    if v, err := strconv.Atoi(q.Get("max-keys")); err == nil && v > 0 && v < maxKeys {
+        maxKeys = v
+    }
+    after := q.Get("start-after")
+    if token := q.Get("continuation-token"); token > after {
+        after = token
+    }
+    var keys []string
+    for key := range objects {
+        if strings.HasPrefix(key, q.Get("prefix")) && key > after {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    result := fakeListResult{Name: bucket, Prefix: q.Get("prefix"), MaxKeys: maxKeys}
+    if len(keys) > maxKeys {
+        keys = keys[:maxKeys]
+        result.IsTruncated = true
+        result.NextContinuationToken = keys[maxKeys-1]
+    }
+    for _, key := range keys {
+        obj := objects[key]
+        entry := fakeListEntry{Key: key, LastModified: obj.modTime.Format(time.RFC3339), ETag: `"` + obj.etag + `"`, Size: len(obj.data)}
+        if f.listMetadata && q.Get("metadata") == "true" {
+            entry.UserMetadata = &struct{ Entries []fakeMetaEntry }{}
+            for k := range obj.meta {
+                entry.UserMetadata.Entries = append(entry.UserMetadata.Entries, fakeMetaEntry{XMLName: xml.Name{Local: k}, Value: obj.meta.Get(k)})
+            }
+        }
+        result.Contents = append(result.Contents, entry)
+    }
+    result.KeyCount = len(result.Contents)
+    w.Header().Set("Content-Type", "application/xml")
+    _ = xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3TTL(t *testing.T) {
+    for _, listMetadata := range []bool{true, false} {
+        _, dsn := newFakeS3(t, "ttl", listMetadata)
+        s, err := store.Open(dsn)
+        if err != nil {
+            t.Fatal(err)
+        }
+        tIfError(t, s.PutTTL("short", []byte("a"), time.Millisecond*300))
+        tIfError(t, s.PutTTL("long", []byte("b"), time.Hour))
+        tIfError(t, s.Put("forever", []byte("c")))
+        if ttl, err := s.TTL("long"); err != nil || ttl < time.Minute*59 || ttl > time.Hour+time.Second {
+            t.Errorf("ttl got %v %v", ttl, err)
+        }
+        if ttl, err := s.TTL("forever"); err != nil || ttl != 0 {
+            t.Errorf("ttl without expiry got %v %v", ttl, err)
+        }
+        if data, err := s.Get("short"); err != nil || string(data) != "a" {
+            t.Errorf("get before expiry got %q %v", data, err)
+        }
+        time.Sleep(time.Millisecond * 400)
+
+        if _, err := s.Get("short"); !store.IsNotFound(err) {
+            t.Error("get expired want ErrNotFound, got", err)
+        }
+        if _, err := s.RGet("short"); !store.IsNotFound(err) {
+            t.Error("rget expired want ErrNotFound, got", err)
+        }
+        if ok, err := s.Exist("short"); ok || err != nil {
+            t.Error("exist expired got", ok, err)
+        }
+        if _, err := s.TTL("short"); !store.IsNotFound(err) {
+            t.Error("ttl expired want ErrNotFound, got", err)
+        }
+        infos, err := s.RangeKeys("", "", 100)
+        tIfError(t, err)
+        if got := strings.Join(infos.ToKeys(), ","); got != "forever,long" {
+            t.Errorf("range keys with metadata=%v got %s", listMetadata, got)
+        }
+        var ranged []string
+        tIfError(t, s.Range("", "", func(key string, value []byte) bool {
+            ranged = append(ranged, key)
+            return true
+        }))
+        if got := strings.Join(ranged, ","); got != "forever,long" {
+            t.Errorf("range got %s", got)
+        }
+
+        // 过期的对象视为不存在, 条件写入可以覆盖; 修改值时保留过期时间
+        ok, err := store.PutIfAbsent(s, "short", []byte("d"), time.Hour)
+        if !ok || err != nil {
+            t.Error("put if absent over expired got", ok, err)
+        }
+        ok, err = store.CompareAndSwap(s, "short", []byte("d"), []byte("e"))
+        if !ok || err != nil {
+            t.Error("compare and swap got", ok, err)
+        }
+        if ttl, _ := s.TTL("short"); ttl < time.Minute*59 {
+            t.Error("compare and swap dropped ttl, got", ttl)
+        }
+        tIfError(t, store.Expire(s, "long", time.Minute))
+        if ttl, _ := s.TTL("long"); ttl <= 0 || ttl > time.Minute+time.Second {
+            t.Error("ttl after Expire got", ttl)
+        }
+        tIfError(t, store.Persist(s, "long"))
+        if ttl, _ := s.TTL("long"); ttl != 0 {
+            t.Error("ttl after Persist got", ttl)
+        }
+        tIfError(t, s.Close())
+    }
+}
+
+// TestS3CAS 两个客户端模拟两个进程, 进程内的 key 锁互不可见, 只能依靠条件 PUT 保证原子性
+func TestS3CAS(t *testing.T) {
+    _, dsn := newFakeS3(t, "cas", true)
+    var clients []store.Store
+    for i := 0; i < 2; i++ {
+        s, err := store.Open(dsn)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer s.Close()
+        clients = append(clients, s)
+    }
+    testCounter(t, "s3", clients[0])
+
+    var wg sync.WaitGroup
+    for _, s := range clients {
+        for i := 0; i < 2; i++ {
+            wg.Add(1)
+            go func(s store.Store) {
+                defer wg.Done()
+                for j := 0; j < 20; j++ {
+                    if _, err := store.IncrBy(s, "shared", 1); err != nil {
+                        t.Error("incr by got", err)
+                        return
+                    }
+                }
+            }(s)
+        }
+    }
+    wg.Wait()
+    if data, err := clients[1].Get("shared"); err != nil || string(data) != "80" {
+        t.Errorf("concurrent incr got %q, %v", data, err)
+    }
+
+    // 读取之后被另一个客户端修改, 条件写入失败
+    tIfError(t, clients[0].Put("k", []byte("a")))
+    ok, err := store.PutIfAbsent(clients[1], "k", []byte("b"), 0)
+    if ok || err != nil {
+        t.Error("put if absent existing got", ok, err)
+    }
+    ok, err = store.DeleteIf(clients[1], "k", []byte("a"))
+    if !ok || err != nil {
+        t.Error("delete if got", ok, err)
+    }
+}
+
+func TestS3Sweeper(t *testing.T) {
+    for _, listMetadata := range []bool{true, false} {
+        f, dsn := newFakeS3(t, "sweep", listMetadata)
+        s, err := store.Open(dsn)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i := 0; i < 5; i++ {
+            tIfError(t, s.PutTTL(fmt.Sprintf("expired_%d", i), []byte{1}, time.Millisecond*100))
+            tIfError(t, s.PutTTL(fmt.Sprintf("live_%d", i), []byte{2}, time.Hour))
+        }
+        time.Sleep(time.Millisecond * 200)
+
+        sw, err := store.StartSweeper(s, store.SweeperOptions{Interval: time.Hour, Budget: 3})
+        tIfError(t, err)
+        removed := 0
+        for i := 0; i < 4; i++ {
+            n, err := sw.SweepOnce(context.Background())
+            tIfError(t, err)
+            removed += n
+        }
+        if removed != 5 {
+            t.Errorf("metadata=%v: sweeper removed %d objects, want 5", listMetadata, removed)
+        }
+        f.mu.Lock()
+        if n := len(f.buckets["sweep"]); n != 5 {
+            t.Errorf("metadata=%v: %d objects left, want 5", listMetadata, n)
+        }
+        f.mu.Unlock()
+        tIfError(t, s.Close())
+    }
+
+    f, dsn := newFakeS3(t, "sweepdsn", true)
+    s, err := store.Open(dsn + "&sweep=20ms")
+    if err != nil {
+        t.Fatal(err)
+    }
+    tIfError(t, s.PutTTL("expired", []byte{1}, time.Millisecond*50))
+    left := 1
+    for deadline := time.Now().Add(time.Second * 2); left > 0 && time.Now().Before(deadline); {
+        time.Sleep(time.Millisecond * 20)
+        f.mu.Lock()
+        left = len(f.buckets["sweepdsn"])
+        f.mu.Unlock()
+    }
+    if left != 0 {
+        t.Error("sweep from dsn did not remove expired object")
+    }
+    tIfError(t, s.Close())
+}
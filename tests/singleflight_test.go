@@ -0,0 +1,144 @@
+package tests
+
+import (
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+type blockingStore struct {
+    store.Store
+    gets    int32
+    release chan struct{}
+}
+
+func (s *blockingStore) Get(key string) ([]byte, error) {
+    atomic.AddInt32(&s.gets, 1)
+    <-s.release
+    return s.Store.Get(key)
+}
+
+func testCoalesce(t *testing.T, name string, s store.Store, backend *blockingStore, stats func() map[string]store.SingleflightStats) {
+    const n = 50
+    var wg sync.WaitGroup
+    for i := 0; i < n; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if data, err := s.Get("hot"); err != nil || len(data) != 1 {
+                t.Error(name, "get:", data, err)
+            }
+        }()
+    }
+    deadline := time.Now().Add(time.Second * 5)
+    for stats()["hot"].Calls < n && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+    close(backend.release)
+    wg.Wait()
+    if gets := atomic.LoadInt32(&backend.gets); gets != 1 {
+        t.Error(name, "backend gets:", gets)
+    }
+    if st := stats()["hot"]; st.Calls != n || st.Collapsed != n-1 {
+        t.Error(name, "stats:", st)
+    }
+}
+
+func TestSingleflight(t *testing.T) {
+    backend := &blockingStore{Store: StoreMemory.New(), release: make(chan struct{})}
+    tIfError(t, backend.Put("hot", []byte{1}))
+    sf := store.NewSingleflight(backend)
+    testCoalesce(t, "wrapper", sf, backend, sf.Stats)
+
+    backend = &blockingStore{Store: StoreMemory.New(), release: make(chan struct{})}
+    tIfError(t, backend.Put("hot", []byte{1}))
+    c := store.NewChainWithOptions(store.ChainOptions{Singleflight: true}, StoreMemory.New(), backend)
+    testCoalesce(t, "chain", c, backend, c.SingleflightStats)
+}
+
+// staleStore 第一次 Get 先读取旧值再阻塞, 模拟写入之前开始的慢查询
+type staleStore struct {
+    store.Store
+    gets    int32
+    release chan struct{}
+}
+
+func (s *staleStore) Get(key string) ([]byte, error) {
+    data, err := s.Store.Get(key)
+    if atomic.AddInt32(&s.gets, 1) == 1 {
+        <-s.release
+    }
+    return data, err
+}
+
+func testReadYourWrite(t *testing.T, name string, s store.Store, backend *staleStore) {
+    tIfError(t, backend.Put("k", []byte("old")))
+    first := make(chan []byte, 1)
+    go func() {
+        data, _ := s.Get("k")
+        first <- data
+    }()
+    for atomic.LoadInt32(&backend.gets) == 0 {
+        time.Sleep(time.Millisecond)
+    }
+    tIfError(t, s.Put("k", []byte("new")))
+    second := make(chan []byte, 1)
+    go func() {
+        data, _ := s.Get("k")
+        second <- data
+    }()
+    select {
+    case data := <-second:
+        if string(data) != "new" {
+            t.Errorf("%s: get after put got %q", name, data)
+        }
+    case <-time.After(time.Second):
+        t.Errorf("%s: get after put joined the stale lookup", name)
+    }
+    close(backend.release)
+    <-first
+}
+
+func TestSingleflightReadYourWrite(t *testing.T) {
+    backend := &staleStore{Store: StoreMemory.New(), release: make(chan struct{})}
+    testReadYourWrite(t, "wrapper", store.NewSingleflight(backend), backend)
+
+    backend = &staleStore{Store: StoreMemory.New(), release: make(chan struct{})}
+    c := store.NewChainWithOptions(store.ChainOptions{Singleflight: true}, StoreMemory.New(), backend)
+    testReadYourWrite(t, "chain", c, backend)
+}
+
+func TestSingleflightExtensions(t *testing.T) {
+    s := store.NewSingleflight(StoreMemory.New())
+    tIfError(t, s.Put("k", []byte("a")))
+    if ok, err := store.CompareAndSwap(s, "k", []byte("a"), []byte("b")); !ok || err != nil {
+        t.Error("CompareAndSwap:", ok, err)
+    }
+    if n, err := store.IncrBy(s, "n", 2); n != 2 || err != nil {
+        t.Error("IncrBy:", n, err)
+    }
+    tIfError(t, store.MPut(s, map[string][]byte{"m1": []byte("1"), "m2": []byte("2")}))
+    tIfError(t, store.Update(s, func(tx store.Txn) error {
+        return tx.Delete("m1")
+    }))
+    if _, err := s.Get("m1"); !store.IsNotFound(err) {
+        t.Error("Get after txn delete:", err)
+    }
+    tIfError(t, store.Expire(s, "m2", -time.Second))
+    if _, err := s.Get("m2"); !store.IsNotFound(err) {
+        t.Error("Get after expire:", err)
+    }
+
+    // 被包装的 Store 不支持时返回 ErrNotSupported, 批量操作逐个 key 执行
+    plain := store.NewSingleflight(&blockingStore{Store: StoreMemory.New()})
+    if _, err := store.CompareAndSwap(plain, "k", nil, nil); err != store.ErrNotSupported {
+        t.Error("CompareAndSwap on plain store:", err)
+    }
+    if err := store.Update(plain, func(tx store.Txn) error { return nil }); err != store.ErrNotSupported {
+        t.Error("Update on plain store:", err)
+    }
+    tIfError(t, store.MDelete(plain, "k"))
+}
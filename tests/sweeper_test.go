@@ -0,0 +1,94 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "testing"
+    "time"
+)
+
+func TestSweeper(t *testing.T) {
+    stores := openTestStores(t)
+    delete(stores, "chain")
+    for _, s := range stores {
+        for i := 0; i < 5; i++ {
+            tIfError(t, s.PutTTL(fmt.Sprintf("expired_%d", i), []byte{1}, time.Second))
+            tIfError(t, s.Put(fmt.Sprintf("live_%d", i), []byte{2}))
+        }
+    }
+    time.Sleep(time.Millisecond * 2100)
+
+    sweepers := map[string]*store.Sweeper{}
+    for name, s := range stores {
+        sw, err := store.StartSweeper(s, store.SweeperOptions{Interval: time.Millisecond * 20, Budget: 3})
+        if err != nil {
+            t.Fatal(name, err)
+        }
+        sweepers[name] = sw
+    }
+    deadline := time.Now().Add(time.Second * 2)
+    for name, sw := range sweepers {
+        for sw.Removed() < 5 && time.Now().Before(deadline) {
+            time.Sleep(time.Millisecond * 10)
+        }
+        if n := sw.Removed(); n != 5 {
+            t.Errorf("%s: sweeper removed %d keys, want 5", name, n)
+        }
+        if sw.Passes() < 2 {
+            t.Errorf("%s: budget not respected, %d passes", name, sw.Passes())
+        }
+    }
+    for name, s := range stores {
+        // budget <= 0 使用默认值
+        for _, budget := range []int{0, -1} {
+            if removed, _, err := s.(store.Sweepable).SweepExpired(context.Background(), "", budget); removed != 0 || err != nil {
+                t.Errorf("%s: sweep budget %d got %d %v", name, budget, removed, err)
+            }
+        }
+        removed, next, err := s.(store.Sweepable).SweepExpired(context.Background(), "", 100)
+        if removed != 0 || next != "" || err != nil {
+            t.Errorf("%s: second sweep want 0, got %d %q %v", name, removed, next, err)
+        }
+        if data, err := s.Get("live_4"); err != nil || data[0] != 2 {
+            t.Errorf("%s: live key swept: %v %v", name, data, err)
+        }
+        tIfError(t, s.Close())
+        passes := sweepers[name].Passes()
+        time.Sleep(time.Millisecond * 50)
+        if sweepers[name].Passes() != passes {
+            t.Errorf("%s: sweeper still running after Close", name)
+        }
+    }
+}
+
+func TestSweeperOpen(t *testing.T) {
+    s, err := store.Open("memory?sweep=10ms&sweep_budget=1")
+    tIfError(t, err)
+    tIfError(t, s.PutTTL("key", []byte{1}, time.Second))
+    tIfError(t, s.Close())
+
+    if _, err := store.Open("memory?sweep=soon"); err == nil {
+        t.Error("invalid sweep accepted")
+    }
+    if _, err := store.StartSweeper(store.NewChain(StoreMemory.New()), store.SweeperOptions{}); !errors.Is(err, store.ErrNotSupported) {
+        t.Error("chain sweeper want ErrNotSupported, got", err)
+    }
+    for _, text := range []string{
+        "buckets: {a: {type: memory, sweep_budget: 10}}",
+        "buckets: {a: {type: redis, addr: x, sweep_interval: 1m}}",
+    } {
+        cfg, err := store.ParseConfig([]byte(text))
+        tIfError(t, err)
+        if err := cfg.Validate(); err == nil {
+            t.Error("invalid sweep config accepted:", text)
+        }
+    }
+    cfg, err := store.ParseConfig([]byte("buckets: {a: {type: lru, size: 10, sweep_interval: 1m, sweep_budget: 10}}"))
+    tIfError(t, err)
+    stores, err := cfg.Build()
+    tIfError(t, err)
+    tIfError(t, stores["a"].Close())
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+    "errors"
+    "github.com/DGHeroin/store"
+    "strconv"
+    "testing"
+)
+
+func testTxn(t *testing.T, name string, s store.Store) {
+    tIfError(t, s.Put("txn_a", []byte("100")))
+    tIfError(t, s.Put("txn_b", []byte("0")))
+    transfer := func(amount int) error {
+        return store.Update(s, func(tx store.Txn) error {
+            a, err := tx.Get("txn_a")
+            if err != nil {
+                return err
+            }
+            b, err := tx.Get("txn_b")
+            if err != nil {
+                return err
+            }
+            na, _ := strconv.Atoi(string(a))
+            nb, _ := strconv.Atoi(string(b))
+            if err := tx.Put("txn_b", []byte(strconv.Itoa(nb+amount))); err != nil {
+                return err
+            }
+            if na < amount {
+                return errors.New("insufficient")
+            }
+            return tx.Put("txn_a", []byte(strconv.Itoa(na-amount)))
+        })
+    }
+    tIfError(t, transfer(30))
+    if err := transfer(80); err == nil {
+        t.Errorf("%s: transfer should fail", name)
+    }
+    a, _ := s.Get("txn_a")
+    b, _ := s.Get("txn_b")
+    if string(a) != "70" || string(b) != "30" {
+        t.Errorf("%s: partial write, a=%s b=%s", name, a, b)
+    }
+
+    tIfError(t, store.Update(s, func(tx store.Txn) error {
+        if err := tx.Delete("txn_a"); err != nil {
+            return err
+        }
+        if _, err := tx.Get("txn_a"); !errors.Is(err, store.ErrNotFound) {
+            t.Errorf("%s: deleted key visible in txn: %v", name, err)
+        }
+        if err := tx.Put("txn_c", []byte("1")); err != nil {
+            return err
+        }
+        var keys []string
+        err := tx.Range("txn_", "txo", func(key string, value []byte) bool {
+            keys = append(keys, key)
+            return true
+        })
+        if len(keys) != 2 || keys[0] != "txn_b" || keys[1] != "txn_c" {
+            t.Errorf("%s: Range in txn got %v", name, keys)
+        }
+        return err
+    }))
+    if ok, _ := s.Exist("txn_a"); ok {
+        t.Errorf("%s: delete not committed", name)
+    }
+}
+
+func TestTxn(t *testing.T) {
+    stores := openTestStores(t)
+    for _, name := range []string{"memory", "bolt", "leveldb"} {
+        testTxn(t, name, stores[name])
+    }
+    if err := store.Update(stores["chain"], func(tx store.Txn) error { return nil }); !errors.Is(err, store.ErrNotSupported) {
+        t.Error("Update on chain:", err)
+    }
+}
@@ -0,0 +1,236 @@
+package tests
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "github.com/DGHeroin/store"
+    "github.com/DGHeroin/store/store/StoreMemory"
+    "github.com/DGHeroin/store/store/StoreMemoryLru"
+    "sort"
+    "testing"
+    "time"
+)
+
+// takeEvents 读取 n 个事件, 格式为 type:key:size
+func takeEvents(t *testing.T, ch <-chan store.Event, n int) (result []string) {
+    t.Helper()
+    var rev uint64
+    for len(result) < n {
+        select {
+        case ev, ok := <-ch:
+            if !ok {
+                t.Fatalf("watch closed after %v", result)
+            }
+            if ev.Revision <= rev {
+                t.Errorf("revision %d after %d", ev.Revision, rev)
+            }
+            rev = ev.Revision
+            result = append(result, fmt.Sprintf("%s:%s:%d", ev.Type, ev.Key, ev.Size))
+        case <-time.After(time.Second * 2):
+            t.Fatalf("timeout after %v", result)
+        }
+    }
+    return
+}
+
+func expectNoEvent(t *testing.T, name string, ch <-chan store.Event) {
+    t.Helper()
+    select {
+    case ev := <-ch:
+        t.Errorf("%s: unexpected event %+v", name, ev)
+    case <-time.After(time.Millisecond * 50):
+    }
+}
+
+func expectClosed(t *testing.T, name string, ch <-chan store.Event) {
+    t.Helper()
+    timeout := time.After(time.Second * 2)
+    for {
+        select {
+        case _, ok := <-ch:
+            if !ok {
+                return
+            }
+        case <-timeout:
+            t.Fatalf("%s: watch not closed", name)
+        }
+    }
+}
+
+func TestWatch(t *testing.T) {
+    stores := openTestStores(t)
+    delete(stores, "chain")
+    for name, s := range stores {
+        ctx, cancel := context.WithCancel(context.Background())
+        ch, err := store.Watch(ctx, s, "app/")
+        tIfError(t, err)
+
+        tIfError(t, s.Put("app/a", []byte("one")))
+        tIfError(t, s.Put("other", []byte("x")))
+        tIfError(t, store.MPut(s, map[string][]byte{"app/b": []byte("two!")}))
+        tIfError(t, s.Delete("app/a"))
+        tIfError(t, s.Delete("app/missing"))
+        _, err = store.IncrBy(s, "app/n", 1)
+        tIfError(t, err)
+        tIfError(t, store.ExpireAt(s, "app/b", time.Now().Add(-time.Second)))
+        want := []string{"put:app/a:3", "put:app/b:4", "delete:app/a:0", "put:app/n:1", "delete:app/b:0"}
+        if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Errorf("%s: events got %v, want %v", name, got, want)
+        }
+
+        tIfError(t, s.PutTTL("app/x", []byte("x"), time.Millisecond*50))
+        time.Sleep(time.Millisecond * 100)
+        _, _, err = s.(store.Sweepable).SweepExpired(context.Background(), "", 100)
+        tIfError(t, err)
+        want = []string{"put:app/x:1", "expire:app/x:0"}
+        if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Errorf("%s: expire events got %v, want %v", name, got, want)
+        }
+
+        if ts, ok := s.(store.TxnStore); ok {
+            rollback := errors.New("rollback")
+            if err := ts.Update(func(tx store.Txn) error {
+                if err := tx.Put("app/r", []byte{1}); err != nil {
+                    return err
+                }
+                return rollback
+            }); err != rollback {
+                t.Errorf("%s: txn want rollback, got %v", name, err)
+            }
+            expectNoEvent(t, name, ch)
+            tIfError(t, ts.Update(func(tx store.Txn) error {
+                if err := tx.Put("app/t", []byte{1, 2}); err != nil {
+                    return err
+                }
+                return tx.Delete("app/n")
+            }))
+            // 事务内不同 key 的事件顺序不确定
+            want = []string{"delete:app/n:0", "put:app/t:2"}
+            got := takeEvents(t, ch, len(want))
+            if sort.Strings(got); fmt.Sprint(got) != fmt.Sprint(want) {
+                t.Errorf("%s: txn events got %v, want %v", name, got, want)
+            }
+        }
+
+        cancel()
+        expectClosed(t, name, ch)
+        ch, err = store.Watch(context.Background(), s, "")
+        tIfError(t, err)
+        tIfError(t, s.Close())
+        expectClosed(t, name, ch)
+    }
+
+    if _, err := store.Watch(context.Background(), plainStore{StoreMemory.New()}, ""); !errors.Is(err, store.ErrNotSupported) {
+        t.Error("plain store Watch want ErrNotSupported, got", err)
+    }
+}
+
+func TestWatchOverflow(t *testing.T) {
+    s := StoreMemory.New()
+    ch, err := store.Watch(context.Background(), s, "")
+    tIfError(t, err)
+    for i := 0; i <= store.WatchBuffer; i++ {
+        tIfError(t, s.Put("k", []byte{1}))
+    }
+    // 缓冲区满后被注销, 已缓冲的事件仍然可以读取
+    if got := takeEvents(t, ch, store.WatchBuffer); len(got) != store.WatchBuffer {
+        t.Error("buffered events:", len(got))
+    }
+    expectClosed(t, "overflow", ch)
+}
+
+func TestWatchEvict(t *testing.T) {
+    s := StoreMemoryLru.New(1, nil)
+    ch, err := store.Watch(context.Background(), s, "")
+    tIfError(t, err)
+    tIfError(t, s.Put("a", []byte{1}))
+    tIfError(t, s.Put("b", []byte{2}))
+    want := []string{"put:a:1", "put:b:1", "evict:a:0"}
+    if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("events got %v, want %v", got, want)
+    }
+    tIfError(t, s.Close())
+}
+
+func TestChainWatch(t *testing.T) {
+    front, back := StoreMemory.New(), StoreMemory.New()
+    c := store.NewChainWithOptions(store.ChainOptions{ReadThrough: true}, front, back)
+    ctx, cancel := context.WithCancel(context.Background())
+    ch, err := store.Watch(ctx, c, "")
+    tIfError(t, err)
+
+    // 同一次写入在两层各产生一个事件, 只转发一次
+    tIfError(t, c.Put("a", []byte("one")))
+    tIfError(t, c.Put("a", []byte("two")))
+    want := []string{"put:a:3", "put:a:3"}
+    if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("chain put events got %v, want %v", got, want)
+    }
+    expectNoEvent(t, "chain put", ch)
+
+    // 直接写入最后一层的变更也会转发, 回填不产生事件
+    tIfError(t, back.Put("b", []byte("bb")))
+    want = []string{"put:b:2"}
+    if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("back put events got %v, want %v", got, want)
+    }
+    if _, err := c.Get("b"); err != nil {
+        t.Fatal(err)
+    }
+    if ok, _ := front.Exist("b"); !ok {
+        t.Fatal("read through did not promote")
+    }
+    expectNoEvent(t, "read through", ch)
+
+    // 前面各层的过期和删除只是缓存行为
+    tIfError(t, front.Delete("b"))
+    expectNoEvent(t, "front delete", ch)
+    tIfError(t, c.Delete("a"))
+    want = []string{"delete:a:0"}
+    if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("chain delete events got %v, want %v", got, want)
+    }
+    expectNoEvent(t, "chain delete", ch)
+
+    cancel()
+    expectClosed(t, "chain", ch)
+
+    // 最后一层不支持时返回已关闭的 channel
+    plain := store.NewChain(StoreMemory.New(), plainStore{StoreMemory.New()})
+    ch, err = store.Watch(context.Background(), plain, "")
+    tIfError(t, err)
+    expectClosed(t, "plain chain", ch)
+    tIfError(t, c.Close())
+}
+
+func TestChainWatchTombstone(t *testing.T) {
+    front, back := StoreMemory.New(), StoreMemory.New()
+    c := store.NewChainWithOptions(store.ChainOptions{TombstoneTTL: time.Minute}, front, back)
+    defer c.Close()
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    ch, err := store.Watch(ctx, c, "")
+    tIfError(t, err)
+
+    // 删除标记写入前面的层, 只转发最后一层的删除
+    tIfError(t, c.Put("a", []byte("one")))
+    want := []string{"put:a:3"}
+    if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("put events got %v, want %v", got, want)
+    }
+    expectNoEvent(t, "put", ch)
+    tIfError(t, c.Delete("a"))
+    want = []string{"delete:a:0"}
+    if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("tombstone events got %v, want %v", got, want)
+    }
+    expectNoEvent(t, "tombstone", ch)
+
+    // 与删除标记大小相同的普通值照常转发
+    tIfError(t, front.Put("b", []byte("0123456789abcdefghi")))
+    want = []string{"put:b:19"}
+    if got := takeEvents(t, ch, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+        t.Errorf("same size put events got %v, want %v", got, want)
+    }
+}
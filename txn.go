@@ -0,0 +1,37 @@
+package store
+
+import (
+    "context"
+    "time"
+)
+
+type (
+    // Txn 事务内的操作, 只能在 Update 的回调中使用
+    Txn interface {
+        Get(key string) ([]byte, error)
+        Put(key string, value []byte) error
+        PutTTL(key string, value []byte, ttl time.Duration) error
+        Delete(key string) error
+        Range(prefix, limit string, cb func(key string, value []byte) bool) error
+    }
+    // TxnStore 多 key 事务. 回调返回 nil 时所有写入原子地提交, 返回错误时全部丢弃;
+    // 事务期间其他写入会被阻塞, 回调中不要调用同一个 Store 的方法
+    TxnStore interface {
+        ContextStore
+        Update(fn func(tx Txn) error) error
+        UpdateContext(ctx context.Context, fn func(tx Txn) error) error
+    }
+)
+
+// Update 在 s 上执行事务, s 不支持事务时返回 ErrNotSupported
+func Update(s Store, fn func(tx Txn) error) error {
+    return UpdateContext(context.Background(), s, fn)
+}
+
+// UpdateContext ctx 在提交前结束时事务被丢弃
+func UpdateContext(ctx context.Context, s Store, fn func(tx Txn) error) error {
+    if ts, ok := s.(TxnStore); ok {
+        return ts.UpdateContext(ctx, fn)
+    }
+    return ErrNotSupported
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+    "bytes"
+    "encoding/binary"
+)
+
+// ExpiryIndexKey 过期索引的 key: prefix + 8 字节大端的过期时间 (Unix 毫秒) + 原始 key, 按过期时间排序
+func ExpiryIndexKey(prefix []byte, at int64, key []byte) []byte {
+    result := make([]byte, len(prefix)+8, len(prefix)+8+len(key))
+    copy(result, prefix)
+    binary.BigEndian.PutUint64(result[len(prefix):], uint64(at))
+    return append(result, key...)
+}
+
+// ParseExpiryIndexKey 解析 ExpiryIndexKey 生成的 key, 不是索引 key 时 ok 为 false
+func ParseExpiryIndexKey(prefix []byte, k []byte) (at int64, key []byte, ok bool) {
+    if !bytes.HasPrefix(k, prefix) || len(k) < len(prefix)+8 {
+        return 0, nil, false
+    }
+    k = k[len(prefix):]
+    return int64(binary.BigEndian.Uint64(k[:8])), k[8:], true
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+    "hash/fnv"
+    "sort"
+    "sync"
+)
+
+type (
+    // KeyLock 按 key 分段的互斥锁, 不同 key 可能落在同一段上
+    KeyLock struct {
+        locks [256]sync.Mutex
+    }
+)
+
+func NewKeyLock() *KeyLock {
+    return &KeyLock{}
+}
+
+func (l *KeyLock) slot(key string) int {
+    h := fnv.New32a()
+    _, _ = h.Write([]byte(key))
+    return int(h.Sum32() % uint32(len(l.locks)))
+}
+
+// Lock 锁住所有 key 所在的段, 按段的顺序加锁以避免死锁, 返回解锁函数
+func (l *KeyLock) Lock(keys ...string) (unlock func()) {
+    slots := make([]int, 0, len(keys))
+    seen := map[int]bool{}
+    for _, key := range keys {
+        if i := l.slot(key); !seen[i] {
+            seen[i] = true
+            slots = append(slots, i)
+        }
+    }
+    sort.Ints(slots)
+    for _, i := range slots {
+        l.locks[i].Lock()
+    }
+    return func() {
+        for j := len(slots) - 1; j >= 0; j-- {
+            l.locks[slots[j]].Unlock()
+        }
+    }
+}
+
+// LockAll 锁住所有段, 返回解锁函数
+func (l *KeyLock) LockAll() (unlock func()) {
+    for i := range l.locks {
+        l.locks[i].Lock()
+    }
+    return func() {
+        for i := len(l.locks) - 1; i >= 0; i-- {
+            l.locks[i].Unlock()
+        }
+    }
+}
@@ -46,26 +46,43 @@ func (c *LRU) Clear() {
     c.evictList.Init()
 }
 func (c *LRU) Add(key, value interface{}) (evicted bool) {
+    _, _, evicted = c.Push(key, value)
+    return
+}
+
+// Push 同 Add, 同时返回因容量限制被淘汰的项
+func (c *LRU) Push(key, value interface{}) (evictedKey, evictedValue interface{}, evicted bool) {
     c.mu.Lock()
     defer c.mu.Unlock()
     if ent, ok := c.items[key]; ok {
         c.evictList.MoveToFront(ent)
         ent.Value.(*entry).value = value
-        return false
+        return nil, nil, false
     }
-    ent := &entry{key, value}
-    entry := c.evictList.PushFront(ent)
-    c.items[key] = entry
+    c.items[key] = c.evictList.PushFront(&entry{key, value})
 
-    evict := c.evictList.Len() > c.size
-    if evict {
-        c.removeOldest()
+    if c.evictList.Len() > c.size {
+        if oldest := c.evictList.Back(); oldest != nil {
+            c.removeElement(oldest)
+            kv := oldest.Value.(*entry)
+            return kv.key, kv.value, true
+        }
+    }
+    return nil, nil, false
+}
+// Replace 替换已有 key 的值, 不改变顺序; key 不存在时返回 false
+func (c *LRU) Replace(key, value interface{}) (ok bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    ent, ok := c.items[key]
+    if ok {
+        ent.Value.(*entry).value = value
     }
-    return evict
+    return ok
 }
 func (c *LRU) Get(key interface{}) (value interface{}, ok bool) {
-    c.mu.RLock()
-    defer c.mu.RUnlock()
+    c.mu.Lock()
+    defer c.mu.Unlock()
     if ent, ok := c.items[key]; ok {
         c.evictList.MoveToFront(ent)
         if ent.Value.(*entry) == nil {
@@ -1,34 +1,182 @@
 package utils
 
 import (
-    "bytes"
     "encoding/binary"
+    "errors"
+    "hash/crc32"
     "time"
 )
 
+const (
+    // HeaderMagic 新格式数据的第一个字节; 旧格式以 4 字节的过期秒数开头, 2105 年之前不会是 0xfe
+    HeaderMagic = 0xfe
+    // HeaderVersion 当前的格式版本, 0 表示旧格式
+    HeaderVersion = 1
+
+    // FlagCompressed value 经过压缩, 由写入方负责编解码
+    FlagCompressed = 1 << 0
+    // FlagEncrypted value 经过加密, 由写入方负责编解码
+    FlagEncrypted = 1 << 1
+    // FlagChecksum header 后面附带 value 的 CRC32, 读取时校验
+    FlagChecksum = 1 << 2
+
+    legacyHeaderSize = 4
+    // headerSize magic, version, flags 各 1 字节, 8 字节大端的过期时间 (Unix 毫秒)
+    headerSize   = 11
+    checksumSize = 4
+)
+
+type (
+    // Header 数据头, ExpireAt 为 Unix 毫秒, 0 表示永不过期
+    Header struct {
+        Version  byte
+        Flags    byte
+        ExpireAt int64
+    }
+)
+
+var (
+    ErrCorruptData        = errors.New("utils: corrupt data")
+    ErrUnsupportedVersion = errors.New("utils: unsupported data version")
+)
+
+// Expired 在 now 时是否已过期
+func (h Header) Expired(now time.Time) bool {
+    return h.ExpireAt > 0 && time.Unix(0, h.ExpireAt*int64(time.Millisecond)).Before(now)
+}
+
+// EncodeData 按当前版本编码, 忽略 h.Version
+func EncodeData(h Header, val []byte) []byte {
+    size := headerSize
+    if h.Flags&FlagChecksum != 0 {
+        size += checksumSize
+    }
+    result := make([]byte, size, size+len(val))
+    result[0] = HeaderMagic
+    result[1] = HeaderVersion
+    result[2] = h.Flags
+    binary.BigEndian.PutUint64(result[3:headerSize], uint64(h.ExpireAt))
+    if h.Flags&FlagChecksum != 0 {
+        binary.BigEndian.PutUint32(result[headerSize:], crc32.ChecksumIEEE(val))
+    }
+    return append(result, val...)
+}
+
+// DecodeData 解析当前版本或旧格式的数据, 不检查是否过期; 返回的 value 引用 data
+func DecodeData(data []byte) (Header, []byte, error) {
+    if len(data) == 0 || data[0] != HeaderMagic {
+        if len(data) < legacyHeaderSize {
+            return Header{}, nil, ErrCorruptData
+        }
+        sec := binary.BigEndian.Uint32(data[:legacyHeaderSize])
+        return Header{ExpireAt: int64(sec) * 1000}, data[legacyHeaderSize:], nil
+    }
+    if len(data) < 2 {
+        return Header{}, nil, ErrCorruptData
+    }
+    if data[1] != HeaderVersion {
+        return Header{}, nil, ErrUnsupportedVersion
+    }
+    if len(data) < headerSize {
+        return Header{}, nil, ErrCorruptData
+    }
+    h := Header{
+        Version:  data[1],
+        Flags:    data[2],
+        ExpireAt: int64(binary.BigEndian.Uint64(data[3:headerSize])),
+    }
+    val := data[headerSize:]
+    if h.Flags&FlagChecksum != 0 {
+        if len(val) < checksumSize {
+            return Header{}, nil, ErrCorruptData
+        }
+        sum := binary.BigEndian.Uint32(val[:checksumSize])
+        if val = val[checksumSize:]; crc32.ChecksumIEEE(val) != sum {
+            return Header{}, nil, ErrCorruptData
+        }
+    }
+    return h, val, nil
+}
+
+// ReadData 解析数据并检查是否过期; 无法解析时返回 ErrCorruptData 或 ErrUnsupportedVersion, 此时 expired 为 false
+func ReadData(val []byte) (value []byte, expired bool, err error) {
+    h, value, err := DecodeData(val)
+    if err != nil {
+        return nil, false, err
+    }
+    return value, h.Expired(GetTimeNow()), nil
+}
+
+// IsExpired 数据可以解析且已过期; 无法解析的数据不算过期, 不能当作过期删除
+func IsExpired(val []byte) bool {
+    _, expired, err := ReadData(val)
+    return err == nil && expired
+}
+
+// SplitData 解析数据并检查是否过期, 第二个返回值为过期时间的 Unix 秒; 无法解析的数据返回 false,
+// 需要区分过期和无法解析时使用 ReadData
 func SplitData(val []byte) (bool, int, []byte) {
-    if len(val) == 0 {
+    h, data, err := DecodeData(val)
+    if err != nil {
         return false, 0, nil
     }
-    ttl, data := val[:4], val[4:]
-    sec := binary.BigEndian.Uint32(ttl)
-    if sec > 0 && time.Unix(int64(sec), 0).Before(GetTimeNow()) {
-        return false, int(sec), data
+    sec := int(h.ExpireAt / 1000)
+    if h.Expired(GetTimeNow()) {
+        return false, sec, data
     }
-    return true, int(sec), data
+    return true, sec, data
 }
+
+// CombineData 按当前版本编码, ttl 精确到毫秒, 不足 1 毫秒的 ttl 按 1 毫秒计
 func CombineData(ttl time.Duration, val []byte) []byte {
-    buf := bytes.Buffer{}
-    ttlByte := make([]byte, 4)
+    h := Header{}
     if ttl > 0 {
-        sec := int64(ttl) / int64(time.Second)
-        expireAt := uint32(GetTimeNow().Unix() + sec)
-        binary.BigEndian.PutUint32(ttlByte, expireAt)
+        if ttl < time.Millisecond {
+            ttl = time.Millisecond
+        }
+        h.ExpireAt = GetTimeNow().Add(ttl).UnixNano() / int64(time.Millisecond)
+    }
+    return EncodeData(h, val)
+}
+
+// ReplaceValue 替换 CombineData 编码的数据中的 value, 保留原有的过期时间和标记; 旧格式会升级为当前版本
+func ReplaceValue(data []byte, val []byte) []byte {
+    h, _, _ := DecodeData(data)
+    return EncodeData(h, val)
+}
+
+// ValueOf 数据中的 value, 不检查是否过期; 无法解析时返回 nil
+func ValueOf(data []byte) []byte {
+    _, val, err := DecodeData(data)
+    if err != nil {
+        return nil
+    }
+    return val
+}
+
+// ExpireAtMillis 数据的过期时间 (Unix 毫秒), 0 表示永不过期
+func ExpireAtMillis(data []byte) int64 {
+    h, _, err := DecodeData(data)
+    if err != nil {
+        return 0
+    }
+    return h.ExpireAt
+}
+
+// IsLegacyData 数据是否为旧的 4 字节秒级格式
+func IsLegacyData(data []byte) bool {
+    return len(data) >= legacyHeaderSize && data[0] != HeaderMagic
+}
+
+// UpgradeData 把旧格式的数据转换为当前版本, 过期时间不变; 不需要转换时返回 false
+func UpgradeData(data []byte) ([]byte, bool) {
+    if !IsLegacyData(data) {
+        return data, false
     }
-    buf.Write(ttlByte)
-    buf.Write(val)
-    return buf.Bytes()
+    h, val, _ := DecodeData(data)
+    return EncodeData(h, val), true
 }
+
 func CopyBytes(data []byte) []byte {
     result := make([]byte, len(data))
     copy(result, data)
@@ -38,3 +186,20 @@ func CopyBytes(data []byte) []byte {
 func GetTimeNow() time.Time {
     return time.Now()
 }
+
+// SetExpireAt 修改数据的过期时间, 保留 value 和标记; at 为零值时去掉过期时间,
+// at 不晚于当前时间时返回 nil, 表示应当删除
+func SetExpireAt(data []byte, at time.Time) []byte {
+    if !at.IsZero() && !at.After(GetTimeNow()) {
+        return nil
+    }
+    h, val, err := DecodeData(data)
+    if err != nil {
+        return nil
+    }
+    h.ExpireAt = 0
+    if !at.IsZero() {
+        h.ExpireAt = (at.UnixNano() + int64(time.Millisecond) - 1) / int64(time.Millisecond)
+    }
+    return EncodeData(h, val)
+}
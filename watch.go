@@ -0,0 +1,147 @@
+package store
+
+import (
+    "context"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+type (
+    // EventType 变更类型
+    EventType int
+    // Event key 的一次变更
+    Event struct {
+        Type EventType
+        Key  string
+        // Size 写入后 value 的字节数, 移除类事件为 0, 后端无法得知时为 -1
+        Size int64
+        // Revision 同一个 Store 内单调递增, 同一个 key 的事件按生效顺序递增
+        Revision uint64
+    }
+    // WatchStore 可以订阅 key 前缀变更的后端
+    WatchStore interface {
+        Store
+        // Watch 返回 prefix 下的变更事件, ctx 结束或 Store 关闭时 channel 被关闭;
+        // 消费跟不上导致缓冲区满时 channel 也会被关闭, 调用方应重新读取数据后再次订阅
+        Watch(ctx context.Context, prefix string) <-chan Event
+    }
+    // Watchers 后端持有的订阅者列表, 零值可用; 后端在写入生效的临界区内 Publish, 保证同一 key 的事件有序
+    Watchers struct {
+        rev  uint64
+        n    int32
+        mu   sync.Mutex
+        subs map[*watcher]struct{}
+    }
+    watcher struct {
+        prefix string
+        ch     chan Event
+        done   chan struct{}
+    }
+)
+
+const (
+    EventPut EventType = iota
+    EventDelete
+    EventExpire
+    // EventEvict key 因容量限制被淘汰
+    EventEvict
+)
+
+// WatchBuffer 每个订阅者的缓冲事件数
+const WatchBuffer = 1024
+
+func (t EventType) String() string {
+    switch t {
+    case EventPut:
+        return "put"
+    case EventDelete:
+        return "delete"
+    case EventExpire:
+        return "expire"
+    case EventEvict:
+        return "evict"
+    }
+    return "unknown"
+}
+
+// Watch s 不支持时返回 ErrNotSupported
+func Watch(ctx context.Context, s Store, prefix string) (<-chan Event, error) {
+    ws, ok := s.(WatchStore)
+    if !ok {
+        return nil, ErrNotSupported
+    }
+    return ws.Watch(ctx, prefix), nil
+}
+
+// Watch 注册订阅者, ctx 结束时注销并关闭 channel
+func (h *Watchers) Watch(ctx context.Context, prefix string) <-chan Event {
+    w := &watcher{
+        prefix: prefix,
+        ch:     make(chan Event, WatchBuffer),
+        done:   make(chan struct{}),
+    }
+    h.mu.Lock()
+    if h.subs == nil {
+        h.subs = map[*watcher]struct{}{}
+    }
+    h.subs[w] = struct{}{}
+    atomic.AddInt32(&h.n, 1)
+    h.mu.Unlock()
+    go func() {
+        select {
+        case <-ctx.Done():
+            h.mu.Lock()
+            h.remove(w)
+            h.mu.Unlock()
+        case <-w.done:
+        }
+    }()
+    return w.ch
+}
+
+// Publish 分配 revision 并投递给前缀匹配的订阅者, 不会阻塞; 缓冲区满的订阅者被注销
+func (h *Watchers) Publish(t EventType, key string, size int64) {
+    if atomic.LoadInt32(&h.n) == 0 {
+        atomic.AddUint64(&h.rev, 1)
+        return
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    ev := Event{Type: t, Key: key, Size: size, Revision: atomic.AddUint64(&h.rev, 1)}
+    for w := range h.subs {
+        if !strings.HasPrefix(key, w.prefix) {
+            continue
+        }
+        select {
+        case w.ch <- ev:
+        default:
+            h.remove(w)
+        }
+    }
+}
+
+// Revision 最后一次发布的 revision
+func (h *Watchers) Revision() uint64 {
+    return atomic.LoadUint64(&h.rev)
+}
+
+// Close 注销并关闭所有订阅者, 后端 Close 时调用
+func (h *Watchers) Close() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for w := range h.subs {
+        h.remove(w)
+    }
+}
+
+// remove 调用方持有 h.mu
+func (h *Watchers) remove(w *watcher) {
+    if _, ok := h.subs[w]; !ok {
+        return
+    }
+    delete(h.subs, w)
+    atomic.AddInt32(&h.n, -1)
+    close(w.ch)
+    close(w.done)
+}